@@ -2,8 +2,8 @@ package config
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sync"
 )
@@ -14,13 +14,56 @@ type Config struct {
 	AgentDir             string                 `json:"agent-dir"`    // Source directory where agents do their work
 	PipelineDir          string                 `json:"pipeline-dir"` // Source directory where pipelines cache the results of commands that should run once
 	ReportDir            string                 `json:"report-dir"`
+	PreservedDir         string                 `json:"preserved-dir"`  // Directory where the workspaces kept after a run are moved. Defaults to a sibling of the agent directory
+	JournalDir           string                 `json:"journal-dir"`    // Directory where the runs being executed are written down. Defaults to a sibling of the agent directory
+	PersistentDir        string                 `json:"persistent-dir"` // Directory where the persistent workspaces are kept between runs. Defaults to a sibling of the agent directory
+	CacheDir             string                 `json:"cache-dir"`      // Directory where the outputs of the cached stages are stored. Defaults to a sibling of the agent directory
 	JerminalResourcePath string                 `json:"-"`
 	AgentResourcePath    string                 `json:"-"`
 	GithubWebhookSecret  string                 `json:"github-webhook-secret"` // pour l'authentification des webhooks github
 	Secret               string                 `json:"secret"`
+	AgentSelection       string                 `json:"agent-selection"` // Strategy selecting the agents of the runs. Defaults to least-recently-used
+	Pools                []Pool                 `json:"pools"`           // Agents created when runs wait for one, and retired once idle
+	Provisioning         []string               `json:"provisioning"`    // Methods tried in order to put the cache of the pipelines in the workspaces. Defaults to reflink, cow-hardlink then copy
 	UserParams           map[string]interface{} `json:"project"`
 }
 
+// PreservedDirectory gives back the directory where the workspaces
+// kept after a run are moved
+func (c *Config) PreservedDirectory() string {
+	if c.PreservedDir != "" {
+		return c.PreservedDir
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(c.AgentDir)), "preserved")
+}
+
+// JournalDirectory gives back the directory where the runs being
+// executed are written down, to recover from a crash of the server
+func (c *Config) JournalDirectory() string {
+	if c.JournalDir != "" {
+		return c.JournalDir
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(c.AgentDir)), "journal")
+}
+
+// PersistentDirectory gives back the directory where the persistent
+// workspaces of the pipelines are kept between runs
+func (c *Config) PersistentDirectory() string {
+	if c.PersistentDir != "" {
+		return c.PersistentDir
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(c.AgentDir)), "workspaces")
+}
+
+// CacheDirectory gives back the directory where the outputs
+// of the stages using CacheOn are stored
+func (c *Config) CacheDirectory() string {
+	if c.CacheDir != "" {
+		return c.CacheDir
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(c.AgentDir)), "cache")
+}
+
 type Project struct {
 }
 
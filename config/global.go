@@ -7,23 +7,90 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // GlobalStateProvider represents global config of the application
 type GlobalStateProvider struct {
 	*Config
-	agents map[string]*Agent // map of identifiers to their agent
+	agents    map[string]*Agent // map of identifiers to their agent
+	releaseMu sync.Mutex        // Protects released
+	released  chan struct{}     // Closed whenever an agent gets released, then replaced
+
+	strategy       Strategy // Selects the agents given to the runs
+	strategyName   string   // agent-selection of the config the strategy was built from
+	customStrategy bool     // true if the strategy was set by SetStrategy
+
+	agentsVersion string              // Version of agents.json the agents were read from
+	demand        map[string][]string // Labels asked by the runs that could not get an agent since the pools were last scaled, by run
 }
 
 // Agent represents a process that executes a pipeline in its personal directory
 // and cleans it up afterward. The Identifier uniquely identifies the agent.
 type Agent struct {
 	sync.Mutex
-	BusySig    *sync.Cond           `json:"-"`          // Signal informing if the Agent is busy
-	Identifier string               `json:"identifier"` // unique string representing an Agent
-	Busy       bool                 `json:"-"`          // true if the agent is executing a pipeline
-	State      *GlobalStateProvider `json:"-"`          // The application config
+	BusySig    *sync.Cond           `json:"-"`                 // Signal informing if the Agent is busy
+	Identifier string               `json:"identifier"`        // unique string representing an Agent
+	Busy       bool                 `json:"-"`                 // true if every executor of the agent is executing a pipeline
+	Executors  int                  `json:"executors"`         // Number of pipelines the agent can execute at the same time. Defaults to 1
+	Weight     int                  `json:"weight"`            // Share of the runs the agent gets with the weighted selection. Defaults to 1
+	State      *GlobalStateProvider `json:"-"`                 // The application config
+	Sandbox    *Sandbox             `json:"sandbox,omitempty"` // Isolation of the commands executed by the agent. Nil if not sandboxed
+	Limits     *Limits              `json:"limits,omitempty"`  // Resources the commands executed by the agent can use. Nil if unlimited
+	Labels     []string             `json:"labels,omitempty"`  // Capabilities of the agent, used to select it
+	Remote     Remote               `json:"-"`                 // Connection to the machine of the agent. Nil if it runs in the server process
+	slots      []bool               // true for the executors executing a pipeline
+	lastUsed   time.Time            // Last time one of the executors got acquired
+	configured bool                 // true if the agent comes from agents.json
+	draining   bool                 // true if the agent got removed from agents.json. It disappears once its runs ended
+	pool       string               // Prefix of the pool that created the agent. Empty if it does not come from a pool
+	idleSince  time.Time            // Last time the agent stopped executing pipelines
+	resizing   *int                 // Number of executors applied once the agent is idle. Nil if none is waiting
+}
+
+// Executor is a slot of an agent. A run holds one for
+// its whole duration, and works in its workspace
+type Executor struct {
+	*Agent
+	Slot      int    `json:"slot"` // Number of the executor, starting at 1
+	workspace string // Directory of the executor, relative to the one of the agents
+}
+
+// AgentUsage tells which executors of an agent are running a pipeline
+type AgentUsage struct {
+	Identifier string   `json:"identifier"`
+	Labels     []string `json:"labels,omitempty"`
+	Remote     bool     `json:"remote"`         // true if the agent runs on another machine
+	Executors  int      `json:"executors"`      // Number of executors of the agent
+	Busy       []int    `json:"busy"`           // Slots of the executors running a pipeline
+	Draining   bool     `json:"draining"`       // true if the agent disappears once its runs ended
+	Pool       string   `json:"pool,omitempty"` // Prefix of the pool that created the agent
+}
+
+// Limits restricts the resources of each command executed by an agent.
+//
+// Zero values mean no limit
+type Limits struct {
+	CPUTime      uint64 `json:"cpu-time"`      // CPU time, in seconds
+	AddressSpace uint64 `json:"address-space"` // Virtual memory of each process, in bytes
+	Memory       uint64 `json:"memory"`        // Memory actually used by the command and its children, in bytes. Needs a cgroup v2
+	OpenFiles    uint64 `json:"open-files"`    // Number of file descriptors
+	Processes    uint64 `json:"processes"`     // Number of processes. Without a cgroup v2, counts all the processes of the user of the server
+	WallTime     uint64 `json:"wall-time"`     // Real time, in seconds
+}
+
+// Sandbox configures the isolation of the commands executed by an agent.
+//
+// Commands run in new mount, PID and network namespaces, with the
+// workspace of the agent writable and the rest of the filesystem read-only
+type Sandbox struct {
+	Network       bool     `json:"network"`        // Keeps access to the network of the host
+	WritablePaths []string `json:"writable-paths"` // Paths of the host, other than the workspace, the commands can write in
 }
 
 var (
@@ -37,19 +104,14 @@ const DEFAULT_AGENT = "6524a5fc-0772-4684-82d7-6900c444162b"
 //
 // SHOULD ONLY BE CALLED ONCE
 func initializeApplicationState(conf *Config) error {
-	agents := []*Agent{}
 	config = &GlobalStateProvider{
 		Config: conf,
 	}
 
 	// Getting the agents from the config file
-	file, err := os.ReadFile(conf.AgentResourcePath)
+	config.agentsVersion = fileVersion(conf.AgentResourcePath)
+	agents, err := readAgents(conf.AgentResourcePath)
 	if err != nil {
-		fmt.Printf("err: %v\n", err)
-		return errors.New("Process should have a ./resources/agents.json file in order to work. Check the docs to set it up")
-	}
-
-	if err = json.Unmarshal(file, &agents); err != nil {
 		return err
 	}
 
@@ -65,13 +127,7 @@ func initializeApplicationState(conf *Config) error {
 	agentMap[DEFAULT_AGENT] = defaultAgent
 
 	for _, agent := range agents {
-		newAgent := &Agent{
-			Identifier: agent.Identifier,
-			Busy:       false,
-			State:      config,
-		}
-		newAgent.BusySig = sync.NewCond(&newAgent.Mutex)
-		agentMap[newAgent.Identifier] = newAgent
+		agentMap[agent.Identifier] = config.configuredAgent(agent)
 	}
 
 	config.agents = agentMap
@@ -212,43 +268,203 @@ func GetStateCustomConf(conf *Config) *GlobalStateProvider {
 	return config
 }
 
-// Initialize first waits until the agent has finished his
-// previous work, then creates the directory it will work in
-func (a *Agent) Initialize() (string, error) {
-	// Wait until the agent is no longer busy
+// Initialize first waits until one of the executors of the agent has
+// finished its previous work, then creates the directory it will work in
+func (a *Agent) Initialize() (*Executor, string, error) {
+	// Wait until an executor is no longer busy
 	a.Lock()
-	for a.Busy {
+	executor := a.acquire()
+	for executor == nil {
 		a.BusySig.Wait()
+		executor = a.acquire()
 	}
-	a.Busy = true
 	a.Unlock()
 
-	// Create the agent directory
-	path := path.Join(a.State.AgentDir, a.Identifier)
+	path, err := executor.Prepare()
+	return executor, path, err
+}
+
+// TryAcquire marks a free executor of the agent as busy without waiting.
+//
+// Returns nil if every executor was already busy
+func (a *Agent) TryAcquire() *Executor {
+	a.Lock()
+	defer a.Unlock()
+	return a.acquire()
+}
+
+// acquire takes the first free executor of the agent
+//
+// MUST BE CALLED WITH THE LOCK OF THE AGENT
+func (a *Agent) acquire() *Executor {
+	if a.draining || a.resizing != nil {
+		return nil
+	}
+	executors := max(a.Executors, 1)
+	for len(a.slots) < executors {
+		a.slots = append(a.slots, false)
+	}
+	for i := 0; i < executors; i++ {
+		if a.slots[i] {
+			continue
+		}
+		a.slots[i] = true
+		a.lastUsed = time.Now()
+		a.updateBusy()
+		executor := &Executor{Agent: a, Slot: i + 1, workspace: a.Identifier}
+		// Agents with a single executor keep their directory as workspace
+		if executors > 1 {
+			executor.workspace = path.Join(a.Identifier, strconv.Itoa(i+1))
+		}
+		return executor
+	}
+	return nil
+}
+
+// usedExecutors gives back the number of executors executing a pipeline
+//
+// MUST BE CALLED WITH THE LOCK OF THE AGENT
+func (a *Agent) usedExecutors() int {
+	used := 0
+	for _, slot := range a.slots {
+		if slot {
+			used++
+		}
+	}
+	return used
+}
+
+// updateBusy marks the agent as busy if all of its executors are,
+// or if it is draining or waiting to be resized
+//
+// MUST BE CALLED WITH THE LOCK OF THE AGENT
+func (a *Agent) updateBusy() {
+	a.Busy = a.draining || a.resizing != nil || a.usedExecutors() >= max(a.Executors, 1)
+}
+
+// WorkspaceName gives back the directory of the executor,
+// relative to the one of the agents
+func (e *Executor) WorkspaceName() string {
+	return e.workspace
+}
+
+// Prepare creates the directory the executor will work in.
+//
+// The executor must have been acquired beforehand, either with
+// Initialize or TryAcquire
+func (e *Executor) Prepare() (string, error) {
+	if e.Remote != nil {
+		return e.Remote.Prepare(e.workspace)
+	}
+	path := path.Join(e.State.AgentDir, e.workspace)
 	infos, err := os.Stat(path)
 	if err == nil {
 		return "", errors.New(fmt.Sprintf("directory should not exist, agent has not cleaned up his directory from previous job. %s", infos.Name()))
 	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", err
+	}
 	return path, os.Mkdir(path, os.ModePerm)
 }
 
-// CleanUp sends a signal to tell it is not busy anymore,
-// and cleans up it's directory
-func (a *Agent) CleanUp() error {
-
-	defer a.Unlock()
-	a.Lock()
+// CleanUp cleans up the directory of the executor, then
+// sends a signal to tell it is not busy anymore.
+// The executor is released even if its directory could not be removed
+func (e *Executor) CleanUp() error {
 	fmt.Println("Cleaning up")
 
-	path := path.Join(a.State.AgentDir, a.Identifier)
-	err := os.RemoveAll(path)
+	// Removing the workspace can take a while, especially on a remote agent,
+	// so the other executors of the agent must not wait for it
+	var err error
+	if e.Remote != nil {
+		err = e.Remote.CleanUp(e.workspace)
+	} else {
+		err = os.RemoveAll(path.Join(e.State.AgentDir, e.workspace))
+	}
 	if err != nil {
-		return err
+		fmt.Printf("Failed to clean up the workspace %s of agent %s: %v\n", e.workspace, e.Identifier, err)
 	}
-	a.Busy = false
-	a.BusySig.Signal()
 
-	return nil
+	e.Lock()
+	// The directory of the agent would keep a single executor from preparing its
+	// workspace. The other executors can't be preparing theirs while it is the last one used
+	if err == nil && e.Remote == nil && e.workspace != e.Identifier && e.usedExecutors() == 1 {
+		os.Remove(path.Join(e.State.AgentDir, e.Identifier))
+	}
+	e.slots[e.Slot-1] = false
+	if e.resizing != nil && !e.inUse() {
+		e.Executors = *e.resizing
+		e.resizing = nil
+	}
+	e.updateBusy()
+	e.BusySig.Broadcast()
+	drained := e.draining && !e.inUse()
+	if !e.inUse() {
+		e.idleSince = time.Now()
+	}
+	e.Unlock()
+
+	if drained {
+		e.State.removeDrained(e.Agent)
+	}
+	e.State.notifyRelease()
+	return err
+}
+
+// Usage tells which executors of the agent are running a pipeline
+func (a *Agent) Usage() AgentUsage {
+	a.Lock()
+	defer a.Unlock()
+	usage := AgentUsage{
+		Identifier: a.Identifier,
+		Labels:     a.Labels,
+		Remote:     a.Remote != nil,
+		Executors:  max(a.Executors, 1),
+		Busy:       []int{},
+		Draining:   a.draining,
+		Pool:       a.pool,
+	}
+	for i, slot := range a.slots {
+		if slot {
+			usage.Busy = append(usage.Busy, i+1)
+		}
+	}
+	return usage
+}
+
+// AgentsUsage gives back the usage of every agent, by identifier
+func (s *GlobalStateProvider) AgentsUsage() []AgentUsage {
+	s.Lock()
+	defer s.Unlock()
+	usages := make([]AgentUsage, 0, len(s.agents))
+	for _, agent := range s.agents {
+		usages = append(usages, agent.Usage())
+	}
+	slices.SortFunc(usages, func(a, b AgentUsage) int {
+		return strings.Compare(a.Identifier, b.Identifier)
+	})
+	return usages
+}
+
+// AgentReleased gives back a channel that gets closed the next
+// time an agent is released
+func (s *GlobalStateProvider) AgentReleased() <-chan struct{} {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	if s.released == nil {
+		s.released = make(chan struct{})
+	}
+	return s.released
+}
+
+// notifyRelease wakes up everything waiting for an agent to be released
+func (s *GlobalStateProvider) notifyRelease() {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	if s.released != nil {
+		close(s.released)
+	}
+	s.released = make(chan struct{})
 }
 
 // GetAgent returns an agent from the map of agents
@@ -272,23 +488,58 @@ func (s *GlobalStateProvider) GetAgent(id string) *Agent {
 	return ag
 }
 
-// Gets the first non busy existing agent
-//
-// If every agent is busy, gets the default agent
-func (s *GlobalStateProvider) GetAnyAgent() *Agent {
+// AddAgent registers an agent. Gives back an error if
+// an agent with the same identifier already exists
+func (s *GlobalStateProvider) AddAgent(agent *Agent) error {
+	s.Lock()
+	if _, ok := s.agents[agent.Identifier]; ok {
+		s.Unlock()
+		return fmt.Errorf("Agent %s is already registered", agent.Identifier)
+	}
+	agent.State = s
+	if agent.BusySig == nil {
+		agent.BusySig = sync.NewCond(&agent.Mutex)
+	}
+	s.agents[agent.Identifier] = agent
+	s.Unlock()
+
+	s.notifyRelease()
+	return nil
+}
+
+// RemoveAgent unregisters an agent. Runs that already
+// reserved it keep it until they end
+func (s *GlobalStateProvider) RemoveAgent(agent *Agent) {
+	s.Lock()
+	defer s.Unlock()
+	if s.agents[agent.Identifier] == agent {
+		delete(s.agents, agent.Identifier)
+	}
+}
+
+// HasLabels tells if the agent carries every one of the labels
+func (a *Agent) HasLabels(labels ...string) bool {
+	for _, label := range labels {
+		if !slices.Contains(a.Labels, label) {
+			return false
+		}
+	}
+	return true
+}
 
+// AgentsWithLabels gives back every agent carrying all of the labels,
+// busy or not
+func (s *GlobalStateProvider) AgentsWithLabels(labels ...string) []*Agent {
 	s.Lock()
 	defer s.Unlock()
 
+	agents := []*Agent{}
 	for _, agent := range s.agents {
-		agent.Lock()
-		available := !agent.Busy
-		agent.Unlock()
-		if available {
-			return agent
+		if agent.HasLabels(labels...) {
+			agents = append(agents, agent)
 		}
 	}
-	return s.agents[DEFAULT_AGENT]
+	return agents
 }
 
 // Gets the default agent back
@@ -302,19 +553,25 @@ func (s *GlobalStateProvider) DefaultAgent() *Agent {
 // allowing for the pipeline to stay coherent even if a change
 // to the config is made during it's runtime
 func (s *GlobalStateProvider) CloneConfig() *Config {
-	s.Lock()
-	defer s.Unlock()
-	s.Config.Lock()
-	defer s.Config.Unlock()
+	// The lock of the state is the one of its config
+	s.RLock()
+	defer s.RUnlock()
 	conf := Config{
 		RWMutex:              sync.RWMutex{},
 		AgentDir:             s.AgentDir,
 		PipelineDir:          s.PipelineDir,
 		ReportDir:            s.ReportDir,
+		PreservedDir:         s.PreservedDir,
+		JournalDir:           s.JournalDir,
+		PersistentDir:        s.PersistentDir,
+		CacheDir:             s.CacheDir,
 		JerminalResourcePath: s.JerminalResourcePath,
 		AgentResourcePath:    s.AgentResourcePath,
 		GithubWebhookSecret:  s.GithubWebhookSecret,
 		Secret:               s.Secret,
+		AgentSelection:       s.AgentSelection,
+		Pools:                slices.Clone(s.Pools),
+		Provisioning:         slices.Clone(s.Provisioning),
 		UserParams:           s.UserParams,
 	}
 	return &conf
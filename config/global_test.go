@@ -1,8 +1,12 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/Cyber-cicco/jerminal/utils"
 )
@@ -22,11 +26,11 @@ func TestAgentLifeCycle(t *testing.T) {
 
 	STATE.UpdateConfig()
 	a := STATE.GetAgent("test")
-	actualPath, err := a.Initialize()
+	executor, actualPath, err := a.Initialize()
     utils.FatalError(err, t)
     utils.FatalExpectedActual(expectedPath, actualPath, t)
 
-    err = a.CleanUp()
+    err = executor.CleanUp()
     utils.FatalError(err, t)
 
     if _test_count < 2 {
@@ -35,3 +39,122 @@ func TestAgentLifeCycle(t *testing.T) {
     }
 
 }
+
+func TestAgentsWithLabels(t *testing.T) {
+	state := GlobalStateProvider{
+		Config: &Config{},
+		agents: make(map[string]*Agent),
+	}
+	state.GetAgent("go").Labels = []string{"go1.23", "docker"}
+	state.GetAgent("big").Labels = []string{"go1.23", "big-disk"}
+
+	utils.FatalExpectedActual(2, len(state.AgentsWithLabels("go1.23")), t)
+	utils.FatalExpectedActual(2, len(state.AgentsWithLabels()), t)
+
+	agents := state.AgentsWithLabels("go1.23", "big-disk")
+	utils.FatalExpectedActual(1, len(agents), t)
+	utils.FatalExpectedActual("big", agents[0].Identifier, t)
+	utils.FatalExpectedActual(0, len(state.AgentsWithLabels("windows")), t)
+}
+
+func TestAgentExecutors(t *testing.T) {
+	state := GlobalStateProvider{
+		Config: &Config{AgentDir: t.TempDir()},
+		agents: make(map[string]*Agent),
+	}
+	agent := state.GetAgent("multi")
+	agent.Executors = 2
+
+	first, firstPath, err := agent.Initialize()
+	utils.FatalError(err, t)
+	second := agent.TryAcquire()
+	if second == nil {
+		t.Fatal("agent should have a second executor")
+	}
+	secondPath, err := second.Prepare()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(path.Join(state.AgentDir, "multi", "1"), firstPath, t)
+	utils.FatalExpectedActual(path.Join(state.AgentDir, "multi", "2"), secondPath, t)
+
+	if agent.TryAcquire() != nil {
+		t.Fatal("every executor of the agent should be busy")
+	}
+	utils.FatalExpectedActual(true, agent.Busy, t)
+	utils.FatalExpectedActual(2, len(agent.Usage().Busy), t)
+
+	utils.FatalError(first.CleanUp(), t)
+	_, err = os.Stat(firstPath)
+	utils.FatalNoError(err, "workspace of the executor should have been removed", t)
+	usage := state.AgentsUsage()
+	utils.FatalExpectedActual(1, len(usage), t)
+	utils.FatalExpectedActual(1, len(usage[0].Busy), t)
+	utils.FatalExpectedActual(2, usage[0].Busy[0], t)
+
+	third := agent.TryAcquire()
+	if third == nil {
+		t.Fatal("released executor should be available")
+	}
+	utils.FatalExpectedActual(1, third.Slot, t)
+	utils.FatalError(third.CleanUp(), t)
+	utils.FatalError(second.CleanUp(), t)
+	utils.FatalExpectedActual(false, agent.Busy, t)
+}
+
+// _test_failingRemote can't remove its workspaces, and looks at the
+// agent while doing so
+type _test_failingRemote struct {
+	agent *Agent
+}
+
+func (r *_test_failingRemote) Prepare(workspace string) (string, error) {
+	return workspace, nil
+}
+
+func (r *_test_failingRemote) CleanUp(workspace string) error {
+	r.agent.Usage()
+	return errors.New("Connection lost")
+}
+
+func (r *_test_failingRemote) Exec(ctx context.Context, req ExecRequest) (*ExecResult, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (r *_test_failingRemote) IsDir(path string) (bool, error) {
+	return false, nil
+}
+
+func (r *_test_failingRemote) PutFiles(dir string, archive []byte) error {
+	return nil
+}
+
+func (r *_test_failingRemote) GetFiles(path string) ([]byte, error) {
+	return nil, nil
+}
+
+func TestCleanUpFailure(t *testing.T) {
+	state := GlobalStateProvider{
+		Config: &Config{AgentDir: t.TempDir()},
+		agents: make(map[string]*Agent),
+	}
+	agent := state.GetAgent("remote")
+	agent.Remote = &_test_failingRemote{agent: agent}
+
+	executor, _, err := agent.Initialize()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(true, agent.Busy, t)
+
+	done := make(chan error)
+	go func() {
+		done <- executor.CleanUp()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("clean up of the remote workspace should not hold the lock of the agent")
+	}
+	utils.FatalNoError(err, "failed clean up should be reported", t)
+	utils.FatalExpectedActual(false, agent.Busy, t)
+	if agent.TryAcquire() == nil {
+		t.Fatal("executor should be released even if its clean up failed")
+	}
+}
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	POOL_SCALE_INTERVAL  = time.Second // Time between two scalings of the pools
+	DEFAULT_IDLE_TIMEOUT = 300         // Seconds an agent of a pool stays idle before being retired
+)
+
+// Pool creates agents on demand when runs wait for one, and
+// retires them once they stayed idle for a while.
+//
+// Its agents are named <prefix>-<n>
+type Pool struct {
+	Prefix      string   `json:"prefix"`
+	Min         int      `json:"min"`               // Agents kept even when idle
+	Max         int      `json:"max"`               // Agents the pool never goes past. Defaults to min
+	Labels      []string `json:"labels,omitempty"`  // Labels of the agents of the pool
+	Executors   int      `json:"executors"`         // Executors of each agent of the pool. Defaults to 1
+	Limits      *Limits  `json:"limits,omitempty"`  // Limits of the agents of the pool
+	Sandbox     *Sandbox `json:"sandbox,omitempty"` // Sandbox of the agents of the pool
+	IdleTimeout int      `json:"idle-timeout"`      // Seconds an agent above the minimum stays idle before being retired. Defaults to 300
+}
+
+// PoolScaling tells which agents got created and retired by the pools
+type PoolScaling struct {
+	Created []string `json:"created"`
+	Retired []string `json:"retired"`
+}
+
+func (p *PoolScaling) String() string {
+	return fmt.Sprintf("Pools scaled : created %v, retired %v", p.Created, p.Retired)
+}
+
+// idleTimeout gives back the time an agent of the pool
+// above the minimum stays idle before being retired
+func (p *Pool) idleTimeout() time.Duration {
+	if p.IdleTimeout <= 0 {
+		return DEFAULT_IDLE_TIMEOUT * time.Second
+	}
+	return time.Duration(p.IdleTimeout) * time.Second
+}
+
+// matches tells if the agents of the pool carry every one of the labels
+func (p *Pool) matches(labels []string) bool {
+	for _, label := range labels {
+		if !slices.Contains(p.Labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// CanProvideLabels tells if an agent carrying every one of the labels
+// exists, or can be created by one of the pools
+func (s *GlobalStateProvider) CanProvideLabels(labels ...string) bool {
+	if len(s.AgentsWithLabels(labels...)) > 0 {
+		return true
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for i := range s.Pools {
+		if s.Pools[i].Prefix != "" && max(s.Pools[i].Max, s.Pools[i].Min) > 0 && s.Pools[i].matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordDemand writes down that the run of the selection could not get an agent
+func (s *GlobalStateProvider) recordDemand(sel Selection) {
+	s.Lock()
+	defer s.Unlock()
+	if s.demand == nil {
+		s.demand = make(map[string][]string)
+	}
+	// A run can ask for an agent several times while waiting,
+	// and for several ones with parallel stages
+	key := sel.Run + "|" + strings.Join(sel.Labels, ",")
+	s.demand[key] = sel.Labels
+}
+
+// poolAgent creates a new agent of the pool
+//
+// MUST BE CALLED WITH THE LOCK OF THE STATE
+func (s *GlobalStateProvider) poolAgent(pool *Pool, now time.Time) *Agent {
+	n := 1
+	for s.agents[fmt.Sprintf("%s-%d", pool.Prefix, n)] != nil {
+		n++
+	}
+	agent := &Agent{
+		Identifier: fmt.Sprintf("%s-%d", pool.Prefix, n),
+		State:      s,
+		Labels:     pool.Labels,
+		Executors:  pool.Executors,
+		Limits:     pool.Limits,
+		Sandbox:    pool.Sandbox,
+		pool:       pool.Prefix,
+		idleSince:  now,
+	}
+	agent.BusySig = sync.NewCond(&agent.Mutex)
+	return agent
+}
+
+// ScalePools creates agents in the pools for the runs that could not
+// get one, and retires the agents that stayed idle for too long
+func (s *GlobalStateProvider) ScalePools() *PoolScaling {
+	return s.scalePools(time.Now())
+}
+
+func (s *GlobalStateProvider) scalePools(now time.Time) *PoolScaling {
+	scaling := &PoolScaling{Created: []string{}, Retired: []string{}}
+	s.Lock()
+	pools := s.Pools
+	demand := s.demand
+	s.demand = nil
+
+	members := make(map[string][]*Agent)
+	for _, agent := range s.agents {
+		if agent.pool != "" {
+			members[agent.pool] = append(members[agent.pool], agent)
+		}
+	}
+
+	// Each waiting run is counted by the first pool that can take it
+	needed := make([]int, len(pools))
+	for _, labels := range demand {
+		for i := range pools {
+			if pools[i].Prefix != "" && pools[i].matches(labels) {
+				needed[i]++
+				break
+			}
+		}
+	}
+
+	configured := make(map[string]*Pool, len(pools))
+	for i := range pools {
+		pool := &pools[i]
+		if pool.Prefix == "" || configured[pool.Prefix] != nil {
+			continue
+		}
+		configured[pool.Prefix] = pool
+		agents := members[pool.Prefix]
+		free := 0
+		for _, agent := range agents {
+			agent.Lock()
+			if !agent.draining {
+				busy := 0
+				for _, slot := range agent.slots {
+					if slot {
+						busy++
+					}
+				}
+				free += max(agent.Executors, 1) - busy
+			}
+			agent.Unlock()
+		}
+		executors := max(pool.Executors, 1)
+		missing := (needed[i] - free + executors - 1) / executors
+		count := max(pool.Min-len(agents), missing, 0)
+		count = min(count, max(pool.Max, pool.Min)-len(agents))
+		for ; count > 0; count-- {
+			agent := s.poolAgent(pool, now)
+			s.agents[agent.Identifier] = agent
+			scaling.Created = append(scaling.Created, agent.Identifier)
+		}
+	}
+
+	// Agents of pools removed from the config get retired as soon as they are idle
+	for prefix, agents := range members {
+		keep, timeout := 0, time.Duration(0)
+		if pool := configured[prefix]; pool != nil {
+			keep, timeout = pool.Min, pool.idleTimeout()
+		}
+		// The agents idle for the longest time go first
+		slices.SortFunc(agents, func(a, b *Agent) int {
+			return a.idleSince.Compare(b.idleSince)
+		})
+		count := len(agents)
+		for _, agent := range agents {
+			if count <= keep {
+				break
+			}
+			agent.Lock()
+			if !agent.inUse() && now.Sub(agent.idleSince) >= timeout {
+				agent.draining = true
+				agent.updateBusy()
+				delete(s.agents, agent.Identifier)
+				scaling.Retired = append(scaling.Retired, agent.Identifier)
+				count--
+			}
+			agent.Unlock()
+		}
+	}
+	agentDir := s.AgentDir
+	s.Unlock()
+
+	// Agents with several executors keep their workspaces in a directory of their own
+	for _, id := range scaling.Retired {
+		os.Remove(filepath.Join(agentDir, id))
+	}
+	slices.Sort(scaling.Created)
+	slices.Sort(scaling.Retired)
+	if len(scaling.Created) > 0 {
+		s.notifyRelease()
+	}
+	return scaling
+}
+
+// RunPools scales the pools at each interval until the context is done
+func (s *GlobalStateProvider) RunPools(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		scaling := s.ScalePools()
+		if len(scaling.Created) > 0 || len(scaling.Retired) > 0 {
+			fmt.Println(scaling)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func _test_poolState(t *testing.T, pools ...Pool) *GlobalStateProvider {
+	state := _test_selectionState()
+	state.AgentDir = t.TempDir()
+	state.Pools = pools
+	return state
+}
+
+func TestPoolScaling(t *testing.T) {
+	state := _test_poolState(t, Pool{Prefix: "pool", Min: 1, Max: 3, Labels: []string{"docker"}, IdleTimeout: 60})
+	now := time.Now()
+
+	// The minimum gets created right away
+	scaling := state.scalePools(now)
+	utils.FatalExpectedActual("[pool-1]", _test_ids(scaling.Created), t)
+	utils.FatalExpectedActual(true, state.CanProvideLabels("docker"), t)
+	utils.FatalExpectedActual(false, state.CanProvideLabels("gpu"), t)
+
+	// Runs waiting for an agent make the pool grow, up to its maximum
+	executors := []*Executor{}
+	for _, run := range []string{"r1", "r2", "r3", "r4"} {
+		sel := Selection{Labels: []string{"docker"}, Run: run}
+		executor := state.AcquireAnyAgent(sel)
+		// Asking several times while waiting counts once
+		state.AcquireAnyAgent(sel)
+		if executor != nil {
+			executors = append(executors, executor)
+		}
+	}
+	utils.FatalExpectedActual(1, len(executors), t)
+	scaling = state.scalePools(now)
+	utils.FatalExpectedActual("[pool-2 pool-3]", _test_ids(scaling.Created), t)
+	for _, id := range []string{"pool-2", "pool-3"} {
+		executor := state.GetAgent(id).TryAcquire()
+		utils.FatalExpectedActual(true, executor != nil, t)
+		executors = append(executors, executor)
+	}
+	scaling = state.scalePools(now)
+	utils.FatalExpectedActual(0, len(scaling.Created), t)
+
+	// Idle agents get retired once the timeout passed, down to the minimum
+	for _, executor := range executors {
+		utils.FatalError(executor.CleanUp(), t)
+	}
+	scaling = state.scalePools(time.Now())
+	utils.FatalExpectedActual(0, len(scaling.Retired), t)
+	scaling = state.scalePools(time.Now().Add(time.Minute))
+	utils.FatalExpectedActual(2, len(scaling.Retired), t)
+	utils.FatalExpectedActual(1, len(state.AgentsWithLabels("docker")), t)
+
+	// Agents of removed pools get retired as soon as they are idle
+	state.Pools = nil
+	busy := state.AgentsWithLabels("docker")[0].TryAcquire()
+	scaling = state.scalePools(time.Now())
+	utils.FatalExpectedActual(0, len(scaling.Retired), t)
+	utils.FatalError(busy.CleanUp(), t)
+	scaling = state.scalePools(time.Now())
+	utils.FatalExpectedActual(1, len(scaling.Retired), t)
+	utils.FatalExpectedActual(0, len(state.AgentsWithLabels("docker")), t)
+}
+
+func TestPoolCountsFreeExecutors(t *testing.T) {
+	state := _test_poolState(t, Pool{Prefix: "wide", Max: 4, Executors: 3})
+	for _, run := range []string{"r1", "r2", "r3", "r4"} {
+		state.AcquireAnyAgent(Selection{Run: run})
+	}
+	scaling := state.scalePools(time.Now())
+	utils.FatalExpectedActual("[wide-1 wide-2]", _test_ids(scaling.Created), t)
+
+	// The free executors of the new agents are enough for
+	// the runs that did not take them yet
+	for _, run := range []string{"r1", "r2", "r3", "r4"} {
+		state.recordDemand(Selection{Run: run})
+	}
+	scaling = state.scalePools(time.Now())
+	utils.FatalExpectedActual(0, len(scaling.Created), t)
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Time between two checks of agents.json for changes
+const AGENTS_POLL_INTERVAL = 5 * time.Second
+
+// AgentsReload tells what changed in the agents when agents.json got read again
+type AgentsReload struct {
+	Added    []string `json:"added"`
+	Updated  []string `json:"updated"`  // Agents whose labels, limits, sandbox, executors or weight changed
+	Draining []string `json:"draining"` // Agents that disappear once their runs ended
+	Removed  []string `json:"removed"`
+}
+
+func (r *AgentsReload) String() string {
+	return fmt.Sprintf("Agents reloaded : added %v, updated %v, draining %v, removed %v", r.Added, r.Updated, r.Draining, r.Removed)
+}
+
+// readAgents reads the agents of agents.json
+func readAgents(path string) ([]*Agent, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		return nil, errors.New("Process should have a ./resources/agents.json file in order to work. Check the docs to set it up")
+	}
+	agents := []*Agent{}
+	if err = json.Unmarshal(file, &agents); err != nil {
+		return nil, err
+	}
+	for _, agent := range agents {
+		if agent.Identifier == "" {
+			return nil, errors.New("Agents of agents.json must have an identifier")
+		}
+	}
+	return agents, nil
+}
+
+// configuredAgent creates an agent of the state from one of agents.json
+func (s *GlobalStateProvider) configuredAgent(agent *Agent) *Agent {
+	newAgent := &Agent{
+		Identifier: agent.Identifier,
+		Busy:       false,
+		State:      s,
+		configured: true,
+	}
+	newAgent.BusySig = sync.NewCond(&newAgent.Mutex)
+	newAgent.configure(agent)
+	return newAgent
+}
+
+// configure applies the settings of the agent of agents.json, and
+// gives back true if any of them changed.
+//
+// A number of executors moving the workspaces while some of them are used
+// waits for the agent to be idle, and the agent gets no run until then
+//
+// MUST BE CALLED WITH THE LOCK OF THE AGENT
+func (a *Agent) configure(agent *Agent) bool {
+	executors := a.Executors
+	if a.resizing != nil {
+		executors = *a.resizing
+	}
+	changed := !slices.Equal(a.Labels, agent.Labels) ||
+		!reflect.DeepEqual(a.Limits, agent.Limits) ||
+		!reflect.DeepEqual(a.Sandbox, agent.Sandbox) ||
+		executors != agent.Executors ||
+		a.Weight != agent.Weight
+	a.Labels = agent.Labels
+	a.Limits = agent.Limits
+	a.Sandbox = agent.Sandbox
+	a.resizing = nil
+	if a.inUse() && movesWorkspaces(a.Executors, agent.Executors) {
+		executors := agent.Executors
+		a.resizing = &executors
+	} else {
+		a.Executors = agent.Executors
+	}
+	a.Weight = agent.Weight
+	a.updateBusy()
+	return changed
+}
+
+// movesWorkspaces tells if changing the number of executors changes
+// the directory of the workspaces. A single executor works in the
+// directory of the agent, and the others in one of its subdirectories
+func movesWorkspaces(from, to int) bool {
+	return (max(from, 1) > 1) != (max(to, 1) > 1)
+}
+
+// inUse tells if one of the executors of the agent is executing a pipeline
+//
+// MUST BE CALLED WITH THE LOCK OF THE AGENT
+func (a *Agent) inUse() bool {
+	return slices.Contains(a.slots, true)
+}
+
+// ReloadAgents reads agents.json again. New agents get added and the
+// settings of the existing ones updated. Agents removed from the file
+// stop getting runs, and disappear once their current runs ended.
+//
+// Agents that don't come from agents.json, like the remote ones, are left as is
+func (s *GlobalStateProvider) ReloadAgents() (*AgentsReload, error) {
+	path := s.CloneConfig().AgentResourcePath
+	// Taken before reading, so a change made meanwhile gets reloaded too
+	version := fileVersion(path)
+	agents, err := readAgents(path)
+	if err != nil {
+		return nil, err
+	}
+	reload := &AgentsReload{Added: []string{}, Updated: []string{}, Draining: []string{}, Removed: []string{}}
+
+	s.Lock()
+	s.agentsVersion = version
+	inFile := make(map[string]bool, len(agents))
+	for _, agent := range agents {
+		inFile[agent.Identifier] = true
+		existing, ok := s.agents[agent.Identifier]
+		if !ok {
+			s.agents[agent.Identifier] = s.configuredAgent(agent)
+			reload.Added = append(reload.Added, agent.Identifier)
+			continue
+		}
+		existing.Lock()
+		if existing.Remote == nil {
+			wasDraining := existing.draining
+			existing.configured = true
+			existing.draining = false
+			if existing.configure(agent) || wasDraining {
+				reload.Updated = append(reload.Updated, agent.Identifier)
+			}
+		}
+		existing.Unlock()
+	}
+	for id, agent := range s.agents {
+		if inFile[id] {
+			continue
+		}
+		agent.Lock()
+		if agent.configured && !agent.draining {
+			agent.draining = true
+			agent.updateBusy()
+			if agent.inUse() {
+				reload.Draining = append(reload.Draining, id)
+			} else {
+				delete(s.agents, id)
+				reload.Removed = append(reload.Removed, id)
+			}
+		}
+		agent.Unlock()
+	}
+	s.Unlock()
+
+	for _, ids := range [][]string{reload.Added, reload.Updated, reload.Draining, reload.Removed} {
+		slices.Sort(ids)
+	}
+	// Added agents and executors can take the waiting runs
+	s.notifyRelease()
+	return reload, nil
+}
+
+// removeDrained removes the agent once it is not used anymore,
+// unless it got back in agents.json in the meantime
+func (s *GlobalStateProvider) removeDrained(agent *Agent) {
+	s.Lock()
+	defer s.Unlock()
+	agent.Lock()
+	defer agent.Unlock()
+	if agent.draining && !agent.inUse() && s.agents[agent.Identifier] == agent {
+		delete(s.agents, agent.Identifier)
+	}
+}
+
+// WatchAgents reloads agents.json every time it changes, checking it
+// at each interval until the context is done
+func (s *GlobalStateProvider) WatchAgents(ctx context.Context, interval time.Duration) {
+	path := s.CloneConfig().AgentResourcePath
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.RLock()
+		loaded := s.agentsVersion
+		s.RUnlock()
+		if fileVersion(path) == loaded {
+			continue
+		}
+		reload, err := s.ReloadAgents()
+		if err != nil {
+			fmt.Printf("Agents could not be reloaded because of error %v\n", err)
+			continue
+		}
+		fmt.Println(reload)
+	}
+}
+
+// fileVersion gives back something that changes with the content of
+// the file. Empty if the file can't be read
+func fileVersion(path string) string {
+	infos, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%v|%d", infos.ModTime(), infos.Size())
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+// _test_reloadState gives back a state with the agents of the json
+func _test_reloadState(agents string, t *testing.T) *GlobalStateProvider {
+	dir := t.TempDir()
+	agentsPath := filepath.Join(dir, "agents.json")
+	utils.FatalError(os.WriteFile(agentsPath, []byte(agents), 0644), t)
+	return GetStateCustomConf(&Config{
+		AgentDir:          filepath.Join(dir, "agent"),
+		AgentResourcePath: agentsPath,
+	})
+}
+
+func _test_hasAgent(state *GlobalStateProvider, id string) bool {
+	for _, usage := range state.AgentsUsage() {
+		if usage.Identifier == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReloadAgents(t *testing.T) {
+	state := _test_reloadState(`[{"identifier": "a", "labels": ["x"]}, {"identifier": "b"}, {"identifier": "idle"}]`, t)
+	busy := state.GetAgent("b").TryAcquire()
+	state.GetAgent("adhoc")
+
+	os.WriteFile(state.AgentResourcePath, []byte(`[
+		{"identifier": "a", "labels": ["y"], "executors": 2, "limits": {"wall-time": 10}},
+		{"identifier": "c"}
+	]`), 0644)
+	reload, err := state.ReloadAgents()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("[c]", _test_ids(reload.Added), t)
+	utils.FatalExpectedActual("[a]", _test_ids(reload.Updated), t)
+	utils.FatalExpectedActual("[b]", _test_ids(reload.Draining), t)
+	utils.FatalExpectedActual("[idle]", _test_ids(reload.Removed), t)
+
+	// Settings of the existing agents changed
+	a := state.GetAgent("a")
+	utils.FatalExpectedActual(true, a.HasLabels("y"), t)
+	utils.FatalExpectedActual(2, a.Executors, t)
+	utils.FatalExpectedActual(uint64(10), a.Limits.WallTime, t)
+
+	// Draining agents don't get runs, and disappear once their run ended
+	b := state.GetAgent("b")
+	if b.TryAcquire() != nil {
+		t.Fatal("draining agent should not get runs")
+	}
+	utils.FatalExpectedActual(true, _test_hasAgent(state, "b"), t)
+	utils.FatalError(busy.CleanUp(), t)
+	utils.FatalExpectedActual(false, _test_hasAgent(state, "b"), t)
+	utils.FatalExpectedActual(false, _test_hasAgent(state, "idle"), t)
+
+	// Agents that don't come from agents.json are left as is
+	utils.FatalExpectedActual(true, _test_hasAgent(state, "adhoc"), t)
+
+	// Invalid files don't change anything
+	os.WriteFile(state.AgentResourcePath, []byte(`[{"labels": ["x"]}]`), 0644)
+	_, err = state.ReloadAgents()
+	utils.FatalNoError(err, "agents without identifier should be refused", t)
+	utils.FatalExpectedActual(true, _test_hasAgent(state, "c"), t)
+}
+
+func TestDrainingAgentAddedBack(t *testing.T) {
+	state := _test_reloadState(`[{"identifier": "a"}]`, t)
+	busy := state.GetAgent("a").TryAcquire()
+
+	os.WriteFile(state.AgentResourcePath, []byte(`[]`), 0644)
+	reload, err := state.ReloadAgents()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("[a]", _test_ids(reload.Draining), t)
+
+	os.WriteFile(state.AgentResourcePath, []byte(`[{"identifier": "a"}]`), 0644)
+	reload, err = state.ReloadAgents()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("[a]", _test_ids(reload.Updated), t)
+
+	utils.FatalError(busy.CleanUp(), t)
+	utils.FatalExpectedActual(true, _test_hasAgent(state, "a"), t)
+	if state.GetAgent("a").TryAcquire() == nil {
+		t.Fatal("agent added back should get runs")
+	}
+}
+
+func TestReloadExecutorsWhileBusy(t *testing.T) {
+	state := _test_reloadState(`[{"identifier": "a", "executors": 1}, {"identifier": "b", "executors": 2}]`, t)
+	a := state.GetAgent("a")
+	running, _, err := a.Initialize()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("a", running.WorkspaceName(), t)
+
+	// The new workspaces would be inside the one being used
+	os.WriteFile(state.AgentResourcePath, []byte(`[{"identifier": "a", "executors": 2}, {"identifier": "b", "executors": 3}]`), 0644)
+	reload, err := state.ReloadAgents()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("[a b]", _test_ids(reload.Updated), t)
+	utils.FatalExpectedActual(1, a.Executors, t)
+	if a.TryAcquire() != nil {
+		t.Fatal("agent waiting to be resized should not get runs")
+	}
+
+	utils.FatalError(running.CleanUp(), t)
+	utils.FatalExpectedActual(2, a.Executors, t)
+	first, _, err := a.Initialize()
+	utils.FatalError(err, t)
+	second, _, err := a.Initialize()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("a/1", first.WorkspaceName(), t)
+	utils.FatalExpectedActual("a/2", second.WorkspaceName(), t)
+
+	// Going back to a single executor waits for both of them
+	os.WriteFile(state.AgentResourcePath, []byte(`[{"identifier": "a", "executors": 1}, {"identifier": "b", "executors": 3}]`), 0644)
+	_, err = state.ReloadAgents()
+	utils.FatalError(err, t)
+	utils.FatalError(first.CleanUp(), t)
+	utils.FatalExpectedActual(2, a.Executors, t)
+	utils.FatalError(second.CleanUp(), t)
+	utils.FatalExpectedActual(1, a.Executors, t)
+	running, path, err := a.Initialize()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(filepath.Join(state.AgentDir, "a"), path, t)
+	utils.FatalError(running.CleanUp(), t)
+
+	// Workspaces of several executors stay where they are
+	utils.FatalExpectedActual(3, state.GetAgent("b").Executors, t)
+}
+
+func TestWatchAgents(t *testing.T) {
+	state := _test_reloadState(`[]`, t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go state.WatchAgents(ctx, 10*time.Millisecond)
+
+	os.WriteFile(state.AgentResourcePath, []byte(`[{"identifier": "watched"}]`), 0644)
+	deadline := time.Now().Add(5 * time.Second)
+	for !_test_hasAgent(state, "watched") {
+		if time.Now().After(deadline) {
+			t.Fatal("agent should have been added once agents.json changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// _test_ids formats the identifiers so they can be compared
+func _test_ids(ids []string) string {
+	return fmt.Sprint(ids)
+}
@@ -0,0 +1,31 @@
+package config
+
+import "context"
+
+// Remote is the connection to an agent running on another machine.
+//
+// Paths are the ones of the machine of the agent
+type Remote interface {
+	Prepare(workspace string) (string, error)                       // Creates a workspace, relative to the directory of the agent, and gives back its path
+	CleanUp(workspace string) error                                 // Removes a workspace, relative to the directory of the agent
+	Exec(ctx context.Context, req ExecRequest) (*ExecResult, error) // Executes a command. It gets killed if ctx is done
+	IsDir(path string) (bool, error)                                // Tells if the path is an existing directory
+	PutFiles(dir string, archive []byte) error                      // Extracts an archive made by utils.Tar in dir
+	GetFiles(path string) ([]byte, error)                           // Gives back an archive of the file or of the directory
+}
+
+// ExecRequest is a command to execute on a remote agent
+type ExecRequest struct {
+	Workspace string   `json:"workspace"` // Workspace of the agent the command runs for
+	Dir       string   `json:"dir"`       // Directory the command runs in
+	Name      string   `json:"name"`
+	Args      []string `json:"args"`
+}
+
+// ExecResult is what a command executed by a remote agent ended with
+type ExecResult struct {
+	Output  []byte `json:"output"`            // Standard output and error of the command
+	Error   string `json:"error,omitempty"`   // Error the command ended with. Empty if it succeeded
+	Limit   string `json:"limit,omitempty"`   // Limit of the agent the command went over, if any
+	Warning string `json:"warning,omitempty"` // Why the limits of the agent are not all enforced, if they aren't
+}
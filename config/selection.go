@@ -0,0 +1,223 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the strategies, used as agent-selection in jerminal.json
+const (
+	STRATEGY_LRU         = "least-recently-used"
+	STRATEGY_ROUND_ROBIN = "round-robin"
+	STRATEGY_AFFINITY    = "affinity"
+	STRATEGY_WEIGHTED    = "weighted"
+)
+
+// Selection is what a strategy knows about the run asking for an agent
+type Selection struct {
+	Pipeline  string   // Name of the pipeline
+	Labels    []string // Labels the agent must carry
+	LastAgent string   // Agent that executed the previous run of the pipeline. Empty if unknown
+	Run       string   // Id of the run asking for an agent
+}
+
+// Strategy orders the agents by preference. The run gets the
+// first of them with a free executor
+type Strategy interface {
+	Order(agents []*Agent, sel Selection) []*Agent
+}
+
+// chooser is implemented by the strategies that need
+// to know which agent got the run
+type chooser interface {
+	chosen(agent *Agent)
+}
+
+// StrategyNamed gives back the strategy with the name. An
+// empty name gives back the default one, least recently used
+func StrategyNamed(name string) (Strategy, error) {
+	switch name {
+	case "", STRATEGY_LRU:
+		return LeastRecentlyUsed(), nil
+	case STRATEGY_ROUND_ROBIN:
+		return RoundRobin(), nil
+	case STRATEGY_AFFINITY:
+		return Affinity(LeastRecentlyUsed()), nil
+	case STRATEGY_WEIGHTED:
+		return Weighted(), nil
+	}
+	return nil, fmt.Errorf("Unknown agent selection strategy %s", name)
+}
+
+type lruStrategy struct{}
+
+// LeastRecentlyUsed prefers the agents that got a run the longest time ago
+func LeastRecentlyUsed() Strategy {
+	return lruStrategy{}
+}
+
+func (lruStrategy) Order(agents []*Agent, sel Selection) []*Agent {
+	lastUsed := make(map[*Agent]time.Time, len(agents))
+	for _, agent := range agents {
+		agent.Lock()
+		lastUsed[agent] = agent.lastUsed
+		agent.Unlock()
+	}
+	ordered := slices.Clone(agents)
+	slices.SortStableFunc(ordered, func(a, b *Agent) int {
+		return lastUsed[a].Compare(lastUsed[b])
+	})
+	return ordered
+}
+
+type roundRobinStrategy struct {
+	sync.Mutex
+	last string // Identifier of the last agent that got a run
+}
+
+// RoundRobin gives the runs to the agents one after the
+// other, by order of identifier
+func RoundRobin() Strategy {
+	return &roundRobinStrategy{}
+}
+
+func (r *roundRobinStrategy) Order(agents []*Agent, sel Selection) []*Agent {
+	r.Lock()
+	defer r.Unlock()
+	next := slices.IndexFunc(agents, func(a *Agent) bool {
+		return strings.Compare(a.Identifier, r.last) > 0
+	})
+	if next < 0 {
+		next = 0
+	}
+	return append(slices.Clone(agents[next:]), agents[:next]...)
+}
+
+func (r *roundRobinStrategy) chosen(agent *Agent) {
+	r.Lock()
+	defer r.Unlock()
+	r.last = agent.Identifier
+}
+
+type affinityStrategy struct {
+	fallback Strategy
+}
+
+// Affinity prefers the agent that executed the previous run of the
+// pipeline, so it finds its caches warm. The other agents are
+// ordered by the fallback strategy
+func Affinity(fallback Strategy) Strategy {
+	return &affinityStrategy{fallback: fallback}
+}
+
+func (a *affinityStrategy) Order(agents []*Agent, sel Selection) []*Agent {
+	ordered := a.fallback.Order(agents, sel)
+	i := slices.IndexFunc(ordered, func(agent *Agent) bool {
+		return agent.Identifier == sel.LastAgent
+	})
+	if i > 0 {
+		last := ordered[i]
+		ordered = append([]*Agent{last}, slices.Delete(ordered, i, i+1)...)
+	}
+	return ordered
+}
+
+func (a *affinityStrategy) chosen(agent *Agent) {
+	if c, ok := a.fallback.(chooser); ok {
+		c.chosen(agent)
+	}
+}
+
+type weightedStrategy struct{}
+
+// Weighted picks the agents at random, proportionally to their weight
+func Weighted() Strategy {
+	return weightedStrategy{}
+}
+
+func (weightedStrategy) Order(agents []*Agent, sel Selection) []*Agent {
+	// Sorting by u^(1/weight) draws the agents without replacement,
+	// each one with a probability proportional to its weight
+	keys := make(map[*Agent]float64, len(agents))
+	for _, agent := range agents {
+		weight := agent.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		keys[agent] = math.Pow(rand.Float64(), 1/float64(weight))
+	}
+	ordered := slices.Clone(agents)
+	slices.SortFunc(ordered, func(a, b *Agent) int {
+		if keys[a] > keys[b] {
+			return -1
+		}
+		if keys[a] < keys[b] {
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+// SetStrategy changes the way agents get selected, instead of
+// the agent-selection of the config
+func (s *GlobalStateProvider) SetStrategy(strategy Strategy) {
+	s.Lock()
+	defer s.Unlock()
+	s.strategy = strategy
+	s.customStrategy = strategy != nil
+}
+
+// currentStrategy gives back the strategy selecting the agents,
+// built again if the agent-selection of the config changed
+//
+// MUST BE CALLED WITH THE LOCK OF THE STATE
+func (s *GlobalStateProvider) currentStrategy() Strategy {
+	if s.customStrategy || (s.strategy != nil && s.strategyName == s.AgentSelection) {
+		return s.strategy
+	}
+	strategy, err := StrategyNamed(s.AgentSelection)
+	if err != nil {
+		fmt.Printf("%v, using %s\n", err, STRATEGY_LRU)
+		strategy = LeastRecentlyUsed()
+	}
+	s.strategy = strategy
+	s.strategyName = s.AgentSelection
+	return strategy
+}
+
+// AcquireAnyAgent gives back a free executor of the agent preferred by
+// the strategy among the ones carrying the labels of the selection.
+//
+// Returns nil if every one of them is busy. The pools then
+// know that the run waits for an agent
+func (s *GlobalStateProvider) AcquireAnyAgent(sel Selection) *Executor {
+	s.Lock()
+	strategy := s.currentStrategy()
+	agents := []*Agent{}
+	for _, agent := range s.agents {
+		if agent.HasLabels(sel.Labels...) {
+			agents = append(agents, agent)
+		}
+	}
+	s.Unlock()
+
+	slices.SortFunc(agents, func(a, b *Agent) int {
+		return strings.Compare(a.Identifier, b.Identifier)
+	})
+	for _, agent := range strategy.Order(agents, sel) {
+		if executor := agent.TryAcquire(); executor != nil {
+			if c, ok := strategy.(chooser); ok {
+				c.chosen(agent)
+			}
+			return executor
+		}
+	}
+	s.recordDemand(sel)
+	return nil
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func _test_selectionState(ids ...string) *GlobalStateProvider {
+	state := &GlobalStateProvider{
+		Config: &Config{},
+		agents: make(map[string]*Agent),
+	}
+	for _, id := range ids {
+		state.GetAgent(id)
+	}
+	return state
+}
+
+// _test_acquireAndRelease gives back the agent the state selects,
+// releasing its executor right away
+func _test_acquireAndRelease(state *GlobalStateProvider, sel Selection, t *testing.T) string {
+	executor := state.AcquireAnyAgent(sel)
+	if executor == nil {
+		t.Fatal("an agent should have been selected")
+	}
+	executor.Lock()
+	executor.slots[executor.Slot-1] = false
+	executor.updateBusy()
+	executor.Unlock()
+	return executor.Identifier
+}
+
+func TestLeastRecentlyUsed(t *testing.T) {
+	state := _test_selectionState("a", "b", "c")
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[_test_acquireAndRelease(state, Selection{}, t)] = true
+	}
+	utils.FatalExpectedActual(3, len(seen), t)
+}
+
+func TestRoundRobin(t *testing.T) {
+	state := _test_selectionState("a", "b", "c")
+	state.SetStrategy(RoundRobin())
+	expected := []string{"a", "b", "c", "a"}
+	for _, id := range expected {
+		utils.FatalExpectedActual(id, _test_acquireAndRelease(state, Selection{}, t), t)
+	}
+
+	// Busy agents are skipped
+	busy := state.GetAgent("b").TryAcquire()
+	utils.FatalExpectedActual("c", _test_acquireAndRelease(state, Selection{}, t), t)
+	utils.FatalExpectedActual("a", _test_acquireAndRelease(state, Selection{}, t), t)
+	utils.FatalExpectedActual("c", _test_acquireAndRelease(state, Selection{}, t), t)
+	utils.FatalExpectedActual(true, busy != nil, t)
+}
+
+func TestAffinity(t *testing.T) {
+	state := _test_selectionState("a", "b", "c")
+	state.SetStrategy(Affinity(RoundRobin()))
+	for i := 0; i < 3; i++ {
+		utils.FatalExpectedActual("b", _test_acquireAndRelease(state, Selection{LastAgent: "b"}, t), t)
+	}
+
+	// Falls back to another agent when the last one is busy
+	state.GetAgent("b").TryAcquire()
+	if id := _test_acquireAndRelease(state, Selection{LastAgent: "b"}, t); id == "b" {
+		t.Fatal("busy agent should not be selected")
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	state := _test_selectionState("light", "heavy")
+	state.GetAgent("heavy").Weight = 9
+	state.AgentSelection = STRATEGY_WEIGHTED
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[_test_acquireAndRelease(state, Selection{}, t)]++
+	}
+	if counts["heavy"] < 800 || counts["light"] < 50 {
+		t.Fatalf("runs should be shared by weight, got %v", counts)
+	}
+}
+
+func TestNoFallbackToBusyAgent(t *testing.T) {
+	state := _test_selectionState(DEFAULT_AGENT, "labeled")
+	state.GetAgent("labeled").Labels = []string{"docker"}
+	state.GetAgent("labeled").TryAcquire()
+
+	sel := Selection{Labels: []string{"docker"}}
+	if state.AcquireAnyAgent(sel) != nil {
+		t.Fatal("no agent should be given when every matching one is busy")
+	}
+	state.GetAgent(DEFAULT_AGENT).TryAcquire()
+	if state.AcquireAnyAgent(Selection{}) != nil {
+		t.Fatal("the default agent should not be given when busy")
+	}
+}
+
+func TestStrategyNamed(t *testing.T) {
+	for _, name := range []string{"", STRATEGY_LRU, STRATEGY_ROUND_ROBIN, STRATEGY_AFFINITY, STRATEGY_WEIGHTED} {
+		_, err := StrategyNamed(name)
+		utils.FatalError(err, t)
+	}
+	_, err := StrategyNamed("random")
+	utils.FatalNoError(err, "unknown strategies should give back an error", t)
+}
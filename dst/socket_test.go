@@ -164,7 +164,7 @@ func TestSocketsProcesses(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Should not have gotten error, got %v", err)
 	}
-	if p.Inerror {
+	if p.Status != SUCCESS {
 		p.Diagnostic.Log()
 		t.Fatalf("Pipeline got error")
 	}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/remote"
+)
+
+var (
+	serverFlag   string
+	secretFlag   string
+	nameFlag     string
+	labelsFlag   string
+	capacityFlag int
+	dirFlag      string
+	agentFlag    string
+)
+
+func init() {
+	hostname, _ := os.Hostname()
+	homeDirEnv := os.Getenv("HOME")
+
+	flag.StringVar(&serverFlag, "server", "localhost:8093", "Address the jerminal server listens for agents on")
+	flag.StringVar(&secretFlag, "secret", "$JERMINAL_SECRET", "Secret of the server. Prefix it with $ to read it from an env variable")
+	flag.StringVar(&nameFlag, "name", hostname, "Name of the agent")
+	flag.StringVar(&labelsFlag, "labels", "", "Comma separated labels of the agent")
+	flag.IntVar(&capacityFlag, "capacity", 1, "Number of runs the agent can execute at the same time")
+	flag.StringVar(&dirFlag, "dir", homeDirEnv+"/.jerminal/remote-agent", "Directory the workspaces get created in")
+	flag.StringVar(&agentFlag, "agent", "", "Json file with the limits and the sandbox of the agent, in the format of agents.json")
+}
+
+func main() {
+	flag.Parse()
+
+	daemon := &remote.Daemon{
+		Address:  serverFlag,
+		Secret:   os.ExpandEnv(secretFlag),
+		Name:     nameFlag,
+		Capacity: capacityFlag,
+		Dir:      dirFlag,
+	}
+	if labelsFlag != "" {
+		daemon.Labels = strings.Split(labelsFlag, ",")
+	}
+	if agentFlag != "" {
+		file, err := os.ReadFile(agentFlag)
+		if err != nil {
+			fmt.Printf("Could not read the agent file : %v\n", err)
+			os.Exit(1)
+		}
+		daemon.Agent = &config.Agent{}
+		if err = json.Unmarshal(file, daemon.Agent); err != nil {
+			fmt.Printf("Could not parse the agent file : %v\n", err)
+			os.Exit(1)
+		}
+		daemon.Labels = append(daemon.Labels, daemon.Agent.Labels...)
+	}
+	if daemon.Secret == "" {
+		fmt.Println("The secret of the server is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := daemon.Run(ctx)
+	if err != nil && ctx.Err() == nil {
+		fmt.Printf("Agent stopped because of error %v\n", err)
+		os.Exit(1)
+	}
+}
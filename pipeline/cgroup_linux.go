@@ -0,0 +1,129 @@
+//go:build linux
+
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/google/uuid"
+)
+
+const CGROUP_ROOT = "/sys/fs/cgroup"
+
+// cgroup is a cgroup v2 created under the cgroup of the server
+// for a single command
+type cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// newCgroup creates a cgroup with the memory and processes limits.
+//
+// Gives back nil if there are no such limits, and an error if cgroups v2
+// are not available, or if the cgroup of the server does not let it create
+// sub cgroups
+func newCgroup(limits *config.Limits) (*cgroup, error) {
+	if limits.Memory == 0 && limits.Processes == 0 {
+		return nil, nil
+	}
+	if _, err := os.Stat(filepath.Join(CGROUP_ROOT, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroups v2 are not available : %w", err)
+	}
+	parent, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	cg := &cgroup{path: filepath.Join(parent, "jerminal-"+uuid.NewString())}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create a cgroup : %w", err)
+	}
+	files := map[string]uint64{"memory.max": limits.Memory, "pids.max": limits.Processes}
+	for file, val := range files {
+		if val == 0 {
+			continue
+		}
+		err := os.WriteFile(filepath.Join(cg.path, file), []byte(strconv.FormatUint(val, 10)), 0644)
+		if err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("Could not set %s of the cgroup : %w", file, err)
+		}
+	}
+	cg.dir, err = os.Open(cg.path)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+// ownCgroup gives back the path of the cgroup v2 of the server
+func ownCgroup() (string, error) {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(CGROUP_ROOT, path), nil
+		}
+	}
+	return "", fmt.Errorf("No cgroup v2 found")
+}
+
+// attach makes the command start directly in the cgroup
+func (cg *cgroup) attach(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+	return nil
+}
+
+// violatedLimit tells if the kernel had to enforce one of the
+// limits of the cgroup
+func (cg *cgroup) violatedLimit() string {
+	if cg.event("memory.events", "oom_kill") > 0 {
+		return LIMIT_MEMORY
+	}
+	if cg.event("pids.events", "max") > 0 {
+		return LIMIT_PROCESSES
+	}
+	return ""
+}
+
+// event reads a counter in one of the event files of the cgroup
+func (cg *cgroup) event(file, name string) int {
+	f, err := os.Open(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == name {
+			count, _ := strconv.Atoi(fields[1])
+			return count
+		}
+	}
+	return 0
+}
+
+// remove deletes the cgroup. Processes left in it get killed first
+func (cg *cgroup) remove() {
+	if cg.dir != nil {
+		cg.dir.Close()
+		cg.dir = nil
+	}
+	os.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0644)
+	os.Remove(cg.path)
+}
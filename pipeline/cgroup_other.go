@@ -0,0 +1,30 @@
+//go:build !linux
+
+package pipeline
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/Cyber-cicco/jerminal/config"
+)
+
+// cgroup only exists on Linux
+type cgroup struct{}
+
+func newCgroup(limits *config.Limits) (*cgroup, error) {
+	if limits.Memory == 0 && limits.Processes == 0 {
+		return nil, nil
+	}
+	return nil, errors.New("cgroups only exist on Linux")
+}
+
+func (cg *cgroup) attach(cmd *exec.Cmd) error {
+	return nil
+}
+
+func (cg *cgroup) violatedLimit() string {
+	return ""
+}
+
+func (cg *cgroup) remove() {}
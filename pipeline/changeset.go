@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Files changed since the last successful run, relative to the root
+// of the repository. Missing if they are not known
+const ChangedFilesKey = Key("ChangedFiles")
+
+// SetChangedFiles tells which files changed since the last successful
+// run, like the ones listed by the payload of a push webhook.
+//
+// Nil means they are not known, so every stage gets executed
+func (p *Pipeline) SetChangedFiles(files []string) {
+	if files == nil {
+		return
+	}
+	files = slices.Clone(files)
+	slices.Sort(files)
+	p.Put(ChangedFilesKey, slices.Compact(files))
+}
+
+// ChangedFiles gives back the files changed since the last successful
+// run, and false if they are not known
+func (p *Pipeline) ChangedFiles() ([]string, bool) {
+	files, err := GetAs[[]string](p.PipelineParams, ChangedFilesKey)
+	return files, err == nil
+}
+
+// checkChangedFiles forgets the changed files given with the run if the
+// previous run did not succeed, or if there is none. The files changed
+// since the last successful run are not only those ones then
+func (p *Pipeline) checkChangedFiles(diag *Diagnostic) {
+	if _, known := p.ChangedFiles(); !known {
+		return
+	}
+	last := GetStore().LastRun(p.Name, p.StartTime)
+	if last != nil && last == GetStore().LastSuccessfulRun(p.Name, p.StartTime) {
+		return
+	}
+	p.remove(ChangedFilesKey)
+	diag.LogEvent(INFO, "Previous run did not succeed, the changed files given with the run are ignored")
+}
+
+// previousCommit gives back the commit checked out by the last
+// successful run of the pipeline, or an empty string if there is none
+func (p *Pipeline) previousCommit() string {
+	run := GetStore().LastSuccessfulRun(p.Name, p.StartTime)
+	if run == nil {
+		return ""
+	}
+	commit, _ := run.Params[GitCommitKey].(string)
+	return commit
+}
+
+// OnChanges only executes the stage if one of the changed files matches
+// one of the patterns. Otherwise it gets skipped.
+//
+// Patterns are relative to the root of the repository, with / as separator.
+// ** matches any number of directories, and a pattern ending with /
+// matches everything in the directory. The stage always gets executed
+// if the changed files are not known
+func (s *stage) OnChanges(patterns ...string) *stage {
+	s.changes = append(s.changes, patterns...)
+	return s
+}
+
+// skippedByChanges tells if none of the changed files
+// concern the stage, and why
+func (s *stage) skippedByChanges(p *Pipeline) (bool, string) {
+	if len(s.changes) == 0 {
+		return false, ""
+	}
+	files, known := p.ChangedFiles()
+	if !known {
+		return false, ""
+	}
+	for _, file := range files {
+		for _, pattern := range s.changes {
+			if matchChange(pattern, file) {
+				return false, ""
+			}
+		}
+	}
+	return true, fmt.Sprintf("Skipped because none of the %d changed files match %s", len(files), strings.Join(s.changes, ", "))
+}
+
+// matchChange tells if the file matches the pattern of OnChanges
+func matchChange(pattern, file string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/"); ok {
+		pattern = dir + "/**"
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(file, "/"))
+}
+
+func matchSegments(pattern, file []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Tries every number of directories it can stand for
+			for i := 0; i <= len(file); i++ {
+				if matchSegments(pattern[1:], file[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(file) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], file[0]); !ok {
+			return false
+		}
+		pattern, file = pattern[1:], file[1:]
+	}
+	return len(file) == 0
+}
@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func TestMatchChange(t *testing.T) {
+	for _, c := range []struct {
+		pattern, file string
+		match         bool
+	}{
+		{"services/api/", "services/api/main.go", true},
+		{"services/api/", "services/api/internal/db/db.go", true},
+		{"services/api/", "services/apis/main.go", false},
+		{"services/**/*.ts", "services/web/src/app.ts", true},
+		{"services/**/*.ts", "services/app.ts", true},
+		{"services/**/*.ts", "services/web/app.go", false},
+		{"*.md", "README.md", true},
+		{"*.md", "docs/README.md", false},
+		{"**/*.md", "docs/README.md", true},
+		{"go.mod", "go.mod", true},
+	} {
+		if matchChange(c.pattern, c.file) != c.match {
+			t.Fatalf("%s matching %s should be %v", c.pattern, c.file, c.match)
+		}
+	}
+}
+
+func TestOnChanges(t *testing.T) {
+	state := _test_preserveState(t)
+	run := func(files []string, fail bool) (*Pipeline, []string) {
+		executed := []string{}
+		stage := func(name string) *stage {
+			return Stage(name, Exec(func(p *Pipeline, ctx context.Context) error {
+				executed = append(executed, name)
+				if fail && name == "always" {
+					return errors.New("failure")
+				}
+				return nil
+			}))
+		}
+		p := setPipelineWithState("test_changes", Agent("test_changes"), state,
+			Stages("stages",
+				stage("api").OnChanges("services/api/"),
+				stage("web").OnChanges("services/web/**/*.ts", "package.json"),
+				stage("always"),
+			),
+		)
+		p.SetChangedFiles(files)
+		utils.FatalError(p.ExecutePipeline(context.Background()), t)
+		return p, executed
+	}
+	web := []string{"services/web/src/app.ts", "services/web/src/app.ts"}
+
+	// Nothing got built before the first run
+	_, executed := run(web, false)
+	utils.FatalExpectedActual("[api web always]", fmt.Sprint(executed), t)
+
+	p, executed := run(web, false)
+	utils.FatalExpectedActual("[web always]", fmt.Sprint(executed), t)
+	record := p.record()
+	utils.FatalExpectedActual(SKIPPED, record.Stages["api"], t)
+	utils.FatalExpectedActual(SUCCESS, record.Stages["web"], t)
+	utils.FatalExpectedActual(SUCCESS, p.GetStatus(), t)
+	files, known := p.ChangedFiles()
+	utils.FatalExpectedActual(true, known, t)
+	utils.FatalExpectedActual("[services/web/src/app.ts]", fmt.Sprint(files), t)
+
+	_, executed = run([]string{}, false)
+	utils.FatalExpectedActual("[always]", fmt.Sprint(executed), t)
+
+	// Every stage gets executed when the changes are not known
+	_, executed = run(nil, false)
+	utils.FatalExpectedActual("[api web always]", fmt.Sprint(executed), t)
+
+	// Files changed by a failed run are not the ones given with the next one
+	p, executed = run([]string{"services/api/main.go"}, true)
+	utils.FatalExpectedActual("[api always]", fmt.Sprint(executed), t)
+	utils.FatalExpectedActual(FAILURE, p.GetStatus(), t)
+	p, executed = run(web, false)
+	utils.FatalExpectedActual("[api web always]", fmt.Sprint(executed), t)
+	_, known = p.ChangedFiles()
+	utils.FatalExpectedActual(false, known, t)
+}
+
+func TestCheckoutChanges(t *testing.T) {
+	origin, _ := _test_repositories(t)
+	state := _test_preserveState(t)
+	run := func(ref string) (*Pipeline, []string) {
+		executed := []string{}
+		stage := func(name string) *stage {
+			return Stage(name, Exec(func(p *Pipeline, ctx context.Context) error {
+				executed = append(executed, name)
+				return nil
+			}))
+		}
+		p := setPipelineWithState("test_checkout_changes", Agent("test_checkout_changes"), state,
+			Stages("stages",
+				Stage("checkout", Checkout(GitOpts{URL: origin, Ref: ref, Depth: 1})),
+				stage("first").OnChanges("first"),
+				stage("feature").OnChanges("feature"),
+			),
+		)
+		utils.FatalError(p.ExecutePipeline(context.Background()), t)
+		return p, executed
+	}
+
+	// Nothing to compare with on the first run
+	p, executed := run("v1")
+	_, known := p.ChangedFiles()
+	utils.FatalExpectedActual(false, known, t)
+	utils.FatalExpectedActual("[first feature]", fmt.Sprint(executed), t)
+
+	// The shallow clone gets the commit of the last successful run to compare with
+	p, executed = run("feature")
+	files, _ := p.ChangedFiles()
+	utils.FatalExpectedActual("[.gitmodules feature sub]", fmt.Sprint(files), t)
+	utils.FatalExpectedActual("[feature]", fmt.Sprint(executed), t)
+}
@@ -0,0 +1,327 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Params put by Checkout
+const (
+	GitCommitKey  = Key("GitCommit")  // SHA of the commit checked out
+	GitAuthorKey  = Key("GitAuthor")  // Author of the commit, as Name <email>
+	GitMessageKey = Key("GitMessage") // Message of the commit
+	GitRefKey     = Key("GitRef")     // Ref the commit got resolved from
+)
+
+// Commits can only be fetched by their full SHA, and not by
+// every server. Short ones need the whole repository
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// GitCredentials authenticate the fetches over http
+type GitCredentials struct {
+	Username string
+	Password string // Password or token
+}
+
+// GitOpts tells what Checkout puts in the workspace
+type GitOpts struct {
+	URL         string
+	Ref         string // Branch, tag, commit SHA or full ref like refs/pull/12/merge. Defaults to the default branch
+	Depth       int    // Number of commits fetched. 0 fetches the whole history
+	Submodules  bool   // Checks out the submodules too, recursively
+	Credentials *GitCredentials
+	Directory   string // Directory of the repository, relative to the working directory. Defaults to the working directory
+}
+
+// CommitInfo describes the commit checked out by a run
+type CommitInfo struct {
+	URL     string `json:"url"`
+	Ref     string `json:"ref"`
+	SHA     string `json:"sha"`
+	Author  string `json:"author"`
+	Message string `json:"message"`
+}
+
+// Checkout clones the repository in the working directory, or fetches it
+// if it is already there, and checks out the ref.
+//
+// The commit gets recorded in the params of the pipeline and in the report.
+// Credentials, given in opts or in an http URL, are only supported by agents
+// running on the server. They are only sent to the host of the URL
+func Checkout(opts GitOpts) Step {
+	params := map[string]string{"url": redactURL(opts.URL), "ref": opts.Ref}
+	if opts.Depth > 0 {
+		params["depth"] = strconv.Itoa(opts.Depth)
+	}
+	if opts.Submodules {
+		params["submodules"] = "true"
+	}
+	if opts.Directory != "" {
+		params["directory"] = opts.Directory
+	}
+	return Describe(Exec(func(p *Pipeline, ctx context.Context) error {
+		if opts.URL == "" {
+			return errors.New("Checkout needs the URL of the repository")
+		}
+		git := &gitRunner{p: p, ctx: ctx, dir: opts.Directory}
+		// Credentials of the URL would be written in the config of the repository.
+		// Split in a copy, the step is shared by the runs of the pipeline
+		runOpts := opts
+		runOpts.URL, runOpts.Credentials = splitCredentials(opts.URL, opts.Credentials)
+		if runOpts.Credentials != nil {
+			if p.remoteOf(ctx) != nil {
+				return errors.New("Checkout credentials are not supported by agents running on other machines")
+			}
+			token := base64.StdEncoding.EncodeToString([]byte(runOpts.Credentials.Username + ":" + runOpts.Credentials.Password))
+			git.config = map[string]string{"http." + runOpts.URL + ".extraHeader": "Authorization: Basic " + token}
+		}
+
+		commit, err := git.checkout(runOpts)
+		if err != nil {
+			return err
+		}
+		p.Put(GitCommitKey, commit.SHA)
+		p.Put(GitAuthorKey, commit.Author)
+		p.Put(GitMessageKey, commit.Message)
+		p.Put(GitRefKey, commit.Ref)
+		p.Lock()
+		p.Commit = commit
+		p.Unlock()
+		p.StageDiagnostic(ctx).LogEvent(INFO, fmt.Sprintf("Checked out %s (%s) from %s", commit.SHA, commit.Ref, commit.URL))
+		if _, known := p.ChangedFiles(); !known {
+			git.recordChanges()
+		}
+		return nil
+	}), "checkout", "Checks out a git repository", params)
+}
+
+// gitRunner executes the git commands of a checkout
+type gitRunner struct {
+	p      *Pipeline
+	ctx    context.Context
+	dir    string            // Directory of the repository, relative to the working directory
+	config map[string]string // Config given to the commands talking to the remote, without being written down
+}
+
+func (g *gitRunner) checkout(opts GitOpts) (*CommitInfo, error) {
+	if g.dir != "" {
+		if err := g.mkdir(); err != nil {
+			return nil, err
+		}
+	}
+	// Initializing an existing repository leaves it as is
+	if _, err := g.run(false, "init", "-q"); err != nil {
+		return nil, err
+	}
+	// The URL can change between runs of a persistent workspace
+	if _, err := g.run(false, "remote", "set-url", "origin", opts.URL); err != nil {
+		if _, err := g.run(false, "remote", "add", "origin", opts.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	ref := opts.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	fetch := []string{"fetch", "-q", "--no-tags", "origin", ref}
+	if opts.Depth > 0 {
+		fetch = append(fetch, "--depth", strconv.Itoa(opts.Depth))
+	}
+	target := "FETCH_HEAD"
+	if _, err := g.run(true, fetch...); err != nil {
+		if !commitSHA.MatchString(ref) {
+			return nil, err
+		}
+		g.p.StageDiagnostic(g.ctx).LogEvent(DEBUG, fmt.Sprintf("Commit %s could not be fetched on its own, fetching the whole repository", ref))
+		if _, err := g.run(true, "fetch", "-q", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+			return nil, err
+		}
+		target = ref
+	}
+	if _, err := g.run(false, "checkout", "-q", "--force", "--detach", target); err != nil {
+		return nil, err
+	}
+
+	if opts.Submodules {
+		update := []string{"submodule", "update", "-q", "--init", "--recursive", "--force"}
+		if opts.Depth > 0 {
+			update = append(update, "--depth", strconv.Itoa(opts.Depth))
+		}
+		if _, err := g.run(true, update...); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := g.run(false, "log", "-1", "--format=%H%x00%an <%ae>%x00%B")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(string(out), "\x00", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Unexpected output of git log : %s", out)
+	}
+	return &CommitInfo{
+		URL:     redactURL(opts.URL),
+		Ref:     ref,
+		SHA:     fields[0],
+		Author:  fields[1],
+		Message: strings.TrimSpace(fields[2]),
+	}, nil
+}
+
+// recordChanges puts the files changed since the commit of the last successful
+// run in the params. They stay unknown if it can't be compared
+func (g *gitRunner) recordChanges() {
+	diag := g.p.StageDiagnostic(g.ctx)
+	previous := g.p.previousCommit()
+	if previous == "" {
+		diag.LogEvent(DEBUG, "No successful run to compare the commit with, every stage gets executed")
+		return
+	}
+	files, err := g.changes(previous)
+	if err != nil {
+		diag.LogEvent(WARN, fmt.Sprintf("Files changed since commit %s could not be listed, every stage gets executed : %v", previous, err))
+		return
+	}
+	g.p.SetChangedFiles(files)
+	diag.LogEvent(INFO, fmt.Sprintf("%d files changed since commit %s", len(files), previous))
+}
+
+// changes lists the files changed between the commit and the one checked out
+func (g *gitRunner) changes(previous string) ([]string, error) {
+	if _, err := g.run(false, "cat-file", "-e", previous+"^{commit}"); err != nil {
+		fetch := []string{"fetch", "-q", "--no-tags", "origin", previous}
+		// Fetching with a depth would make a complete repository shallow
+		if out, err := g.run(false, "rev-parse", "--is-shallow-repository"); err == nil && strings.TrimSpace(string(out)) == "true" {
+			fetch = append(fetch, "--depth", "1")
+		}
+		if _, err := g.run(true, fetch...); err != nil {
+			return nil, err
+		}
+	}
+	out, err := g.run(false, "diff", "--name-only", "--no-renames", "-z", previous, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, file := range strings.Split(string(out), "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// run executes git in the directory of the repository. Commands talking
+// to the remote get the config holding the credentials
+func (g *gitRunner) run(remote bool, args ...string) ([]byte, error) {
+	name := args[0]
+	if g.dir != "" {
+		args = append([]string{"-C", g.dir}, args...)
+	}
+	logged := make([]string, len(args))
+	for i, arg := range args {
+		logged[i] = redactURL(arg)
+	}
+	g.p.StageDiagnostic(g.ctx).LogEvent(DEBUG, fmt.Sprintf("Executing command git %s", strings.Join(logged, " ")))
+	if agent := g.p.remoteOf(g.ctx); agent != nil {
+		out, err := g.p.execRemote(g.ctx, agent, "git", args...)
+		if err != nil {
+			return out, fmt.Errorf("git %s failed : %w : %s", name, err, out)
+		}
+		return out, nil
+	}
+
+	cmd, err := g.p.command(g.ctx, "git", args...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if remote {
+		cmd.Env = withGitConfig(cmd.Env, g.config)
+	}
+	out, err := cmd.output()
+	if err != nil {
+		return out, fmt.Errorf("git %s failed : %w%s", name, err, stderrOf(err))
+	}
+	return out, nil
+}
+
+// stderrOf gives back the standard error of a failed command, to explain what happened
+func stderrOf(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return " : " + strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return ""
+}
+
+// mkdir creates the directory of the repository
+func (g *gitRunner) mkdir() error {
+	if filepath.IsAbs(g.dir) || !filepath.IsLocal(g.dir) {
+		return fmt.Errorf("Directory %s of the checkout should be inside the working directory", g.dir)
+	}
+	if agent := g.p.remoteOf(g.ctx); agent != nil {
+		_, err := g.p.execRemote(g.ctx, agent, "mkdir", "-p", g.dir)
+		return err
+	}
+	return os.MkdirAll(filepath.Join(g.p.WorkingDirectory(g.ctx), g.dir), os.ModePerm)
+}
+
+// withGitConfig adds config to the environment of a git command, after
+// the one it may already have, so it doesn't show up in the processes
+func withGitConfig(env []string, config map[string]string) []string {
+	if len(config) == 0 {
+		return env
+	}
+	count := 0
+	for _, variable := range env {
+		if value, ok := strings.CutPrefix(variable, "GIT_CONFIG_COUNT="); ok {
+			count, _ = strconv.Atoi(value)
+		}
+	}
+	for key, value := range config {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, key),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, value),
+		)
+		count++
+	}
+	// The last value of a variable is the one used
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", count))
+}
+
+// splitCredentials takes the credentials out of an http URL. The ones
+// given explicitly are kept over the ones of the URL
+func splitCredentials(raw string, credentials *GitCredentials) (string, *GitCredentials) {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return raw, credentials
+	}
+	if credentials == nil {
+		password, _ := u.User.Password()
+		credentials = &GitCredentials{Username: u.User.Username(), Password: password}
+	}
+	u.User = nil
+	return u.String(), credentials
+}
+
+// redactURL hides the credentials the URL may contain
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = url.User("***")
+	return u.String()
+}
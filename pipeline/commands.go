@@ -7,6 +7,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+
+	"github.com/Cyber-cicco/jerminal/config"
 )
 
 const CmdOutKey = Key("CmdOutKey")
@@ -25,25 +28,35 @@ func CD(dir string) *executor {
 		if filepath.IsAbs(dir) {
 			newPath = cleanDir
 		} else {
-            newPath = filepath.Join(p.directory, cleanDir)
+            newPath = filepath.Join(p.WorkingDirectory(ctx), cleanDir)
         }
 
 		// Check if the resulting path exists and is a directory
-		info, err := os.Stat(newPath)
-		if err != nil {
-			return err // Return error if the path does not exist
-		}
-		if !info.IsDir() {
-			return errors.New("target path is not a directory")
+		if remote := p.remoteOf(ctx); remote != nil {
+			isDir, err := remote.IsDir(newPath)
+			if err != nil {
+				return err
+			}
+			if !isDir {
+				return errors.New("target path is not a directory")
+			}
+		} else {
+			info, err := os.Stat(newPath)
+			if err != nil {
+				return err // Return error if the path does not exist
+			}
+			if !info.IsDir() {
+				return errors.New("target path is not a directory")
+			}
 		}
 
 		// Update the pipeline's directory
-		p.directory = newPath
+		p.setWorkingDirectory(ctx, newPath)
 		return nil
 	}
 
 	defered := func(p *Pipeline, ctx context.Context) error {
-		p.directory = p.mainDirectory
+		p.setWorkingDirectory(ctx, p.Workspace(ctx))
 		return nil
 	}
 
@@ -54,29 +67,52 @@ func CD(dir string) *executor {
 	}
 }
 
-// SH Executes a command in the directory of the current agent
+// Run executes a command in the working directory of the current agent the
+// way SH does: on its machine if it runs on another one, with its limits
+// and in its sandbox. Gives back the standard output and error of the command.
+//
+// Meant for custom steps, that shouldn't use os/exec directly
+func (p *Pipeline) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if remote := p.remoteOf(ctx); remote != nil {
+		return p.execRemote(ctx, remote, name, args...)
+	}
+	cmd, err := p.command(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return cmd.combinedOutput()
+}
+
+// SH Executes a command in the directory of the current agent,
+// on its machine if it runs on another one
 // It also puts the result of the result of the command in
-// the params of the pipeline
-func SH(name string, args ...string) executable {
-	return Exec(func(p *Pipeline, ctx context.Context) error {
-		cmd := exec.Command(name, args...)
-		cmd.Dir = p.directory
+// the params of the pipeline, and as a string in the outputs
+// of the current stage. Stages running in parallel only put it
+// in their outputs, so they don't overwrite each other
+func SH(name string, args ...string) Step {
+	return Describe(Exec(func(p *Pipeline, ctx context.Context) (err error) {
         p.Diagnostic.LogEvent(DEBUG, fmt.Sprintf("Executing command %s", name))
-		out, err := cmd.CombinedOutput()
+		out, err := p.Run(ctx, name, args...)
         p.Diagnostic.LogEvent(DEBUG, fmt.Sprintf("Got ouput : %s", string(out)))
-        p.Put(CmdOutKey, out)
+        if !inParallel(ctx) {
+            p.Put(CmdOutKey, out)
+        }
+        p.CurrentOutputs(ctx).Put(CmdOutKey, string(out))
 		return err
-	})
+	}), "sh", "Executes a command", map[string]string{"command": strings.Join(append([]string{name}, args...), " ")})
 }
 
 
-func SHBackground(name string, args ...string) executable {
+func SHBackground(name string, args ...string) Step {
     return Exec(func(p *Pipeline, ctx context.Context) error {
-        cmd := exec.Command(name, args...)
-        cmd.Dir = p.directory
+        // Not bound to the context, the process has to outlive the stage
+        cmd, err := p.command(context.Background(), name, args...)
+        if err != nil {
+            return err
+        }
         p.Diagnostic.LogEvent(DEBUG, fmt.Sprintf("Starting background command %s", name))
         
-        err := cmd.Start()
+        err = cmd.start()
         if err != nil {
             return err
         }
@@ -87,3 +123,15 @@ func SHBackground(name string, args ...string) executable {
     })
 }
 
+// isolate makes the command run in the sandbox of the agent,
+// if it has one
+func isolate(cmd *exec.Cmd, agent *config.Agent, workspace string) error {
+	if agent == nil || agent.Sandbox == nil {
+		return nil
+	}
+	workspace, err := filepath.Abs(workspace)
+	if err != nil {
+		return err
+	}
+	return sandbox(cmd, agent.Sandbox, workspace)
+}
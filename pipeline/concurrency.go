@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EConcurrency tells the server what to do with a new run of a pipeline
+// when the maximum number of runs of this pipeline is already reached
+type EConcurrency uint8
+
+const (
+	QUEUE              = EConcurrency(iota) // New run waits for a running one to end
+	CANCEL_IN_PROGRESS                      // New run cancels the runs in progress or queued
+	SKIP_IF_RUNNING                         // New run is dropped if others are in progress or queued
+)
+
+var CONCURRENCY_STR = [3]string{"QUEUE", "CANCEL_IN_PROGRESS", "SKIP_IF_RUNNING"}
+
+// ConcurrencyPolicy describes how the runs of a same pipeline can overlap
+type ConcurrencyPolicy struct {
+	Mode        EConcurrency  `json:"mode"`         // What to do when the limit is reached
+	MaxRuns     uint16        `json:"max-runs"`     // Maximum number of runs at the same time. 0 means no limit for QUEUE, 1 otherwise
+	QuietPeriod time.Duration `json:"quiet-period"` // Time without new trigger to wait for before starting a run
+}
+
+// Limit gives back the number of runs that can be executed at the
+// same time. 0 means there is no limit
+func (c ConcurrencyPolicy) Limit() int {
+	if c.MaxRuns == 0 && c.Mode != QUEUE {
+		return 1
+	}
+	return int(c.MaxRuns)
+}
+
+// Reached tells if a new run would go over the limit given the
+// number of runs in progress, or in progress and queued
+func (c ConcurrencyPolicy) Reached(running int) bool {
+	limit := c.Limit()
+	return limit != 0 && running >= limit
+}
+
+// SetConcurrency tells the server how many runs of the pipeline can
+// execute at the same time, and what to do with a new run if
+// the limit is reached
+func (p *Pipeline) SetConcurrency(mode EConcurrency, maxRuns uint16) {
+	p.Concurrency.Mode = mode
+	p.Concurrency.MaxRuns = maxRuns
+}
+
+// SetQuietPeriod makes the server wait for the given duration without
+// new triggers before starting a run, so a burst of triggers
+// collapses into a single run
+func (p *Pipeline) SetQuietPeriod(period time.Duration) {
+	p.Concurrency.QuietPeriod = period
+}
+
+// MarshalJSON converts EConcurrency to the corresponding string
+func (c EConcurrency) MarshalJSON() ([]byte, error) {
+	if int(c) < len(CONCURRENCY_STR) {
+		return json.Marshal(CONCURRENCY_STR[c])
+	}
+	return json.Marshal(uint8(c))
+}
+
+// UnmarshalJSON converts string back to EConcurrency
+func (c *EConcurrency) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		for i, s := range CONCURRENCY_STR {
+			if s == str {
+				*c = EConcurrency(i)
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid concurrency string: %s", str)
+	}
+
+	return fmt.Errorf("invalid concurrency value: %s", string(data))
+}
@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	queue := ConcurrencyPolicy{Mode: QUEUE}
+	utils.FatalExpectedActual(false, queue.Reached(100), t)
+
+	skip := ConcurrencyPolicy{Mode: SKIP_IF_RUNNING}
+	utils.FatalExpectedActual(1, skip.Limit(), t)
+	utils.FatalExpectedActual(false, skip.Reached(0), t)
+	utils.FatalExpectedActual(true, skip.Reached(1), t)
+
+	limited := ConcurrencyPolicy{Mode: QUEUE, MaxRuns: 3}
+	utils.FatalExpectedActual(false, limited.Reached(2), t)
+	utils.FatalExpectedActual(true, limited.Reached(3), t)
+}
+
+func TestConcurrencyJSON(t *testing.T) {
+	bytes, err := json.Marshal(ConcurrencyPolicy{Mode: CANCEL_IN_PROGRESS, MaxRuns: 2})
+	utils.FatalError(err, t)
+
+	var policy ConcurrencyPolicy
+	err = json.Unmarshal(bytes, &policy)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(CANCEL_IN_PROGRESS, policy.Mode, t)
+	utils.FatalExpectedActual(2, policy.MaxRuns, t)
+}
@@ -0,0 +1,255 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PackageCoverage is the coverage of a single package
+type PackageCoverage struct {
+	Name    string  `json:"name"`
+	Covered int     `json:"covered"` // Number of statements, or lines, executed by the tests
+	Total   int     `json:"total"`   // Number of statements, or lines, in the package
+	Percent float64 `json:"percent"`
+}
+
+// CoverageReport holds the coverage measured by a stage
+type CoverageReport struct {
+	Covered  int               `json:"covered"`
+	Total    int               `json:"total"`
+	Percent  float64           `json:"percent"`
+	Minimum  float64           `json:"minimum"`            // Threshold under which the coverage is not accepted
+	Previous *float64          `json:"previous,omitempty"` // Coverage of the last successful run, if any
+	Packages []PackageCoverage `json:"packages"`
+}
+
+// percent gives back the percentage of covered out of total.
+// Nothing to cover counts as fully covered
+func percent(covered, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(covered) * 100 / float64(total)
+}
+
+// newCoverageReport computes the totals of the report based on the
+// covered and total counts of each package
+func newCoverageReport(covered, total map[string]int) *CoverageReport {
+	report := &CoverageReport{Packages: []PackageCoverage{}}
+	for name, t := range total {
+		report.Packages = append(report.Packages, PackageCoverage{
+			Name:    name,
+			Covered: covered[name],
+			Total:   t,
+			Percent: percent(covered[name], t),
+		})
+		report.Covered += covered[name]
+		report.Total += t
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		return report.Packages[i].Name < report.Packages[j].Name
+	})
+	report.Percent = percent(report.Covered, report.Total)
+	return report
+}
+
+// Coverage parses a coverage profile, either produced by go test -coverprofile
+// or in the Cobertura XML format, and attaches the coverage of each package
+// to the stage.
+//
+// The stage fails if the total coverage is under minPercent. A drop compared
+// to the last successful run of the pipeline is logged as a warning.
+func Coverage(profilePath string, minPercent float64) Step {
+	return coverage(profilePath, minPercent, false)
+}
+
+// CoverageUnstable works like Coverage, but marks the run as UNSTABLE
+// instead of failing if the coverage is under minPercent
+func CoverageUnstable(profilePath string, minPercent float64) Step {
+	return coverage(profilePath, minPercent, true)
+}
+
+func coverage(profilePath string, minPercent float64, unstable bool) Step {
+	return Describe(Exec(func(p *Pipeline, ctx context.Context) error {
+		profile := profilePath
+		if !filepath.IsAbs(profile) {
+			profile = filepath.Join(p.WorkingDirectory(ctx), profile)
+		}
+		content, err := os.ReadFile(profile)
+		if err != nil {
+			return err
+		}
+		report, err := parseCoverage(content)
+		if err != nil {
+			return fmt.Errorf("could not parse coverage profile %s : %v", profile, err)
+		}
+		report.Minimum = minPercent
+
+		diag := p.StageDiagnostic(ctx)
+		name := ""
+		if scope := stageFrom(ctx); scope != nil {
+			name = scope.name
+		}
+		if previous := GetStore().LastSuccessfulRun(p.Name, p.StartTime); previous != nil {
+			if prevPercent, ok := previous.Coverage[name]; ok {
+				report.Previous = &prevPercent
+				if report.Percent < prevPercent {
+					diag.LogEvent(WARN, fmt.Sprintf("Coverage dropped from %.2f%% to %.2f%%", prevPercent, report.Percent))
+				}
+			}
+		}
+
+		diag.Lock()
+		diag.Coverage = report
+		diag.Unlock()
+		p.recordCoverage(name, report.Percent)
+		diag.LogEvent(INFO, fmt.Sprintf("Coverage is %.2f%% (%d/%d)", report.Percent, report.Covered, report.Total))
+
+		if report.Percent >= minPercent {
+			return nil
+		}
+		reason := fmt.Sprintf("coverage %.2f%% is under the minimum of %.2f%%", report.Percent, minPercent)
+		if unstable {
+			p.MarkUnstable(ctx, reason)
+			return nil
+		}
+		return fmt.Errorf("Coverage %.2f%% is under the minimum of %.2f%%", report.Percent, minPercent)
+	}), "coverage", "Parses a coverage profile", map[string]string{
+		"profile":  profilePath,
+		"minimum":  strconv.FormatFloat(minPercent, 'f', -1, 64),
+		"unstable": strconv.FormatBool(unstable),
+	})
+}
+
+// recordCoverage keeps the coverage measured by a stage so
+// it can be found in the history
+func (p *Pipeline) recordCoverage(name string, percent float64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.coverage == nil {
+		p.coverage = make(map[string]float64)
+	}
+	p.coverage[name] = percent
+}
+
+// parseCoverage detects the format of the profile and parses it
+func parseCoverage(content []byte) (*CoverageReport, error) {
+	trimmed := bytes.TrimSpace(content)
+	if bytes.HasPrefix(trimmed, []byte("mode:")) {
+		return parseGoCoverage(bytes.NewReader(trimmed))
+	}
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		return parseCobertura(bytes.NewReader(trimmed))
+	}
+	return nil, fmt.Errorf("unknown coverage format")
+}
+
+// parseGoCoverage reads a profile written by go test -coverprofile.
+//
+// Blocks are identified by their position, so profiles merged from
+// several runs don't count the same statements twice
+func parseGoCoverage(r io.Reader) (*CoverageReport, error) {
+	type block struct {
+		pkg   string
+		stmts int
+	}
+	blocks := make(map[string]block)
+	hit := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		// file.go:startLine.startCol,endLine.endCol numStmts count
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		colon := strings.LastIndex(fields[0], ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		stmts, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		blocks[fields[0]] = block{pkg: path.Dir(fields[0][:colon]), stmts: stmts}
+		if count > 0 {
+			hit[fields[0]] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	covered := make(map[string]int)
+	total := make(map[string]int)
+	for id, b := range blocks {
+		total[b.pkg] += b.stmts
+		if hit[id] {
+			covered[b.pkg] += b.stmts
+		}
+	}
+	return newCoverageReport(covered, total), nil
+}
+
+type coberturaLine struct {
+	Number int `xml:"number,attr"`
+	Hits   int `xml:"hits,attr"`
+}
+
+type coberturaClass struct {
+	Filename string          `xml:"filename,attr"`
+	Lines    []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaPackage struct {
+	Name    string           `xml:"name,attr"`
+	Classes []coberturaClass `xml:"classes>class"`
+}
+
+type cobertura struct {
+	Packages []coberturaPackage `xml:"packages>package"`
+}
+
+// parseCobertura reads a Cobertura XML report, counting the lines of
+// each package
+func parseCobertura(r io.Reader) (*CoverageReport, error) {
+	var root cobertura
+	err := xml.NewDecoder(r).Decode(&root)
+	if err != nil {
+		return nil, err
+	}
+	covered := make(map[string]int)
+	total := make(map[string]int)
+	for _, pkg := range root.Packages {
+		if _, ok := total[pkg.Name]; !ok {
+			total[pkg.Name] = 0
+		}
+		for _, class := range pkg.Classes {
+			for _, line := range class.Lines {
+				total[pkg.Name]++
+				if line.Hits > 0 {
+					covered[pkg.Name]++
+				}
+			}
+		}
+	}
+	return newCoverageReport(covered, total), nil
+}
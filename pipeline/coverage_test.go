@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+const _test_coverprofile = `mode: set
+example.com/app/foo/foo.go:3.10,5.2 2 1
+example.com/app/foo/foo.go:7.10,9.2 2 0
+example.com/app/bar/bar.go:3.10,5.2 4 1
+example.com/app/foo/foo.go:7.10,9.2 2 1
+`
+
+const _test_cobertura = `<?xml version="1.0" ?>
+<coverage line-rate="0.5">
+  <packages>
+    <package name="app">
+      <classes>
+        <class filename="app/main.py">
+          <lines>
+            <line number="1" hits="1"/>
+            <line number="2" hits="0"/>
+          </lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>`
+
+func TestParseGoCoverage(t *testing.T) {
+	report, err := parseCoverage([]byte(_test_coverprofile))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(8, report.Total, t)
+	utils.FatalExpectedActual(8, report.Covered, t)
+	utils.FatalExpectedActual(2, len(report.Packages), t)
+	utils.FatalExpectedActual("example.com/app/bar", report.Packages[0].Name, t)
+}
+
+func TestParseCobertura(t *testing.T) {
+	report, err := parseCoverage([]byte(_test_cobertura))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(50.0, report.Percent, t)
+	utils.FatalExpectedActual("app", report.Packages[0].Name, t)
+
+	_, err = parseCoverage([]byte("not a profile"))
+	utils.FatalNoError(err, "unknown format should not be parsed", t)
+}
+
+func TestCoverageThreshold(t *testing.T) {
+	p := _test_getPipeline("TestCoverageThreshold")
+	p.Name = "TestCoverageThreshold"
+	p.Diagnostic = NewDiag("test")
+	p.StartTime = time.Now()
+	p.directory = t.TempDir()
+	err := os.WriteFile(filepath.Join(p.directory, "coverage.xml"), []byte(_test_cobertura), os.ModePerm)
+	utils.FatalError(err, t)
+
+	err = Stage("coverage", Coverage("coverage.xml", 50)).ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(50.0, p.coverage["coverage"], t)
+
+	err = Stage("coverage", Coverage("coverage.xml", 80)).ExecuteStage(p, context.Background())
+	utils.FatalNoError(err, "coverage under the minimum should fail the stage", t)
+
+	err = Stage("coverage", CoverageUnstable("coverage.xml", 80)).ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(UNSTABLE, p.Status, t)
+}
+
+func TestCoverageComparesWithLastSuccess(t *testing.T) {
+	name := "TestCoverageComparesWithLastSuccess"
+	GetStore().RecordRun(name, &RunRecord{
+		Status:    SUCCESS,
+		StartTime: time.Now().Add(-time.Minute),
+		Coverage:  map[string]float64{"coverage": 75},
+	})
+	p := _test_getPipeline(name)
+	p.Name = name
+	p.Diagnostic = NewDiag("test")
+	p.StartTime = time.Now()
+	p.directory = t.TempDir()
+	err := os.WriteFile(filepath.Join(p.directory, "coverage.xml"), []byte(_test_cobertura), os.ModePerm)
+	utils.FatalError(err, t)
+
+	err = Stage("coverage", Coverage("coverage.xml", 0)).ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+	diag := p.Diagnostic.Events[0].(*Diagnostic)
+	utils.FatalExpectedActual(75.0, *diag.Coverage.Previous, t)
+}
@@ -15,13 +15,16 @@ var IMPORTANCE_STR = [5]string{"DEBUG", "INFO", "WARN", "ERROR", "CRITICAL"}
 
 // Informations about an element of the pipeline
 type Diagnostic struct {
-	Start        JSONTime      `json:"date" time_format:"2006-01-02 15:04:05"` // Time the diagnostic was written
-	Events       []pipelineLog `json:"logs"`                                   // Infos about what happened in the process
-	Label        string        `json:"label"`                                  // Name of the diagnostic
-	identifier   uuid.UUID     `json:"-"`                                      // Unique identifier of the diagnostic
-	parent       *Diagnostic   `json:"-"`                                      // Parent of the Diagnostic. Nil if does not exist
-	sync.RWMutex `json:"-"`    // Can be used in goroutines so need to lock it
-	Inerror      bool          `json:"in-error"` // Tells if the attached process should be considered in error
+	Start        JSONTime        `json:"date" time_format:"2006-01-02 15:04:05"` // Time the diagnostic was written
+	Events       []pipelineLog   `json:"logs"`                                   // Infos about what happened in the process
+	Label        string          `json:"label"`                                  // Name of the diagnostic
+	identifier   uuid.UUID       `json:"-"`                                      // Unique identifier of the diagnostic
+	parent       *Diagnostic     `json:"-"`                                      // Parent of the Diagnostic. Nil if does not exist
+	sync.RWMutex `json:"-"`      // Can be used in goroutines so need to lock it
+	Status       ERunStatus      `json:"status"`             // Outcome of the attached process
+	Cause        string          `json:"cause,omitempty"`    // Limit of the agent that made the process fail, if any
+	Tests        *TestReport     `json:"tests,omitempty"`    // Results of the tests executed by the process
+	Coverage     *CoverageReport `json:"coverage,omitempty"` // Coverage measured by the process
 }
 
 // Infos about an event
@@ -54,7 +57,10 @@ func (d *Diagnostic) FilterBasedOnImportance(imp EImportance) *Diagnostic {
 		Label:      d.Label,
 		identifier: d.identifier,
 		Start:      d.Start,
-		Inerror:    d.Inerror,
+		Status:     d.Status,
+		Cause:      d.Cause,
+		Tests:      d.Tests,
+		Coverage:   d.Coverage,
 		parent:     d.parent,
 		Events:     []pipelineLog{},
 	}
@@ -82,6 +88,50 @@ func (d *Diagnostic) AddChild(diag *Diagnostic) {
 	diag.parent = d
 }
 
+// SetStatus changes the status of the attached process
+func (d *Diagnostic) SetStatus(status ERunStatus) {
+	d.Lock()
+	defer d.Unlock()
+	d.Status = status
+}
+
+// SetCause records the limit of the agent that made the process fail
+func (d *Diagnostic) SetCause(cause string) {
+	d.Lock()
+	defer d.Unlock()
+	d.Cause = cause
+}
+
+// GetStatus gives back the status of the attached process
+func (d *Diagnostic) GetStatus() ERunStatus {
+	d.RLock()
+	defer d.RUnlock()
+	return d.Status
+}
+
+// childrenStatus gives back the most severe status among the
+// child diagnostics, or SUCCESS if there is none
+func (d *Diagnostic) childrenStatus() ERunStatus {
+	d.RLock()
+	defer d.RUnlock()
+	status := SUCCESS
+	for _, ev := range d.Events {
+		if child, ok := ev.(*Diagnostic); ok {
+			status = status.Worst(child.GetStatus())
+		}
+	}
+	return status
+}
+
+// skippedDiag adds a child diagnostic to tell an element
+// was not executed
+func (d *Diagnostic) skippedDiag(name, reason string) {
+	diag := NewDiag(name)
+	diag.Status = SKIPPED
+	diag.LogEvent(INFO, reason)
+	d.AddChild(diag)
+}
+
 // Prints the events recursively
 func (d *Diagnostic) Log() {
 	for _, ev := range d.Events {
@@ -100,7 +150,7 @@ func NewDiag(name string) *Diagnostic {
 		Label:      name,
 		identifier: uuid.New(),
 		Start:      JSONTime(time.Now()),
-		Inerror:    false,
+		Status:     RUNNING,
 		Events:     []pipelineLog{},
 	}
 }
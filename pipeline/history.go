@@ -0,0 +1,208 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Maximum number of runs kept in the history of a pipeline
+const MAX_HISTORY = 50
+
+// RunRecord sums up a finished run of a pipeline, so subsequent
+// runs can compare themselves with it
+type RunRecord struct {
+	Id        uuid.UUID             `json:"id"`
+	Status    ERunStatus            `json:"status"`
+	StartTime time.Time             `json:"start-time"`
+	EndTime   time.Time             `json:"end-time"`
+	Stages    map[string]ERunStatus `json:"stages"`   // Status of each stage and group of stages, by name
+	Coverage  map[string]float64    `json:"coverage"` // Coverage percentage measured by each stage, by name
+	Params    map[Key]interface{}   `json:"-"`        // Params of the pipeline at the end of the run
+	Agent     string                `json:"agent"`    // Agent that executed the run
+}
+
+// RecordRun adds a finished run to the history of the pipeline
+func (s *Store) RecordRun(name string, record *RunRecord) {
+	s.Lock()
+	defer s.Unlock()
+	history := append(s.History[name], record)
+	if len(history) > MAX_HISTORY {
+		history = history[len(history)-MAX_HISTORY:]
+	}
+	s.History[name] = history
+}
+
+// reportRecord holds what the history needs from a JSON report
+type reportRecord struct {
+	Id        uuid.UUID   `json:"id"`
+	Status    ERunStatus  `json:"status"`
+	StartTime time.Time   `json:"start-time"`
+	EndTime   time.Time   `json:"end-time"`
+	Commit    *CommitInfo `json:"commit"`
+	Record    *RunRecord  `json:"record"` // Missing from the reports written before it got added
+}
+
+// LoadHistory fills the history of the pipelines with the JSON reports
+// of the directory, so it survives a restart of the server.
+//
+// Runs already in the history are left as they are. Only the commit
+// checked out is restored from the params of the runs. Gives back the
+// number of runs added
+func (s *Store) LoadHistory(reportDir string) (int, error) {
+	pipelines, err := os.ReadDir(reportDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	loaded := 0
+	errs := []error{}
+	for _, dir := range pipelines {
+		if !dir.IsDir() {
+			continue
+		}
+		records, err := readReports(filepath.Join(reportDir, dir.Name()))
+		if err != nil {
+			errs = append(errs, err)
+		}
+		loaded += s.addHistory(dir.Name(), records)
+	}
+	return loaded, errors.Join(errs...)
+}
+
+// readReports gives back the records of the JSON reports of a pipeline
+func readReports(dir string) ([]*RunRecord, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	records := []*RunRecord{}
+	errs := []error{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		report := reportRecord{}
+		if err := json.Unmarshal(content, &report); err != nil {
+			errs = append(errs, fmt.Errorf("Report %s could not be read : %w", filepath.Join(dir, file.Name()), err))
+			continue
+		}
+		record := report.Record
+		if record == nil {
+			record = &RunRecord{Id: report.Id, Status: report.Status, StartTime: report.StartTime, EndTime: report.EndTime}
+		}
+		record.Params = map[Key]interface{}{}
+		if report.Commit != nil {
+			record.Params[GitCommitKey] = report.Commit.SHA
+		}
+		records = append(records, record)
+	}
+	return records, errors.Join(errs...)
+}
+
+// addHistory puts runs read from the reports in the history of the
+// pipeline, by order of start. Gives back the number of runs added
+func (s *Store) addHistory(name string, records []*RunRecord) int {
+	s.Lock()
+	defer s.Unlock()
+	history := s.History[name]
+	added := 0
+	for _, record := range records {
+		known := slices.ContainsFunc(history, func(r *RunRecord) bool { return r.Id == record.Id })
+		if !known {
+			history = append(history, record)
+			added++
+		}
+	}
+	slices.SortStableFunc(history, func(a, b *RunRecord) int { return a.StartTime.Compare(b.StartTime) })
+	if len(history) > MAX_HISTORY {
+		history = history[len(history)-MAX_HISTORY:]
+	}
+	s.History[name] = history
+	return added
+}
+
+// LastRun gives back the last run of the pipeline that started before
+// the given time, or nil if there is none
+func (s *Store) LastRun(name string, before time.Time) *RunRecord {
+	return s.findLastRun(name, before, func(r *RunRecord) bool { return true })
+}
+
+// LastSuccessfulRun gives back the last run of the pipeline that started
+// before the given time and did not fail, or nil if there is none
+func (s *Store) LastSuccessfulRun(name string, before time.Time) *RunRecord {
+	return s.findLastRun(name, before, func(r *RunRecord) bool {
+		return !r.Status.Failed() && r.Status != UNSTABLE
+	})
+}
+
+func (s *Store) findLastRun(name string, before time.Time, keep func(r *RunRecord) bool) *RunRecord {
+	s.Lock()
+	defer s.Unlock()
+	history := s.History[name]
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].StartTime.Before(before) && keep(history[i]) {
+			return history[i]
+		}
+	}
+	return nil
+}
+
+// record creates the summary of the run of the pipeline
+func (p *Pipeline) record() *RunRecord {
+	p.Lock()
+	defer p.Unlock()
+	record := &RunRecord{
+		Id:        p.Id,
+		Status:    p.Status,
+		StartTime: p.StartTime,
+		EndTime:   p.EndTime,
+		Stages:    make(map[string]ERunStatus, len(p.stageStatuses)),
+		Coverage:  make(map[string]float64, len(p.coverage)),
+		Params:    make(map[Key]interface{}, len(p.params)),
+	}
+	if p.Agent != nil {
+		record.Agent = p.Agent.Identifier
+	}
+	for name, status := range p.stageStatuses {
+		record.Stages[name] = status
+	}
+	for name, percent := range p.coverage {
+		record.Coverage[name] = percent
+	}
+	for key, val := range p.params {
+		record.Params[key] = val
+	}
+	return record
+}
+
+// recordStageStatus keeps the status of a stage or group of
+// stages so it can be found in the history
+func (p *Pipeline) recordStageStatus(name string, status ERunStatus) {
+	p.Lock()
+	defer p.Unlock()
+	if p.stageStatuses == nil {
+		p.stageStatuses = make(map[string]ERunStatus)
+	}
+	p.stageStatuses[name] = status
+}
+
+// previousRun gives back the run of the pipeline that
+// happened before this one
+func (p *Pipeline) previousRun() *RunRecord {
+	return GetStore().LastRun(p.Name, p.StartTime)
+}
@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func TestLoadHistory(t *testing.T) {
+	dir := t.TempDir()
+	state := config.GetStateCustomConf(&config.Config{
+		AgentDir:             filepath.Join(dir, "agent"),
+		PipelineDir:          filepath.Join(dir, "pipeline"),
+		ReportDir:            filepath.Join(dir, "reports"),
+		JerminalResourcePath: "../resources/jerminal.json",
+		AgentResourcePath:    "../resources/agents.json",
+	})
+	p := setPipelineWithState("test_load_history", Agent("test_load_history"), state,
+		Stages("stages",
+			Stage("flaky", SH("true")),
+		),
+	)
+	p.ReportJson()
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+
+	// Written before the reports had the record of the run
+	old := filepath.Join(state.ReportDir, p.Name, "old.json")
+	content := `{"id":"8b0fa1a2-52d5-4b0e-9a0a-3c1f0e2a4d11","status":"FAILURE","start-time":"2020-01-02T15:04:05Z","commit":{"sha":"abc"}}`
+	utils.FatalError(os.WriteFile(old, []byte(content), 0644), t)
+
+	// Like after a restart of the server
+	store := &Store{History: make(map[string][]*RunRecord)}
+	loaded, err := store.LoadHistory(state.ReportDir)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(2, loaded, t)
+
+	last := store.LastRun(p.Name, time.Now())
+	utils.FatalExpectedActual(p.Id, last.Id, t)
+	utils.FatalExpectedActual(SUCCESS, last.Status, t)
+	utils.FatalExpectedActual(SUCCESS, last.Stages["flaky"], t)
+	utils.FatalExpectedActual("test_load_history", last.Agent, t)
+
+	first := store.LastRun(p.Name, p.StartTime)
+	utils.FatalExpectedActual(FAILURE, first.Status, t)
+	utils.FatalExpectedActual("abc", first.Params[GitCommitKey].(string), t)
+
+	// Loading again adds nothing
+	loaded, err = store.LoadHistory(state.ReportDir)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(0, loaded, t)
+	utils.FatalExpectedActual(2, len(store.History[p.Name]), t)
+}
@@ -0,0 +1,229 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+	"github.com/google/uuid"
+)
+
+// JournalEntry is written down when a run starts working in a workspace,
+// and removed once it ended. The entries found when the server starts
+// are the runs it was executing when it stopped
+type JournalEntry struct {
+	Id         uuid.UUID          `json:"id"`
+	Pipeline   string             `json:"pipeline"`
+	Agent      string             `json:"agent"` // Agent executing the run
+	StartTime  time.Time          `json:"start-time"`
+	Workspaces []JournalWorkspace `json:"workspaces"`          // Workspaces used by the run at the moment
+	Reports    []ReportType       `json:"reports"`             // Reports the run should write
+	Retention  *RetentionPolicy   `json:"retention,omitempty"` // Retention policy of the pipeline
+}
+
+// JournalWorkspace is a workspace used by a run
+type JournalWorkspace struct {
+	Name   string `json:"name"` // Name of the workspace in the preserved run
+	Agent  string `json:"agent"`
+	Path   string `json:"path"`
+	Remote bool   `json:"remote"` // true if the workspace is on the machine of a remote agent
+}
+
+// journalPath gives back the file of the entry of the run
+func (p *Pipeline) journalPath() string {
+	return filepath.Join(p.globalState.JournalDirectory(), p.Id.String()+".json")
+}
+
+// journalWorkspace writes down that the run works in the workspace of the agent
+func (p *Pipeline) journalWorkspace(agent *config.Agent, workspace, name string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.journal == nil {
+		p.journal = &JournalEntry{
+			Id:        p.Id,
+			Pipeline:  p.Name,
+			StartTime: p.StartTime,
+			Reports:   p.Report.Types,
+			Retention: p.Retention,
+		}
+		if p.Agent != nil {
+			p.journal.Agent = p.Agent.Identifier
+		}
+	}
+	p.journal.Workspaces = append(p.journal.Workspaces, JournalWorkspace{
+		Name:   name,
+		Agent:  agent.Identifier,
+		Path:   workspace,
+		Remote: agent.Remote != nil,
+	})
+	return p.writeJournal()
+}
+
+// unjournalWorkspace writes down that the run stopped using the workspace
+func (p *Pipeline) unjournalWorkspace(name string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.journal == nil {
+		return nil
+	}
+	p.journal.Workspaces = slices.DeleteFunc(p.journal.Workspaces, func(w JournalWorkspace) bool {
+		return w.Name == name
+	})
+	return p.writeJournal()
+}
+
+// writeJournal writes the entry of the run
+//
+// MUST BE CALLED WITH THE LOCK OF THE PIPELINE
+func (p *Pipeline) writeJournal() error {
+	bytes, err := json.Marshal(p.journal)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(p.globalState.JournalDirectory(), os.ModePerm); err != nil {
+		return err
+	}
+	// Written in another file first, so a crash can't leave half an entry
+	tmp := p.journalPath() + ".tmp"
+	if err = os.WriteFile(tmp, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.journalPath())
+}
+
+// closeJournal removes the entry of the run once it ended
+func (p *Pipeline) closeJournal() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.journal == nil {
+		return nil
+	}
+	p.journal = nil
+	err := os.Remove(p.journalPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// RecoverySummary tells what got cleaned up after a stop of the server
+type RecoverySummary struct {
+	Aborted  []string `json:"aborted"`  // Runs that were being executed, as pipeline/id
+	Archived []string `json:"archived"` // Workspaces moved to the preserved directory
+	Removed  []string `json:"removed"`  // Stale directories of the agents
+}
+
+func (r *RecoverySummary) String() string {
+	if len(r.Aborted) == 0 && len(r.Removed) == 0 {
+		return "Nothing to recover from the previous execution of the server"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Recovered from the previous execution of the server : %d runs aborted, %d workspaces archived, %d stale agent directories removed",
+		len(r.Aborted), len(r.Archived), len(r.Removed))
+	for _, run := range r.Aborted {
+		fmt.Fprintf(&b, "\n  aborted  %s", run)
+	}
+	for _, path := range r.Archived {
+		fmt.Fprintf(&b, "\n  archived %s", path)
+	}
+	for _, path := range r.Removed {
+		fmt.Fprintf(&b, "\n  removed  %s", path)
+	}
+	return b.String()
+}
+
+// Recover cleans up what the server left behind when it stopped in the
+// middle of runs. Those runs get reported as ABORTED, their workspaces
+// archived if their retention policy keeps them, and every directory
+// of the local agents gets removed so they can work again.
+//
+// MUST BE CALLED BEFORE ANY RUN STARTS
+func Recover(state *config.GlobalStateProvider) (*RecoverySummary, error) {
+	conf := state.CloneConfig()
+	summary := &RecoverySummary{Aborted: []string{}, Archived: []string{}, Removed: []string{}}
+	var errs []error
+
+	files, err := filepath.Glob(filepath.Join(conf.JournalDirectory(), "*.json"))
+	if err != nil {
+		return summary, err
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var entry JournalEntry
+		if err = json.Unmarshal(content, &entry); err != nil {
+			errs = append(errs, fmt.Errorf("Journal entry %s is not valid : %v", file, err))
+		} else {
+			errs = append(errs, recoverRun(state, conf, &entry, summary))
+		}
+		errs = append(errs, os.Remove(file))
+	}
+
+	// No run is being executed, so every workspace left is stale
+	dirs, err := os.ReadDir(conf.AgentDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(conf.AgentDir, dir.Name())
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		summary.Removed = append(summary.Removed, path)
+	}
+	return summary, errors.Join(errs...)
+}
+
+// recoverRun archives the workspaces of a run that got interrupted, and
+// writes it down as ABORTED in the history and the reports of its pipeline
+func recoverRun(state *config.GlobalStateProvider, conf *config.Config, entry *JournalEntry, summary *RecoverySummary) error {
+	p := setPipelineWithState(entry.Pipeline, nil, state)
+	p.Id = entry.Id
+	p.StartTime = entry.StartTime
+	p.Retention = entry.Retention
+	p.Report.Types = entry.Reports
+	p.Agent = &config.Executor{Agent: &config.Agent{Identifier: entry.Agent}}
+	p.Status = ABORTED
+	p.Diagnostic = NewDiag(p.Name)
+	p.Diagnostic.LogEvent(ERROR, "Run got interrupted by a stop of the server")
+
+	if p.Retention.keeps(ABORTED) {
+		for _, workspace := range entry.Workspaces {
+			// Remote agents clean up their own directory when they connect again
+			if workspace.Remote || !utils.IsWithin(conf.AgentDir, workspace.Path) {
+				continue
+			}
+			if _, err := os.Stat(workspace.Path); err != nil {
+				continue
+			}
+			local := &config.Agent{Identifier: workspace.Agent}
+			if p.preserveWorkspace(local, workspace.Path, workspace.Name, false, p.Diagnostic) == nil {
+				summary.Archived = append(summary.Archived, filepath.Join(p.preservedPath(), workspace.Name))
+			}
+		}
+	}
+
+	p.EndTime = time.Now()
+	p.ElapsedTime = p.EndTime.UnixMilli() - p.StartTime.UnixMilli()
+	p.Diagnostic.SetStatus(ABORTED)
+	var errs []error
+	if p.PreservedWorkspace != "" {
+		errs = append(errs, p.savePreserved())
+	}
+	GetStore().RecordRun(p.Name, p.record())
+	errs = append(errs, p.Report.Report(p))
+	summary.Aborted = append(summary.Aborted, p.Name+"/"+p.Id.String())
+	return errors.Join(errs...)
+}
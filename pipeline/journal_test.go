@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func TestJournal(t *testing.T) {
+	state := _test_preserveState(t)
+	var entry JournalEntry
+	p := setPipelineWithState("test_journal", Agent("test_journal"), state,
+		Stages("stages",
+			Stage("stage",
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					content, err := os.ReadFile(p.journalPath())
+					if err != nil {
+						return err
+					}
+					return json.Unmarshal(content, &entry)
+				}),
+			).OnAgent(Agent("test_journal_stage")),
+		),
+	)
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+
+	// Both workspaces were written down while the stage ran
+	utils.FatalExpectedActual(p.Id, entry.Id, t)
+	utils.FatalExpectedActual("test_journal", entry.Agent, t)
+	utils.FatalExpectedActual(2, len(entry.Workspaces), t)
+	utils.FatalExpectedActual(PRESERVED_WORKSPACE, entry.Workspaces[0].Name, t)
+	utils.FatalExpectedActual("test_journal_stage", entry.Workspaces[1].Agent, t)
+
+	_, err := os.Stat(p.journalPath())
+	utils.FatalNoError(err, "entry should have been removed once the run ended", t)
+}
+
+func TestRecover(t *testing.T) {
+	state := _test_preserveState(t)
+	state.ReportDir = t.TempDir()
+
+	// Run that got interrupted in the middle of its execution
+	p := setPipelineWithState("test_recover", Agent("test_recover"), state)
+	p.KeepWorkspaces(RetentionPolicy{})
+	p.ReportJson()
+	p.StartTime = time.Now()
+	p.Agent = state.GetAgent("test_recover").TryAcquire()
+	workspace, err := p.Agent.Prepare()
+	utils.FatalError(err, t)
+	os.WriteFile(filepath.Join(workspace, "file"), []byte("hello"), 0644)
+	utils.FatalError(p.journalWorkspace(p.Agent.Agent, workspace, PRESERVED_WORKSPACE), t)
+
+	// Directory left by a run that crashed before being written down
+	stale := filepath.Join(state.AgentDir, "test_recover_stale")
+	utils.FatalError(os.MkdirAll(filepath.Join(stale, "1"), os.ModePerm), t)
+
+	summary, err := Recover(state)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(1, len(summary.Aborted), t)
+	utils.FatalExpectedActual("test_recover/"+p.Id.String(), summary.Aborted[0], t)
+	utils.FatalExpectedActual(1, len(summary.Archived), t)
+	utils.FatalExpectedActual(1, len(summary.Removed), t)
+	utils.FatalExpectedActual(stale, summary.Removed[0], t)
+
+	// The workspace got archived and the run reported as ABORTED
+	runs, err := ListPreserved(state.PreservedDirectory(), "test_recover")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(1, len(runs), t)
+	utils.FatalExpectedActual(ABORTED, runs[0].Status, t)
+	content, err := os.ReadFile(filepath.Join(runs[0].Path, PRESERVED_WORKSPACE, "file"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("hello", string(content), t)
+
+	reports, err := filepath.Glob(filepath.Join(state.ReportDir, "test_recover", "*.json"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(1, len(reports), t)
+	var report map[string]interface{}
+	content, err = os.ReadFile(reports[0])
+	utils.FatalError(err, t)
+	utils.FatalError(json.Unmarshal(content, &report), t)
+	utils.FatalExpectedActual("ABORTED", report["status"], t)
+	utils.FatalExpectedActual(ABORTED, GetStore().LastRun("test_recover", time.Now()).Status, t)
+
+	// Agents can work again, and nothing is left to recover
+	for _, executor := range []*config.Executor{p.Agent, state.GetAgent("test_recover_stale").TryAcquire()} {
+		_, err = executor.Prepare()
+		utils.FatalError(err, t)
+		utils.FatalError(executor.CleanUp(), t)
+	}
+	summary, err = Recover(state)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(0, len(summary.Aborted), t)
+	utils.FatalExpectedActual(0, len(summary.Removed), t)
+}
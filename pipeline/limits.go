@@ -0,0 +1,238 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+)
+
+// Names of the limits, used as the cause of the failure
+// in the diagnostics.
+//
+// Going over the address space or the open files only makes a call of the
+// command fail, which can't be told apart from any other failure
+const (
+	LIMIT_CPU_TIME  = "cpu-time"
+	LIMIT_MEMORY    = "memory"
+	LIMIT_PROCESSES = "processes"
+	LIMIT_WALL_TIME = "wall-time"
+)
+
+// LimitError tells that a command got stopped because it
+// went over one of the limits of its agent
+type LimitError struct {
+	Limit string // Name of the limit
+	Err   error  // Error the command ended with
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Command went over the %s limit of the agent : %v", e.Limit, e.Err)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// command is a process started by a step, with the limits
+// and the sandbox of the agent applied
+type command struct {
+	*exec.Cmd
+	ctx    context.Context
+	cancel context.CancelFunc
+	limits *config.Limits
+	cgroup *cgroup
+	// Tells why the limits of the agent are not all enforced, if they aren't
+	warning string
+}
+
+// command creates a command executed in the current directory of the
+// pipeline, with the limits and the sandbox of the agent.
+//
+// The command gets killed if ctx is done
+func (p *Pipeline) command(ctx context.Context, name string, args ...string) (*command, error) {
+	agent := p.CurrentAgent(ctx)
+	if agent != nil && agent.Remote != nil {
+		return nil, fmt.Errorf("Agent %s runs on another machine, %s can only be executed there with SH", agent.Identifier, name)
+	}
+	cmd, err := newCommand(ctx, agent, p.Workspace(ctx), p.WorkingDirectory(ctx), name, args...)
+	if err == nil && cmd.warning != "" {
+		p.StageDiagnostic(ctx).LogEvent(WARN, cmd.warning)
+	}
+	return cmd, err
+}
+
+// RunCommand executes a command in dir the way SH does, with the limits
+// and the sandbox of the agent, and gives back its standard output and error.
+// The warning tells why the limits of the agent are not all enforced, if they aren't.
+//
+// Used by the agents running on other machines
+func RunCommand(ctx context.Context, agent *config.Agent, workspace, dir, name string, args ...string) (out []byte, warning string, err error) {
+	cmd, err := newCommand(ctx, agent, workspace, dir, name, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	out, err = cmd.combinedOutput()
+	return out, cmd.warning, err
+}
+
+func newCommand(ctx context.Context, agent *config.Agent, workspace, dir, name string, args ...string) (*command, error) {
+	var limits *config.Limits
+	if agent != nil {
+		limits = agent.Limits
+	}
+	c := &command{limits: limits}
+	if limits != nil && limits.WallTime > 0 {
+		ctx, c.cancel = context.WithTimeout(ctx, time.Duration(limits.WallTime)*time.Second)
+	} else {
+		ctx, c.cancel = context.WithCancel(ctx)
+	}
+	c.ctx = ctx
+	c.Cmd = exec.CommandContext(ctx, name, args...)
+	c.Dir = dir
+	// Children left behind by a killed command must not block it
+	c.WaitDelay = time.Second
+
+	if limits != nil {
+		var err error
+		c.cgroup, err = newCgroup(limits)
+		// The processes are still limited by ulimit
+		if err != nil && limits.Memory > 0 {
+			c.warning = fmt.Sprintf("Memory limit of the agent is not enforced : %v", err)
+		}
+		applyRlimits(c.Cmd, limits, c.cgroup != nil)
+	}
+	err := isolate(c.Cmd, agent, workspace)
+	if err == nil && c.cgroup != nil {
+		err = c.cgroup.attach(c.Cmd)
+	}
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyRlimits makes the command go through a shell setting its limits.
+// The number of processes is left to the cgroup if there is one
+func applyRlimits(cmd *exec.Cmd, limits *config.Limits, hasCgroup bool) {
+	script := []string{"set -e"}
+	if limits.CPUTime > 0 {
+		script = append(script, fmt.Sprintf("ulimit -t %d", limits.CPUTime))
+	}
+	if limits.AddressSpace > 0 {
+		script = append(script, fmt.Sprintf("ulimit -v %d", limits.AddressSpace/1024))
+	}
+	if limits.OpenFiles > 0 {
+		script = append(script, fmt.Sprintf("ulimit -n %d", limits.OpenFiles))
+	}
+	if limits.Processes > 0 && !hasCgroup {
+		// -u for bash and busybox, -p for dash
+		script = append(script, fmt.Sprintf("ulimit -u %d 2>/dev/null || ulimit -p %d", limits.Processes, limits.Processes))
+	}
+	if len(script) == 1 {
+		return
+	}
+	script = append(script, `exec "$@"`)
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return
+	}
+	target := cmd.Path
+	if cmd.Err != nil || target == "" {
+		target = cmd.Args[0]
+	}
+	cmd.Args = append([]string{"sh", "-c", strings.Join(script, "\n"), "jerminal-limits", target}, cmd.Args[1:]...)
+	cmd.Path = sh
+	cmd.Err = nil
+}
+
+// combinedOutput runs the command and gives back its standard output and error
+func (c *command) combinedOutput() ([]byte, error) {
+	out, err := c.Cmd.CombinedOutput()
+	return out, c.done(err)
+}
+
+// output runs the command and gives back its standard output. The standard
+// error is kept in the exec.ExitError
+func (c *command) output() ([]byte, error) {
+	out, err := c.Cmd.Output()
+	return out, c.done(err)
+}
+
+// start starts the command without waiting for it. The limits
+// are released once it ends
+func (c *command) start() error {
+	err := c.Cmd.Start()
+	if err != nil {
+		c.release()
+		return err
+	}
+	go func() {
+		c.Cmd.Wait()
+		c.release()
+	}()
+	return nil
+}
+
+// done releases the resources of the command, and tells which limit
+// made it fail, if any
+func (c *command) done(err error) error {
+	defer c.release()
+	if err == nil || c.limits == nil {
+		return err
+	}
+	limit := c.violatedLimit()
+	if limit == "" {
+		return err
+	}
+	if limit == LIMIT_WALL_TIME {
+		err = fmt.Errorf("%w after %d seconds", context.DeadlineExceeded, c.limits.WallTime)
+	}
+	return &LimitError{Limit: limit, Err: err}
+}
+
+// violatedLimit tells which limit made the command fail, when the
+// deadline, the cgroup or the way the command ended prove it
+func (c *command) violatedLimit() string {
+	if errors.Is(c.ctx.Err(), context.DeadlineExceeded) && c.limits.WallTime > 0 {
+		return LIMIT_WALL_TIME
+	}
+	if c.cgroup != nil {
+		if limit := c.cgroup.violatedLimit(); limit != "" {
+			return limit
+		}
+	}
+	if state := c.ProcessState; state != nil && c.limits.CPUTime > 0 {
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() &&
+			(status.Signal() == syscall.SIGXCPU || status.Signal() == syscall.SIGKILL) &&
+			state.UserTime()+state.SystemTime() >= time.Duration(c.limits.CPUTime)*time.Second-100*time.Millisecond {
+			return LIMIT_CPU_TIME
+		}
+	}
+	return ""
+}
+
+// release stops the timer of the wall time and removes the cgroup
+func (c *command) release() {
+	c.cancel()
+	if c.cgroup != nil {
+		c.cgroup.remove()
+	}
+}
+
+// limitOf gives back the name of the limit that made the error happen,
+// or an empty string if it does not come from a limit
+func limitOf(err error) string {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return limitErr.Limit
+	}
+	return ""
+}
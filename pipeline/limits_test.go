@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func _test_limitedPipeline(t *testing.T, limits *config.Limits) *Pipeline {
+	p := _test_getPipeline("TestLimits")
+	p.Agent.Limits = limits
+	p.Diagnostic = NewDiag("test")
+	p.mainDirectory = t.TempDir()
+	p.directory = p.mainDirectory
+	return p
+}
+
+func TestLimitsApplied(t *testing.T) {
+	p := _test_limitedPipeline(t, &config.Limits{OpenFiles: 64, AddressSpace: 1 << 30})
+	err := Stage("limits", SH("sh", "-c", "ulimit -n; ulimit -v")).ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+	out := MustGetAs[string](p.Outputs("limits"), CmdOutKey)
+	utils.FatalExpectedActual("64\n1048576\n", out, t)
+}
+
+func TestWallTimeLimit(t *testing.T) {
+	p := _test_limitedPipeline(t, &config.Limits{WallTime: 1})
+	start := time.Now()
+	err := Stage("limits", SH("sleep", "10")).ExecuteStage(p, context.Background())
+	utils.FatalNoError(err, "command should have been stopped", t)
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("command should have been stopped after 1 second, took %v", time.Since(start))
+	}
+	utils.FatalExpectedActual(LIMIT_WALL_TIME, limitOf(err), t)
+	diag := p.Diagnostic.Events[0].(*Diagnostic)
+	utils.FatalExpectedActual(TIMED_OUT, diag.Status, t)
+	utils.FatalExpectedActual(LIMIT_WALL_TIME, diag.Cause, t)
+}
+
+func TestCPUTimeLimit(t *testing.T) {
+	p := _test_limitedPipeline(t, &config.Limits{CPUTime: 1, WallTime: 20})
+	err := Stage("limits", SH("sh", "-c", "while :; do :; done")).ExecuteStage(p, context.Background())
+	utils.FatalNoError(err, "command should have been stopped", t)
+	utils.FatalExpectedActual(LIMIT_CPU_TIME, limitOf(err), t)
+	diag := p.Diagnostic.Events[0].(*Diagnostic)
+	utils.FatalExpectedActual(FAILURE, diag.Status, t)
+	utils.FatalExpectedActual(LIMIT_CPU_TIME, diag.Cause, t)
+}
+
+func TestFailureWithoutLimit(t *testing.T) {
+	p := _test_limitedPipeline(t, &config.Limits{OpenFiles: 64})
+	// What the command writes is no proof of a limit
+	for _, script := range []string{"echo 'too many open files' && exit 1", "echo 'Cannot allocate memory' >&2 && exit 1", "exit 1"} {
+		err := Stage("limits", SH("sh", "-c", script)).ExecuteStage(p, context.Background())
+		utils.FatalNoError(err, "command should have failed", t)
+		if limitOf(err) != "" || strings.Contains(err.Error(), "limit") {
+			t.Fatalf("failure should not come from a limit : %v", err)
+		}
+	}
+}
+
+func TestUnenforcedMemoryLimit(t *testing.T) {
+	limits := &config.Limits{Memory: 1 << 30}
+	if cg, err := newCgroup(limits); err == nil {
+		cg.remove()
+		t.Skip("cgroups can be created, the memory limit is enforced")
+	}
+	p := _test_limitedPipeline(t, limits)
+	err := Stage("limits", SH("true")).ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+	warned := false
+	for _, ev := range p.Diagnostic.Events[0].(*Diagnostic).Events {
+		if e, ok := ev.(*DiagnosticEvent); ok && e.Importance == WARN && strings.Contains(e.Description, "not enforced") {
+			warned = true
+		}
+	}
+	utils.FatalExpectedActual(true, warned, t)
+}
@@ -2,7 +2,15 @@ package pipeline
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/Cyber-cicco/jerminal/utils"
 )
@@ -13,11 +21,14 @@ import (
 // The first time it runs, it should execute the commands and caches the current
 // config of the directory
 //
-// The subsequent runs just copies the content of the directory in the agent directory
+// The subsequent runs just copies the content of the directory in the agent directory,
+// until the definition or the inputs of the onceRunner change
 type onceRunner struct {
-	executables    []executable // List of executables to run.
-	executionOrder uint32       // Order in which the executables should be executed.
-	Diagnostic     *Diagnostic  // Infos about the process
+	executables    []Step      // List of executables to run.
+	executionOrder uint32      // Order in which the executables should be executed.
+	Diagnostic     *Diagnostic // Infos about the process
+	inputs         []string    // Values the result depends on
+	inputFiles     []string    // Files of the server the result depends on
 }
 
 func (o *onceRunner) GetName() string {
@@ -30,27 +41,47 @@ func (o *onceRunner) GetShouldStopIfError() bool {
 }
 
 // RunOnce initializes a OnceRunner with the specified executables.
-func RunOnce(executables ...executable) *onceRunner {
+func RunOnce(executables ...Step) *onceRunner {
 	return &onceRunner{
 		executables: executables,
 	}
 }
 
+// Inputs declares values the result of the onceRunner depends on,
+// like the version of a tool. The cache is created again when they change.
+//
+// Changes of the commands of SH steps are detected without it, but not
+// the ones of the code of Exec steps
+func (o *onceRunner) Inputs(values ...string) *onceRunner {
+	o.inputs = append(o.inputs, values...)
+	return o
+}
+
+// InputFiles declares files or directories of the server the result of the
+// onceRunner depends on. The cache is created again when their content change
+func (o *onceRunner) InputFiles(paths ...string) *onceRunner {
+	o.inputFiles = append(o.inputFiles, paths...)
+	return o
+}
+
 // ExecuteInPipeline runs all executables in a OnceRunner.
 func (o *onceRunner) ExecuteInPipeline(p *Pipeline, ctx context.Context) error {
-	empty, err := utils.IsDirEmpty(p.directory)
-
-	if err != nil {
-		return err
+	if p.cacheValid {
+		p.TimeRan++
+		return nil
 	}
 
-	if !empty {
-		return errors.New("Agent directory should be empty when executing a task that runs once per pipeline")
-	}
+	// The workspace of a remote agent is not on this machine
+	if p.Agent.Remote == nil {
+		empty, err := utils.IsDirEmpty(p.directory)
 
-	if p.TimeRan > 0 {
-		p.TimeRan++
-		return nil
+		if err != nil {
+			return err
+		}
+
+		if !empty {
+			return errors.New("Agent directory should be empty when executing a task that runs once per pipeline")
+		}
 	}
 
 	p.Diagnostic.LogEvent(INFO, "Executing pipeline setup for subsequent runs")
@@ -58,8 +89,10 @@ func (o *onceRunner) ExecuteInPipeline(p *Pipeline, ctx context.Context) error {
 	for _, ex := range o.executables {
 		select {
 		case <-ctx.Done():
-            p.Diagnostic.LogEvent(WARN, "Job got canceled before finishing")
-        default:
+			// Nothing gets cached, so the next run executes it again
+			p.Diagnostic.LogEvent(WARN, "Job got canceled before finishing")
+			return ctx.Err()
+		default:
 			err := ex.Execute(p, ctx)
 			if err != nil {
 				return err
@@ -68,12 +101,175 @@ func (o *onceRunner) ExecuteInPipeline(p *Pipeline, ctx context.Context) error {
 		}
 	}
 
-	err = utils.CopyDir(p.directory, p.pipelineDir)
+	var err error
+	if p.Agent.Remote != nil {
+		err = fromAgent(p.Agent.Agent, p.directory, p.pipelineDir)
+	} else {
+		err = utils.CopyDir(p.directory, p.pipelineDir)
+	}
 
 	if err != nil {
 		return err
 	}
 
+	// Written last, so an interrupted copy gets executed again
+	if p.fingerprint != "" {
+		err = os.WriteFile(p.fingerprintPath(), []byte(p.fingerprint), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
 	p.TimeRan++
+	if o == p.lastOnceRunner() {
+		p.unlockCache()
+	}
 	return nil
 }
+
+// fingerprint identifies the definition and the inputs of the onceRunner
+func (o *onceRunner) fingerprint() (string, error) {
+	hash := sha256.New()
+	definition, err := json.Marshal(struct {
+		Steps  StepInfo `json:"steps"`
+		Inputs []string `json:"inputs"`
+		Files  []string `json:"files"`
+	}{o.Info(), o.inputs, o.inputFiles})
+	if err != nil {
+		return "", err
+	}
+	hash.Write(definition)
+	if err := utils.HashPaths(hash, o.inputFiles...); err != nil {
+		return "", fmt.Errorf("Inputs of RunOnce could not be read : %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fingerprintPath gives back the file written next to
+// the cache of the pipeline, identifying what created it
+func (p *Pipeline) fingerprintPath() string {
+	return p.pipelineDir + ".fingerprint"
+}
+
+// checkCache removes the cache of the pipeline if the definition or the
+// inputs of its RunOnce changed since it got created, so they get executed again
+func (p *Pipeline) checkCache(diag *Diagnostic) error {
+	if !p.hasOnceRunner() {
+		return nil
+	}
+	hash := sha256.New()
+	for _, evt := range p.events {
+		if once, ok := evt.(*onceRunner); ok {
+			fingerprint, err := once.fingerprint()
+			if err != nil {
+				return err
+			}
+			hash.Write([]byte(fingerprint))
+		}
+	}
+	p.fingerprint = hex.EncodeToString(hash.Sum(nil))
+
+	saved, err := os.ReadFile(p.fingerprintPath())
+	if err == nil && string(saved) == p.fingerprint {
+		// The cache may have been removed without its fingerprint
+		if infos, statErr := os.Stat(p.pipelineDir); statErr == nil && infos.IsDir() {
+			p.cacheValid = true
+			return nil
+		}
+		diag.LogEvent(INFO, "Cache of the pipeline is missing, executing RunOnce again")
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, statErr := os.Stat(p.pipelineDir); statErr == nil {
+		diag.LogEvent(INFO, "RunOnce changed since the cache got created, executing it again")
+	}
+	if err := p.resetCache(); err != nil {
+		return err
+	}
+
+	// Files left by the previous runs would get in the way
+	if p.reusedWorkspace {
+		entries, err := os.ReadDir(p.mainDirectory)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(p.mainDirectory, entry.Name())); err != nil {
+				return err
+			}
+		}
+		p.reusedWorkspace = false
+	}
+	return nil
+}
+
+// lastOnceRunner gives back the RunOnce executed last by the pipeline,
+// or nil if it has none
+func (p *Pipeline) lastOnceRunner() *onceRunner {
+	var last *onceRunner
+	for _, evt := range p.events {
+		if once, ok := evt.(*onceRunner); ok {
+			last = once
+		}
+	}
+	return last
+}
+
+// hasOnceRunner tells if the pipeline caches things for its subsequent runs
+func (p *Pipeline) hasOnceRunner() bool {
+	for _, evt := range p.events {
+		if _, ok := evt.(*onceRunner); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Locks of the caches of the pipelines, by directory of the cache
+var cacheLocks sync.Map
+
+// cacheMutex gives back the lock serializing the creation and the
+// reset of the cache of the pipeline, shared by all of its runs
+func (p *Pipeline) cacheMutex() *sync.Mutex {
+	mu, _ := cacheLocks.LoadOrStore(p.pipelineDir, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// lockCache waits for the other runs to be done with the cache of the
+// pipeline, and keeps it until unlockCache gets called
+func (p *Pipeline) lockCache() {
+	mu := p.cacheMutex()
+	mu.Lock()
+	p.cacheUnlock = mu.Unlock
+}
+
+// unlockCache lets the other runs use the cache of the pipeline
+// again. Does nothing if the run doesn't hold it
+func (p *Pipeline) unlockCache() {
+	if p.cacheUnlock != nil {
+		p.cacheUnlock()
+		p.cacheUnlock = nil
+	}
+}
+
+// ResetCache removes what the RunOnce of the pipeline cached,
+// so it gets executed again on the next run.
+//
+// Waits for the runs creating the cache to be done with it
+func (p *Pipeline) ResetCache() error {
+	mu := p.cacheMutex()
+	mu.Lock()
+	defer mu.Unlock()
+	return p.resetCache()
+}
+
+func (p *Pipeline) resetCache() error {
+	if err := os.Remove(p.fingerprintPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.RemoveAll(utils.CowDir(p.pipelineDir)); err != nil {
+		return err
+	}
+	return os.RemoveAll(p.pipelineDir)
+}
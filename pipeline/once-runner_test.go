@@ -4,13 +4,19 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/utils"
 )
 
 func TestOnceRunner(t *testing.T) {
 	p := _test_getPipeline("TestOnceRunner")
 	o := &onceRunner{
-		executables: []executable{
+		executables: []Step{
 			Exec(func(p *Pipeline, ctx context.Context) error {
 				err := os.Mkdir(filepath.Join(p.directory, "test"), os.ModePerm)
 				return err
@@ -60,3 +66,144 @@ func TestOnceRunner(t *testing.T) {
 	}
 
 }
+
+func TestOnceRunnerInvalidation(t *testing.T) {
+	state := _test_preserveState(t)
+	input := filepath.Join(t.TempDir(), "input")
+	utils.FatalError(os.WriteFile(input, []byte("v1"), 0644), t)
+	executed := 0
+	content := ""
+	run := func(url string) *Pipeline {
+		p := setPipelineWithState("test_once", Agent("test_once"), state,
+			RunOnce(
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					executed++
+					return nil
+				}),
+				SH("sh", "-c", "echo "+url+" > cloned"),
+			).InputFiles(input),
+			Stages("stages",
+				Stage("read",
+					Exec(func(p *Pipeline, ctx context.Context) error {
+						out, err := os.ReadFile(filepath.Join(p.WorkingDirectory(ctx), "cloned"))
+						content = strings.TrimSpace(string(out))
+						return err
+					}),
+				),
+			),
+		)
+		utils.FatalError(p.ExecutePipeline(context.Background()), t)
+		return p
+	}
+
+	run("first")
+	utils.FatalExpectedActual(1, executed, t)
+
+	// Known even by a new pipeline, like after a restart of the server
+	run("first")
+	utils.FatalExpectedActual(1, executed, t)
+	utils.FatalExpectedActual("first", content, t)
+
+	// Changing a command or an input makes it execute again
+	run("second")
+	utils.FatalExpectedActual(2, executed, t)
+	utils.FatalExpectedActual("second", content, t)
+	utils.FatalError(os.WriteFile(input, []byte("v2"), 0644), t)
+	run("second")
+	utils.FatalExpectedActual(3, executed, t)
+
+	p := run("second")
+	utils.FatalExpectedActual(3, executed, t)
+	utils.FatalError(p.ResetCache(), t)
+	run("second")
+	utils.FatalExpectedActual(4, executed, t)
+
+	// A cache removed without its fingerprint is not valid
+	utils.FatalError(os.RemoveAll(p.pipelineDir), t)
+	run("second")
+	utils.FatalExpectedActual(5, executed, t)
+	utils.FatalExpectedActual("second", content, t)
+}
+
+func TestOnceRunnerConcurrentRuns(t *testing.T) {
+	state := _test_preserveState(t)
+	var executed atomic.Int32
+	pipelines := []*Pipeline{}
+	for i := 0; i < 3; i++ {
+		name := "test_once_concurrent_" + string(rune('a'+i))
+		pipelines = append(pipelines, setPipelineWithState("test_once_concurrent", Agent(name), state,
+			RunOnce(
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					executed.Add(1)
+					time.Sleep(50 * time.Millisecond)
+					return os.WriteFile(filepath.Join(p.directory, "cached"), []byte("ok"), 0644)
+				}),
+			),
+			Stages("stages",
+				Stage("read",
+					Exec(func(p *Pipeline, ctx context.Context) error {
+						_, err := os.Stat(filepath.Join(p.WorkingDirectory(ctx), "cached"))
+						return err
+					}),
+				),
+			),
+		))
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(pipelines))
+	for i, p := range pipelines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = p.ExecutePipeline(context.Background())
+		}()
+	}
+	// A reset in the middle waits for the cache to be created
+	time.Sleep(10 * time.Millisecond)
+	utils.FatalError(pipelines[0].ResetCache(), t)
+	wg.Wait()
+	for _, err := range errs {
+		utils.FatalError(err, t)
+	}
+	for _, p := range pipelines {
+		utils.FatalExpectedActual(SUCCESS, p.GetStatus(), t)
+	}
+	// Executed once, then at most once more after the reset
+	if n := executed.Load(); n < 1 || n > 2 {
+		t.Fatalf("Expected RunOnce to execute once or twice, got %d", n)
+	}
+}
+
+func TestOnceRunnerCanceled(t *testing.T) {
+	state := _test_preserveState(t)
+	executed := 0
+	run := func(cancelFirst bool) *Pipeline {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := setPipelineWithState("test_once_canceled", Agent("test_once_canceled"), state,
+			RunOnce(
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					if cancelFirst {
+						cancel()
+					}
+					return nil
+				}),
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					executed++
+					return nil
+				}),
+			),
+		)
+		p.ExecutePipeline(ctx)
+		return p
+	}
+
+	p := run(true)
+	utils.FatalExpectedActual(0, executed, t)
+	_, err := os.Stat(p.fingerprintPath())
+	utils.FatalNoError(err, "an interrupted RunOnce should not be cached", t)
+
+	run(false)
+	utils.FatalExpectedActual(1, executed, t)
+}
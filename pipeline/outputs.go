@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// StageOutputs holds the values put by each stage in its own
+// namespace, so stages running in parallel don't overwrite each other
+type StageOutputs struct {
+	sync.Mutex
+	stages map[string]*PipelineParams
+}
+
+func newStageOutputs() *StageOutputs {
+	return &StageOutputs{stages: make(map[string]*PipelineParams)}
+}
+
+// of gives back the namespace of the stage, creating it if needed
+func (o *StageOutputs) of(stage string) *PipelineParams {
+	o.Lock()
+	defer o.Unlock()
+	params, ok := o.stages[stage]
+	if !ok {
+		params = &PipelineParams{params: make(map[Key]interface{})}
+		o.stages[stage] = params
+	}
+	return params
+}
+
+// MarshalJSON writes the outputs of each stage, by name of stage
+func (o *StageOutputs) MarshalJSON() ([]byte, error) {
+	o.Lock()
+	defer o.Unlock()
+	res := make(map[string]map[Key]interface{}, len(o.stages))
+	for name, params := range o.stages {
+		res[name] = params.snapshot()
+	}
+	return json.Marshal(res)
+}
+
+// Outputs gives back the namespace of the stage with the given name.
+//
+// Values put in it can be read by any subsequent stage :
+//
+//	p.Outputs("build").Get("version")
+func (p *Pipeline) Outputs(stage string) *PipelineParams {
+	return p.StageOutputs.of(stage)
+}
+
+// CurrentOutputs gives back the namespace of the stage being executed.
+// If the executable does not run in a stage, gives back the
+// params of the pipeline
+func (p *Pipeline) CurrentOutputs(ctx context.Context) *PipelineParams {
+	if scope := stageFrom(ctx); scope != nil {
+		return p.Outputs(scope.name)
+	}
+	return p.PipelineParams
+}
+
+// snapshot gives back a copy of the params
+func (p *PipelineParams) snapshot() map[Key]interface{} {
+	p.Lock()
+	defer p.Unlock()
+	res := make(map[Key]interface{}, len(p.params))
+	for key, val := range p.params {
+		res[key] = val
+	}
+	return res
+}
+
+// paramGetter is implemented by PipelineParams and Pipeline
+type paramGetter interface {
+	Get(param Key) (interface{}, error)
+}
+
+// GetAs gives back the param converted to the requested type,
+// or an error if it does not exist or is of another type
+//
+//	version, err := GetAs[string](p.Outputs("build"), "version")
+func GetAs[T any](p paramGetter, param Key) (T, error) {
+	var res T
+	val, err := p.Get(param)
+	if err != nil {
+		return res, err
+	}
+	res, ok := val.(T)
+	if !ok {
+		return res, fmt.Errorf("param %s is of type %T, not %T", param, val, res)
+	}
+	return res, nil
+}
+
+// MustGetAs works like GetAs, but panics instead of giving back an error
+func MustGetAs[T any](p paramGetter, param Key) T {
+	res, err := GetAs[T](p, param)
+	if err != nil {
+		panic(err.Error())
+	}
+	return res
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func TestStageOutputs(t *testing.T) {
+	p := _test_getPipeline("TestStageOutputs")
+	p.Diagnostic = NewDiag("test")
+	p.directory = t.TempDir()
+	stages := Stages("stages",
+		Stage("first", SH("echo", "first")),
+		Stage("second", SH("echo", "second")),
+	).Parallel()
+	err := stages.ExecuteInPipeline(p, context.Background())
+	utils.FatalError(err, t)
+
+	first, err := GetAs[string](p.Outputs("first"), CmdOutKey)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("first\n", first, t)
+	utils.FatalExpectedActual("second\n", MustGetAs[string](p.Outputs("second"), CmdOutKey), t)
+
+	_, err = GetAs[int](p.Outputs("first"), CmdOutKey)
+	utils.FatalNoError(err, "output is not an int", t)
+	_, err = GetAs[string](p.Outputs("unknown"), CmdOutKey)
+	utils.FatalNoError(err, "stage never ran", t)
+	_, err = p.Get(CmdOutKey)
+	utils.FatalNoError(err, "parallel stages should not share their output", t)
+
+	err = Stage("sequential", SH("echo", "sequential")).ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("sequential\n", string(MustGetAs[[]byte](p, CmdOutKey)), t)
+
+	bytes, err := json.Marshal(p.StageOutputs)
+	utils.FatalError(err, t)
+	var res map[string]map[string]string
+	utils.FatalError(json.Unmarshal(bytes, &res), t)
+	utils.FatalExpectedActual("second\n", res["second"]["CmdOutKey"], t)
+}
+
+func TestCloneCopiesParams(t *testing.T) {
+	p := _test_getPipeline("TestCloneCopiesParams")
+	p.Put("key", 1)
+	clone := p.Clone()
+	clone.Put("key", 2)
+	clone.Outputs("stage").Put("key", 3)
+	utils.FatalExpectedActual(1, MustGetAs[int](p, "key"), t)
+	utils.FatalExpectedActual(2, MustGetAs[int](&clone, "key"), t)
+	_, err := p.Outputs("stage").Get("key")
+	utils.FatalNoError(err, "outputs should not be shared between clones", t)
+}
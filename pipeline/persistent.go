@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+// WorkspaceCleaner prepares a persistent workspace for a new run.
+//
+// An error means the workspace is corrupt. It then gets
+// replaced by a fresh one
+type WorkspaceCleaner func(workspace string) error
+
+// persistence configures the persistent workspace of a pipeline
+type persistence struct {
+	clean WorkspaceCleaner // Nil if the workspace is reused as is
+}
+
+// PersistentWorkspace keeps the workspace of the pipeline between runs
+// instead of removing it. Each agent executor gets its own.
+//
+// Before each run, the clean step gets executed in the workspace,
+// falling back to a fresh one if it fails. A nil clean step
+// reuses the workspace as it was left.
+//
+// Only works with the agents running on the server
+func (p *Pipeline) PersistentWorkspace(clean WorkspaceCleaner) {
+	p.persistent = &persistence{clean: clean}
+}
+
+// GitClean removes every file of the workspace that is not tracked by its
+// git repository, like git clean -fdx would. Files matching one of the
+// patterns, relative to the workspace, are kept.
+//
+// Nested repositories and submodules are left as is. Workspaces without
+// a valid repository are considered corrupt
+func GitClean(keep ...string) WorkspaceCleaner {
+	return func(workspace string) error {
+		entries, err := utils.ReadGitIndex(workspace)
+		if err != nil {
+			return err
+		}
+		tracked := make(map[string]bool, len(entries))
+		dirs := map[string]bool{}
+		for _, entry := range entries {
+			path := filepath.FromSlash(entry.Path)
+			tracked[path] = true
+			for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+				dirs[dir] = true
+			}
+		}
+
+		return filepath.WalkDir(workspace, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(workspace, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			if rel == ".git" || tracked[rel] && d.IsDir() || keeps(rel, keep) {
+				// Submodules are tracked as a whole
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				if dirs[rel] {
+					return nil
+				}
+				if _, err := os.Lstat(filepath.Join(path, ".git")); err == nil {
+					return filepath.SkipDir
+				}
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+			if tracked[rel] {
+				return nil
+			}
+			return os.Remove(path)
+		})
+	}
+}
+
+// keeps tells if the path matches one of the patterns
+func keeps(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if match, _ := filepath.Match(pattern, path); match {
+			return true
+		}
+		// Patterns without separators apply in every directory, like in .gitignore
+		if !strings.ContainsRune(pattern, filepath.Separator) {
+			if match, _ := filepath.Match(pattern, filepath.Base(path)); match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// persistentPath gives back the directory where the workspace of
+// the executor of the pipeline is kept between runs
+func (p *Pipeline) persistentPath() string {
+	return filepath.Join(p.globalState.PersistentDirectory(), p.Name, p.Agent.WorkspaceName())
+}
+
+// restoreWorkspace puts the persistent workspace of the pipeline in place
+// of the fresh one of the executor, and cleans it.
+//
+// Gives back false if the pipeline had no workspace to reuse, or if it was corrupt
+func (p *Pipeline) restoreWorkspace(workspace string, diag *Diagnostic) (bool, error) {
+	saved := p.persistentPath()
+	infos, err := os.Stat(saved)
+	if errors.Is(err, fs.ErrNotExist) {
+		diag.LogEvent(INFO, "No persistent workspace yet, starting from a fresh one")
+		return false, nil
+	}
+	if err == nil && !infos.IsDir() {
+		err = fmt.Errorf("%s is not a directory", saved)
+	}
+	if err == nil {
+		err = os.Remove(workspace)
+	}
+	if err == nil {
+		err = os.Rename(saved, workspace)
+	}
+	if err == nil && p.persistent.clean != nil {
+		err = p.persistent.clean(workspace)
+	}
+	if err == nil {
+		diag.LogEvent(INFO, fmt.Sprintf("Reusing the persistent workspace %s", saved))
+		return true, nil
+	}
+
+	diag.LogEvent(WARN, fmt.Sprintf("Persistent workspace is corrupt, starting from a fresh one : %v", err))
+	if err := os.RemoveAll(saved); err != nil {
+		return false, err
+	}
+	if err := os.RemoveAll(workspace); err != nil {
+		return false, err
+	}
+	return false, os.Mkdir(workspace, os.ModePerm)
+}
+
+// saveWorkspace keeps the workspace for the next run of the pipeline
+func (p *Pipeline) saveWorkspace(workspace string) error {
+	saved := p.persistentPath()
+	if err := os.MkdirAll(filepath.Dir(saved), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(saved); err != nil {
+		return err
+	}
+	return os.Rename(workspace, saved)
+}
@@ -0,0 +1,134 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+// _test_git runs a git command in the directory, giving back its output
+func _test_git(dir string, t *testing.T, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@test", "-c", "init.defaultBranch=main"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed : %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func _test_writeFiles(dir string, t *testing.T, files ...string) {
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		utils.FatalError(os.MkdirAll(filepath.Dir(path), os.ModePerm), t)
+		utils.FatalError(os.WriteFile(path, []byte(file), 0644), t)
+	}
+}
+
+func _test_exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestGitClean(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	for _, version := range []string{"2", "3", "4"} {
+		dir := t.TempDir()
+		_test_git(dir, t, "init", "-q")
+		_test_writeFiles(dir, t, "tracked", "src/tracked", "src/deep/tracked", "nested/tracked")
+		_test_git(filepath.Join(dir, "nested"), t, "init", "-q")
+		_test_git(dir, t, "add", "tracked", "src")
+		_test_git(dir, t, "commit", "-qm", "init")
+		_test_git(dir, t, "update-index", "--index-version", version)
+		_test_writeFiles(dir, t, "untracked", "src/untracked", "src/deep/untracked", "build/output", "debug.log", "src/debug.log")
+
+		utils.FatalError(GitClean("*.log")(dir), t)
+		for _, file := range []string{"tracked", "src/tracked", "src/deep/tracked", "nested/tracked", "debug.log", "src/debug.log", ".git/index"} {
+			if !_test_exists(filepath.Join(dir, file)) {
+				t.Fatalf("index version %s : %s should have been kept", version, file)
+			}
+		}
+		for _, file := range []string{"untracked", "src/untracked", "src/deep/untracked", "build"} {
+			if _test_exists(filepath.Join(dir, file)) {
+				t.Fatalf("index version %s : %s should have been removed", version, file)
+			}
+		}
+	}
+
+	// Workspaces without repository are corrupt
+	utils.FatalNoError(GitClean()(t.TempDir()), "workspace without repository should be refused", t)
+}
+
+func _test_persistentPipeline(state *config.GlobalStateProvider, clean WorkspaceCleaner) *Pipeline {
+	p := setPipelineWithState("test_persistent", Agent("test_persistent"), state,
+		Stages("stages",
+			Stage("write",
+				SH("sh", "-c", "echo run >> runs && touch tmp"),
+			),
+		),
+	)
+	p.PersistentWorkspace(clean)
+	return p
+}
+
+func TestPersistentWorkspace(t *testing.T) {
+	state := _test_preserveState(t)
+	clean := func(workspace string) error {
+		return os.Remove(filepath.Join(workspace, "tmp"))
+	}
+	runs := func(p *Pipeline) string {
+		content, err := os.ReadFile(filepath.Join(p.persistentPath(), "runs"))
+		utils.FatalError(err, t)
+		return strings.TrimSpace(string(content))
+	}
+
+	p := _test_persistentPipeline(state, clean)
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual(false, p.reusedWorkspace, t)
+	utils.FatalExpectedActual("run", runs(p), t)
+
+	// The next run starts from the cleaned workspace of the previous one
+	p = _test_persistentPipeline(state, clean)
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual(true, p.reusedWorkspace, t)
+	utils.FatalExpectedActual("run\nrun", runs(p), t)
+
+	// The agent got released
+	_, err := os.Stat(filepath.Join(state.AgentDir, "test_persistent"))
+	utils.FatalNoError(err, "workspace of the agent should have been moved", t)
+	utils.FatalExpectedActual(true, state.GetAgent("test_persistent").TryAcquire() != nil, t)
+}
+
+func TestCorruptPersistentWorkspace(t *testing.T) {
+	state := _test_preserveState(t)
+	p := _test_persistentPipeline(state, nil)
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+
+	// A failing clean step makes the run start from a fresh workspace
+	p = _test_persistentPipeline(state, func(workspace string) error {
+		return errors.New("corrupt")
+	})
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual(false, p.reusedWorkspace, t)
+	content, err := os.ReadFile(filepath.Join(p.persistentPath(), "runs"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("run\n", string(content), t)
+
+	// So does anything else than a directory
+	path := p.persistentPath()
+	utils.FatalError(os.RemoveAll(path), t)
+	utils.FatalError(os.WriteFile(path, []byte{}, 0644), t)
+	p = _test_persistentPipeline(state, nil)
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual(false, p.reusedWorkspace, t)
+	utils.FatalExpectedActual(true, _test_exists(filepath.Join(path, "runs")), t)
+}
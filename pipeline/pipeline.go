@@ -5,11 +5,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Cyber-cicco/jerminal/config"
-	"github.com/Cyber-cicco/jerminal/utils"
 	"github.com/google/uuid"
 )
 
@@ -23,9 +23,10 @@ type PipelineParams struct {
 // Pipeline represents the main execution context for stages and executors.
 // It uses an Agent to manage execution and a directory for workspace.
 type Pipeline struct {
-	PipelineParams
-	Agent         *config.Agent               `json:"agent"` // Agent executing the Pipeline
+	*PipelineParams
+	Agent         *config.Executor            `json:"agent"` // Executor of the agent executing the Pipeline
 	agentProvider AgentProvider               // function executed at runtime to provide the Agent to the pipeline
+	agentReserved bool                        // true if the Agent has already been reserved for the run
 	Name          string                      `json:"name"` // human readable name of the pipeline
 	mainDirectory string                      // Base directory of the pipeline
 	directory     string                      // Working directory for the pipeline.
@@ -33,61 +34,132 @@ type Pipeline struct {
 	CloneFrom     *uuid.UUID                  `json:"parent,omitempty"`
 	TimeRan       uint32                      `json:"time-ran"` // Number of time the pipeline ran
 	pipelineDir   string                      // Directory to cache things for subsequent runs of the pipeline
-	events        []pipelineEvents            // components to be executed
-	Inerror       bool                        `json:"in-error"` // Indicate if a fatal error has been encountered
+	events        []Event                     // components to be executed
+	Status        ERunStatus                  `json:"status"` // Outcome of the run
+	stageStatuses map[string]ERunStatus       // Status of the stages that were executed, by name
+	coverage      map[string]float64          // Coverage percentage measured by the stages, by name
 	globalState   *config.GlobalStateProvider // L'état de l'application
 	StartTime     time.Time                   `json:"start-time"` // Début de la pipeline
 	EndTime       time.Time                   `json:"end-time"` // Fin de la pipeline
 	Diagnostic    *Diagnostic                 `json:"diagnostics"`  // Infos about the current process. It can change based on what stage is getting executed.
 	ElapsedTime   int64                       `json:"elapsed-time"` // Time it took to run the Pipeline
+	Tests         *TestSummary                `json:"tests,omitempty"` // Totals of the tests executed during the run
+	StageOutputs  *StageOutputs               `json:"outputs"`         // Values put by each stage in its own namespace
+	Commit        *CommitInfo                 `json:"commit,omitempty"` // Commit put in the workspace by Checkout
+	PreservedWorkspace string                 `json:"preserved-workspace,omitempty"` // Directory where the workspaces of the run got kept. Empty if they were removed
+	preservedStages    []string               // Stages whose workspace got kept
+	journal            *JournalEntry          // Entry of the run in the journal, written down to recover from a crash of the server
+	persistent         *persistence           // Workspace kept between runs. Nil if each run gets a fresh one
+	reusedWorkspace    bool                   // true if the run started from the workspace of a previous one
+	fingerprint        string                 // Identifies the definition and the inputs of the RunOnce of the pipeline. Empty if it has none
+	cacheValid         bool                   // true if the cache got created by the same RunOnce, so it doesn't need to be executed
+	cacheUnlock        func()                 // Lets the other runs use the cache of the pipeline. Nil if the run doesn't hold it
 
 	// Copy of the config that should be initialized at start of
 	// the pipeline so it keeps it's config even if there is a change during the execution
-	Config *config.Config `json:"-"`
-	Report *Report        `json:"report-type"` // Config that allows to choose a way of logging the results into a file
+	Config      *config.Config    `json:"-"`
+	Report      *Report           `json:"report-type"` // Config that allows to choose a way of logging the results into a file
+	Concurrency ConcurrencyPolicy `json:"concurrency"` // How the runs of the pipeline can overlap when started by the server
+	Priority    int               `json:"priority"`    // Default priority of the runs in the queue of the server
+	Retention   *RetentionPolicy  `json:"retention,omitempty"` // Workspaces kept after the runs. Nil if they are always removed
 }
 
-// Provides the agent for the pipeline
-type AgentProvider func(p *Pipeline) *config.Agent
+// Provides an agent acquired for the pipeline, or nil
+// if no suitable agent is free at the moment.
+//
+// Gives back an error if no agent could ever be provided
+type AgentProvider func(p *Pipeline) (*config.Executor, error)
 
 // Launches the events of the pipeline
 //
 // MUST BE CALLED IN A GOROUTINE BY THE SERVER
 func (p *Pipeline) ExecutePipeline(ctx context.Context) error {
 	var lastErr error
-	p.Agent = p.agentProvider(p)
 	p.StartTime = time.Now()
 
 	diag := NewDiag(fmt.Sprintf("%s", p.Name))
+	diag.Status = PENDING
 
 	p.Diagnostic = diag
+
+	if !p.agentReserved {
+		err := p.waitForAgent(ctx)
+		if err != nil {
+			diag.LogEvent(WARN, fmt.Sprintf("Pipeline could not get an agent : %v", err))
+			p.MarkStatus(statusFromError(err))
+			diag.SetStatus(p.GetStatus())
+			return err
+		}
+	}
+
+	p.setStatus(RUNNING)
+	diag.SetStatus(RUNNING)
+
 	// Clean up work from the agent at end of pipeline
 	defer func() {
-		err := p.Agent.CleanUp()
+		p.unlockCache()
+		// The final status tells if the workspace should be preserved
+		p.MarkStatus(SUCCESS)
+		err := p.releaseExecutor(p.Agent, p.mainDirectory, PRESERVED_WORKSPACE, p.GetStatus(), diag)
 		if err != nil {
 			diag.LogEvent(CRITICAL, fmt.Sprintf("Agent could not terminate properly because of error %v", err))
 		}
 		lastErr = err
         p.EndTime = time.Now()
 		p.ElapsedTime = p.EndTime.UnixMilli() - p.StartTime.UnixMilli()
-		diag.LogEvent(INFO, fmt.Sprintf("Pipeline finished in %d ms", p.ElapsedTime))
-		if !p.Inerror {
+		if p.PreservedWorkspace != "" {
+			if err := p.savePreserved(); err != nil {
+				diag.LogEvent(ERROR, fmt.Sprintf("Preserved workspaces could not be saved because of error %v", err))
+			}
+		}
+		diag.SetStatus(p.GetStatus())
+		diag.LogEvent(INFO, fmt.Sprintf("Pipeline finished in %d ms with status %s", p.ElapsedTime, p.GetStatus()))
+		if !p.GetStatus().Failed() {
 			p.RanSuccessfully()
 		}
+		GetStore().RecordRun(p.Name, p.record())
 		p.Report.Report(p)
+		if err := p.closeJournal(); err != nil {
+			diag.LogEvent(WARN, fmt.Sprintf("Run could not be removed from the journal because of error %v", err))
+		}
 	}()
 
-	path, err := p.Agent.Initialize()
+	path, err := p.Agent.Prepare()
 
 	if err != nil {
 		fmt.Printf("err: %v\n", err)
 		diag.LogEvent(CRITICAL, fmt.Sprintf("Agent could not initialize because of error %v", err))
+		p.MarkStatus(FAILURE)
 		return err
 	}
 
 	// Sets up the infos about the directory it will work in
 	p.mainDirectory = path
 	p.directory = p.mainDirectory
+	if err := p.journalWorkspace(p.Agent.Agent, path, PRESERVED_WORKSPACE); err != nil {
+		diag.LogEvent(WARN, fmt.Sprintf("Run could not be written down in the journal because of error %v", err))
+	}
+
+	if p.persistent != nil {
+		if p.Agent.Remote != nil {
+			diag.LogEvent(WARN, "Persistent workspaces are not supported by remote agents, starting from a fresh one")
+		} else if p.reusedWorkspace, err = p.restoreWorkspace(path, diag); err != nil {
+			diag.LogEvent(CRITICAL, fmt.Sprintf("Workspace could not be restored because of error %v", err))
+			p.MarkStatus(FAILURE)
+			return err
+		}
+	}
+
+	p.checkChangedFiles(diag)
+
+	// Kept until the RunOnce created the cache, or until the workspace
+	// got seeded from it, so other runs and resets can't change it meanwhile
+	p.lockCache()
+	if err := p.checkCache(diag); err != nil {
+		diag.LogEvent(CRITICAL, fmt.Sprintf("Cache of the pipeline could not be checked because of error %v", err))
+		p.MarkStatus(FAILURE)
+		return err
+	}
 
 	_, err = os.Stat(p.pipelineDir)
 
@@ -95,34 +167,53 @@ func (p *Pipeline) ExecutePipeline(ctx context.Context) error {
 	if err != nil {
 		err := os.MkdirAll(p.pipelineDir, os.ModePerm)
 		if err != nil {
+			p.MarkStatus(FAILURE)
+			return err
+		}
+	} else if p.reusedWorkspace {
+		// Files of the cache overwrite the ones left by the previous run
+		err := toAgent(p.Agent.Agent, p.pipelineDir, p.mainDirectory)
+		if err != nil {
+			p.MarkStatus(FAILURE)
 			return err
 		}
 	} else {
-		err := utils.CopyDir(p.pipelineDir, p.mainDirectory)
+		err := p.seedWorkspace(p.Agent.Agent, p.mainDirectory, diag)
 		if err != nil {
+			p.MarkStatus(FAILURE)
 			return err
 		}
 	}
 
+	if p.cacheValid || p.lastOnceRunner() == nil {
+		p.unlockCache()
+	}
+
 	diag.LogEvent(INFO, "starting main loop")
 	//Executes all the things from the pipeline
-	for _, evt := range p.events {
+	for i, evt := range p.events {
 		var stageErr error
 		select {
 		case <-ctx.Done():
 			diag.LogEvent(WARN, "Pipeline got canceled before finishing")
+			p.MarkStatus(statusFromError(ctx.Err()))
+			p.finishAfterStop(ctx, i, "Skipped because the pipeline got canceled")
 			return ctx.Err()
 		default:
 			err := evt.ExecuteInPipeline(p, ctx)
 			if err != nil {
 				if evt.GetShouldStopIfError() {
 					stageErr = err
-					p.Inerror = true
+					p.MarkStatus(statusFromError(err))
 					diag.LogEvent(ERROR, fmt.Sprintf("got blocking error in executable %s : %v", evt.GetName(), err))
+				} else {
+					p.MarkStatus(UNSTABLE)
+					diag.LogEvent(WARN, fmt.Sprintf("got non blocking error in executable %s : %v", evt.GetName(), err))
 				}
 			}
 		}
 		if stageErr != nil {
+			p.finishAfterStop(ctx, i+1, "Skipped because of a previous blocking error")
 			break
 		}
 	}
@@ -131,6 +222,109 @@ func (p *Pipeline) ExecutePipeline(ctx context.Context) error {
 	return lastErr
 }
 
+// finishAfterStop handles the events that come after the one that stopped
+// the pipeline. Post events still get executed so they can react
+// to the failure, every other event is skipped
+func (p *Pipeline) finishAfterStop(ctx context.Context, from int, reason string) {
+	for _, evt := range p.events[from:] {
+		if post, ok := evt.(*post); ok {
+			err := post.ExecuteInPipeline(p, ctx)
+			if err != nil {
+				p.Diagnostic.LogEvent(ERROR, fmt.Sprintf("got error in executable %s : %v", post.GetName(), err))
+			}
+			continue
+		}
+		p.Diagnostic.skippedDiag(fmt.Sprintf("%s | %s", p.Name, evt.GetName()), reason)
+	}
+}
+
+// ReserveAgent asks the agent provider for a free agent and
+// keeps it for the run.
+//
+// Returns false if no agent could be reserved, with an
+// error if none ever will
+func (p *Pipeline) ReserveAgent() (bool, error) {
+	agent, err := p.agentProvider(p)
+	if agent == nil || err != nil {
+		return false, err
+	}
+	p.Agent = agent
+	p.agentReserved = true
+	return true, nil
+}
+
+// waitForAgent blocks until an agent could be reserved or until
+// the context gets canceled
+func (p *Pipeline) waitForAgent(ctx context.Context) error {
+	for {
+		released := p.globalState.AgentReleased()
+		reserved, err := p.ReserveAgent()
+		if reserved || err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// waitFor blocks until the provider gives back an agent or until
+// the context gets canceled
+func (p *Pipeline) waitFor(ctx context.Context, provider AgentProvider) (*config.Executor, error) {
+	for {
+		released := p.globalState.AgentReleased()
+		agent, err := provider(p)
+		if agent != nil || err != nil {
+			return agent, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// useAgent makes a stage run on its own agent, in a workspace
+// initialized like the one of the pipeline.
+//
+// Gives back the function cleaning the workspace and releasing the agent
+func (p *Pipeline) useAgent(ctx context.Context, scope *stageScope, provider AgentProvider) (func(ERunStatus), error) {
+	scope.diag.LogEvent(INFO, fmt.Sprintf("Stage %s waiting for its agent", scope.name))
+	agent, err := p.waitFor(ctx, provider)
+	if err != nil {
+		return nil, err
+	}
+	path, err := agent.Prepare()
+	name := filepath.Join(PRESERVED_STAGES, scope.name)
+	release := func(status ERunStatus) {
+		err := p.releaseExecutor(agent, path, name, status, scope.diag)
+		if err != nil {
+			scope.diag.LogEvent(CRITICAL, fmt.Sprintf("Agent %s could not terminate properly because of error %v", agent.Identifier, err))
+			return
+		}
+		p.unjournalWorkspace(name)
+	}
+	if err == nil {
+		err = p.seedStage(agent.Agent, path, scope.diag)
+	}
+	if err != nil {
+		path = ""
+		release(FAILURE)
+		return nil, err
+	}
+	if err := p.journalWorkspace(agent.Agent, path, name); err != nil {
+		scope.diag.LogEvent(WARN, fmt.Sprintf("Workspace could not be written down in the journal because of error %v", err))
+	}
+	scope.agent = agent
+	scope.mainDirectory = path
+	scope.directory = path
+	scope.diag.LogEvent(INFO, fmt.Sprintf("Stage %s runs on agent %s", scope.name, agent.Identifier))
+	return release, nil
+}
+
 func (p *Pipeline) RanSuccessfully() {
 	parent, ok := GetStore().GlobalPipelines[p.Name]
 	if !ok {
@@ -168,9 +362,16 @@ func (p *Pipeline) SetReportLogLevel(imp EImportance) {
 	p.Report.LogLevel = imp
 }
 
+// SetPriority sets the default priority of the runs of the pipeline
+// in the queue of the server. Higher priorities get an agent first
+func (p *Pipeline) SetPriority(priority int) {
+	p.Priority = priority
+}
+
 // Clone gives back a shallow copy of the Pipeline
 //
-// Pipelines share their executables and their agent.
+// Pipelines share their executables. Params are copied,
+// and the outputs of the stages start empty.
 //
 // Executed pipelines also share the same ClonedFrom property,
 // which corresponds to the ID they were cloned from
@@ -179,13 +380,33 @@ func (p *Pipeline) Clone() Pipeline {
 	pipeline := *p
 	pipeline.Id = uuid.New()
 	pipeline.CloneFrom = &p.Id
+	pipeline.Agent = nil
+	pipeline.agentReserved = false
+	pipeline.Status = PENDING
+	pipeline.stageStatuses = nil
+	pipeline.Tests = nil
+	pipeline.coverage = nil
+	pipeline.PreservedWorkspace = ""
+	pipeline.preservedStages = nil
+	pipeline.journal = nil
+	pipeline.reusedWorkspace = false
+	pipeline.fingerprint = ""
+	pipeline.cacheValid = false
+	pipeline.cacheUnlock = nil
+	pipeline.Commit = nil
+	pipeline.PipelineParams = &PipelineParams{params: p.snapshot()}
+	pipeline.StageOutputs = newStageOutputs()
 	return pipeline
 }
 
 // SetPipeline initializes a new pipeline with the specified agent and components.
 //
 // It gets the current config of the app and gives back the Pipeline
-func SetPipeline(name string, agent AgentProvider, events ...pipelineEvents) (*Pipeline, error) {
+func SetPipeline(name string, agent AgentProvider, events ...Event) (*Pipeline, error) {
+	err := validateEvents(events)
+	if err != nil {
+		return nil, err
+	}
 	s, err := config.GetState()
 	if err != nil {
 		return nil, err
@@ -196,7 +417,7 @@ func SetPipeline(name string, agent AgentProvider, events ...pipelineEvents) (*P
 // setPipelineWithState gets a new pipeline with a config
 //
 // Only in testing should it be used by something else than SetPipeline
-func setPipelineWithState(name string, agentProvider AgentProvider, config *config.GlobalStateProvider, events ...pipelineEvents) *Pipeline {
+func setPipelineWithState(name string, agentProvider AgentProvider, config *config.GlobalStateProvider, events ...Event) *Pipeline {
 	p := Pipeline{
 		Name:           name,
 		Id:             uuid.New(),
@@ -205,10 +426,12 @@ func setPipelineWithState(name string, agentProvider AgentProvider, config *conf
 		directory:      "",
 		events:         events,
 		Diagnostic:     &Diagnostic{},
+		Status:         PENDING,
 		TimeRan:        0,
 		globalState:    config,
 		Config:         config.Config,
-		PipelineParams: PipelineParams{params: map[Key]interface{}{}},
+		PipelineParams: &PipelineParams{params: map[Key]interface{}{}},
+		StageOutputs:   newStageOutputs(),
 		Report: &Report{
 			Types:    []ReportType{},
 			LogLevel: INFO,
@@ -258,26 +481,55 @@ func (p *PipelineParams) Put(key Key, val interface{}) {
 	p.params[key] = val
 }
 
+func (p *PipelineParams) remove(key Key) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.params, key)
+}
+
 // Agent retrieves an agent with the specified identifier.
 func Agent(id string) AgentProvider {
-	return func(p *Pipeline) *config.Agent {
-		return p.globalState.GetAgent(id)
+	return func(p *Pipeline) (*config.Executor, error) {
+		return p.globalState.GetAgent(id).TryAcquire(), nil
 	}
 }
 
-// Returns the first agent available. If none is, returns
-// the default agent
+// Returns the available agent preferred by the selection strategy
+// of the server. If none is, the pipeline waits for one to be released
 func AnyAgent() AgentProvider {
-	return func(p *Pipeline) *config.Agent {
-		return p.globalState.GetAnyAgent()
+	return func(p *Pipeline) (*config.Executor, error) {
+		return p.globalState.AcquireAnyAgent(p.selection()), nil
 	}
 }
 
-// Returns the default agent even if busy
+// Returns the default agent, waiting for it if busy
 func DefaultAgent() AgentProvider {
-	return func(p *Pipeline) *config.Agent {
-		return p.globalState.DefaultAgent()
+	return func(p *Pipeline) (*config.Executor, error) {
+		return p.globalState.DefaultAgent().TryAcquire(), nil
+	}
+}
+
+// AgentWithLabels returns the available agent preferred by the selection
+// strategy among the ones carrying every one of the labels. If none is,
+// the pipeline waits for one to be released.
+//
+// Fails if no agent carries the labels
+func AgentWithLabels(labels ...string) AgentProvider {
+	return func(p *Pipeline) (*config.Executor, error) {
+		if !p.globalState.CanProvideLabels(labels...) {
+			return nil, fmt.Errorf("No agent has the labels %s", strings.Join(labels, ", "))
+		}
+		return p.globalState.AcquireAnyAgent(p.selection(labels...)), nil
+	}
+}
+
+// selection describes the run to the strategy selecting its agent
+func (p *Pipeline) selection(labels ...string) config.Selection {
+	sel := config.Selection{Pipeline: p.Name, Labels: labels, Run: p.Id.String()}
+	if last := GetStore().LastRun(p.Name, time.Now()); last != nil {
+		sel.LastAgent = last.Agent
 	}
+	return sel
 }
 
 func (p *Pipeline) GetId() string {
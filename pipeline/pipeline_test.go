@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Cyber-cicco/jerminal/config"
 	"github.com/Cyber-cicco/jerminal/utils"
@@ -13,19 +17,22 @@ import (
 
 func _test_getPipeline(agentId string) *Pipeline {
 	return &Pipeline{
-		Agent: &config.Agent{
-			Identifier: agentId,
+		Agent: &config.Executor{
+			Agent: &config.Agent{
+				Identifier: agentId,
+			},
 		},
 		Name:          "test",
 		mainDirectory: "./test",
 		directory:     "./test",
 		Id:            uuid.New(),
 		TimeRan:       0,
-		events:        []pipelineEvents{},
-		Inerror:       false,
-		PipelineParams: PipelineParams{
+		events:        []Event{},
+		Status:        PENDING,
+		PipelineParams: &PipelineParams{
 			params: make(map[Key]interface{}),
 		},
+		StageOutputs: newStageOutputs(),
 		Diagnostic: &Diagnostic{},
 		globalState: config.GetStateCustomConf(&config.Config{
 			AgentDir:             "./test/agent",
@@ -36,6 +43,19 @@ func _test_getPipeline(agentId string) *Pipeline {
 	}
 }
 
+// _test_getState gives back the state used in tests, making sure
+// the directory of the agents exists
+func _test_getState() *config.GlobalStateProvider {
+	state := config.GetStateCustomConf(&config.Config{
+		AgentDir:             "./test/agent",
+		PipelineDir:          "./test/pipeline",
+		JerminalResourcePath: "../resources/jerminal.json",
+		AgentResourcePath:    "../resources/agents.json",
+	})
+	os.MkdirAll(state.AgentDir, os.ModePerm)
+	return state
+}
+
 func TestPipelineExecution1(t *testing.T) {
 	actual := 0
 	expected := 46
@@ -145,8 +165,8 @@ func TestPipelineExecution1(t *testing.T) {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	if p.Inerror {
-		t.Fatalf("Pipeline should not have been in error")
+	if p.Status != UNSTABLE {
+		t.Fatalf("Pipeline should have been unstable, got %s", p.Status)
 	}
 
 	if expected != actual {
@@ -259,8 +279,8 @@ func TestPipelineExecution2(t *testing.T) {
 		t.Fatalf("Expected no error but got %v", err)
 	}
 
-	if !p.Inerror {
-		t.Fatalf("Pipeline should have been in error")
+	if p.Status != FAILURE {
+		t.Fatalf("Pipeline should have been in error, got %s", p.Status)
 	}
 
 	if expected != actual {
@@ -399,8 +419,8 @@ func TestPipelineParams(t *testing.T) {
 		t.Fatalf("Expected no error but got %v", err)
 	}
 
-	if !p.Inerror {
-		t.Fatalf("Pipeline should have been in error")
+	if p.Status != FAILURE {
+		t.Fatalf("Pipeline should have been in error, got %s", p.Status)
 	}
 
 	expected := 21
@@ -441,3 +461,251 @@ func TestStagesStopage(t *testing.T) {
     utils.FatalError(err, t)
     utils.FatalExpectedActual(1, res, t)
 }
+
+func TestPipelineWaitsForAgent(t *testing.T) {
+	state := _test_getState()
+	p := setPipelineWithState("test_wait",
+		Agent("test_wait"),
+		state,
+		Stages("stages",
+			Stage("stage",
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					return nil
+				}),
+			),
+		),
+	)
+	busy := state.GetAgent("test_wait").TryAcquire()
+	utils.FatalExpectedActual(true, busy != nil, t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := p.ExecutePipeline(ctx)
+	utils.FatalExpectedActual(context.DeadlineExceeded, err, t)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		busy.CleanUp()
+	}()
+	err = p.ExecutePipeline(context.Background())
+	utils.FatalError(err, t)
+}
+
+func TestAgentWithLabels(t *testing.T) {
+	state := _test_getState()
+	state.GetAgent("test_labels").Labels = []string{"go1.23", "big-disk"}
+	p := setPipelineWithState("test_labels",
+		AgentWithLabels("go1.23", "big-disk"),
+		state,
+		Stages("stages",
+			Stage("stage",
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					utils.FatalExpectedActual("test_labels", p.Agent.Identifier, t)
+					return nil
+				}),
+			),
+		),
+	)
+	busy := state.GetAgent("test_labels").TryAcquire()
+	utils.FatalExpectedActual(true, busy != nil, t)
+
+	// Waits for the matching agent instead of taking another one
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := p.ExecutePipeline(ctx)
+	utils.FatalExpectedActual(context.DeadlineExceeded, err, t)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		busy.CleanUp()
+	}()
+	err = p.ExecutePipeline(context.Background())
+	utils.FatalError(err, t)
+
+	p = setPipelineWithState("test_no_labels", AgentWithLabels("windows"), state)
+	err = p.ExecutePipeline(context.Background())
+	utils.FatalNoError(err, "no agent can match the labels", t)
+	utils.FatalExpectedActual(FAILURE, p.Status, t)
+}
+
+func TestAgentExecutors(t *testing.T) {
+	state := _test_getState()
+	state.GetAgent("test_executors").Executors = 2
+	started := make(chan string, 2)
+	proceed := make(chan struct{})
+	newPipeline := func(name string) *Pipeline {
+		return setPipelineWithState(name,
+			Agent("test_executors"),
+			state,
+			Stages("stages",
+				Stage("stage",
+					Exec(func(p *Pipeline, ctx context.Context) error {
+						started <- p.Workspace(ctx)
+						<-proceed
+						return nil
+					}),
+				),
+			),
+		)
+	}
+	errs := make(chan error, 2)
+	for _, name := range []string{"test_executors_1", "test_executors_2"} {
+		p := newPipeline(name)
+		go func() {
+			errs <- p.ExecutePipeline(context.Background())
+		}()
+	}
+
+	// Both runs execute at the same time, each in the workspace of its executor
+	workspaces := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case workspace := <-started:
+			workspaces[workspace] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("runs should execute at the same time on the agent")
+		}
+	}
+	utils.FatalExpectedActual(2, len(workspaces), t)
+	close(proceed)
+	utils.FatalError(<-errs, t)
+	utils.FatalError(<-errs, t)
+	utils.FatalExpectedActual(false, state.GetAgent("test_executors").Busy, t)
+}
+
+func TestAnyAgentAffinity(t *testing.T) {
+	state := _test_getState()
+	state.SetStrategy(config.Affinity(config.RoundRobin()))
+	defer state.SetStrategy(nil)
+
+	agents := []string{}
+	for i := 0; i < 3; i++ {
+		p := setPipelineWithState("test_affinity", AnyAgent(), state,
+			Stages("stages",
+				Stage("stage",
+					Exec(func(p *Pipeline, ctx context.Context) error {
+						agents = append(agents, p.Agent.Identifier)
+						return nil
+					}),
+				),
+			),
+		)
+		utils.FatalError(p.ExecutePipeline(context.Background()), t)
+	}
+	utils.FatalExpectedActual(agents[0], agents[1], t)
+	utils.FatalExpectedActual(agents[0], agents[2], t)
+	utils.FatalExpectedActual(agents[0], GetStore().LastRun("test_affinity", time.Now()).Agent, t)
+}
+
+func TestAgentFromPool(t *testing.T) {
+	state := _test_preserveState(t)
+	state.Pools = []config.Pool{{Prefix: "test_pool", Max: 1, Labels: []string{"pool-test"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go state.RunPools(ctx, 10*time.Millisecond)
+
+	agent := ""
+	p := setPipelineWithState("test_pool", AgentWithLabels("pool-test"), state,
+		Stages("stages",
+			Stage("stage",
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					agent = p.Agent.Identifier
+					return nil
+				}),
+			),
+		),
+	)
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual("test_pool-1", agent, t)
+}
+
+func TestWorkspaceProvisioning(t *testing.T) {
+	for _, method := range []string{"hardlink", "cow-hardlink", "copy", ""} {
+		state := _test_preserveState(t)
+		if method != "" {
+			state.Provisioning = []string{method}
+		}
+		cache := filepath.Join(state.PipelineDir, "test_provision")
+		utils.FatalError(os.MkdirAll(filepath.Join(cache, "dir"), os.ModePerm), t)
+		utils.FatalError(os.WriteFile(filepath.Join(cache, "dir", "cached"), []byte("cached"), 0644), t)
+		utils.FatalError(os.Symlink("dir/cached", filepath.Join(cache, "link")), t)
+
+		linked := false
+		p := setPipelineWithState("test_provision", Agent("test_provision"), state,
+			Stages("stages",
+				Stage("stage",
+					Exec(func(p *Pipeline, ctx context.Context) error {
+						cached, err := os.Stat(filepath.Join(cache, "dir", "cached"))
+						if err != nil {
+							return err
+						}
+						provisioned, err := os.Stat(filepath.Join(p.WorkingDirectory(ctx), "link"))
+						if err != nil {
+							return err
+						}
+						linked = os.SameFile(cached, provisioned)
+						return nil
+					}),
+				),
+			),
+		)
+		p.Config = state.CloneConfig()
+		utils.FatalError(p.ExecutePipeline(context.Background()), t)
+		utils.FatalExpectedActual(method == "hardlink", linked, t)
+
+		// The files of the cache are left as they are
+		infos, err := os.Stat(filepath.Join(cache, "dir", "cached"))
+		utils.FatalError(err, t)
+		utils.FatalExpectedActual(fs.FileMode(0644), infos.Mode().Perm(), t)
+	}
+
+	_, err := utils.Provision(t.TempDir(), t.TempDir(), "rsync")
+	utils.FatalNoError(err, "unknown methods should be refused", t)
+}
+
+func TestCowHardlinkProvisioning(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "cache")
+	utils.FatalError(os.MkdirAll(src, os.ModePerm), t)
+	cached := filepath.Join(src, "cached")
+	utils.FatalError(os.WriteFile(cached, []byte("cached"), 0644), t)
+
+	first, second := t.TempDir(), t.TempDir()
+	stats, err := utils.Provision(src, first, utils.PROVISION_COW_HARDLINK)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(1, stats.Files[utils.PROVISION_COW_HARDLINK], t)
+	_, err = utils.Provision(src, second, utils.PROVISION_COW_HARDLINK)
+	utils.FatalError(err, t)
+
+	cacheInfos, err := os.Stat(cached)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(fs.FileMode(0644), cacheInfos.Mode().Perm(), t)
+	firstInfos, err := os.Stat(filepath.Join(first, "cached"))
+	utils.FatalError(err, t)
+	secondInfos, err := os.Stat(filepath.Join(second, "cached"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(fs.FileMode(0444), firstInfos.Mode().Perm(), t)
+	utils.FatalExpectedActual(false, os.SameFile(cacheInfos, firstInfos), t)
+	utils.FatalExpectedActual(true, os.SameFile(firstInfos, secondInfos), t)
+
+	// Replacing the file gives the workspace its own copy
+	replaced := filepath.Join(first, "cached")
+	utils.FatalError(os.Remove(replaced), t)
+	utils.FatalError(os.WriteFile(replaced, []byte("replaced"), 0644), t)
+	content, err := os.ReadFile(filepath.Join(second, "cached"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("cached", string(content), t)
+
+	// A copy written in place gets made again
+	copied := filepath.Join(utils.CowDir(src), "cached")
+	utils.FatalError(os.Chmod(copied, 0644), t)
+	utils.FatalError(os.WriteFile(copied, []byte("changed"), 0644), t)
+	third := t.TempDir()
+	_, err = utils.Provision(src, third, utils.PROVISION_COW_HARDLINK)
+	utils.FatalError(err, t)
+	content, err = os.ReadFile(filepath.Join(third, "cached"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("cached", string(content), t)
+	content, err = os.ReadFile(cached)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("cached", string(content), t)
+}
@@ -0,0 +1,210 @@
+package pipeline
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// StepInfo describes a step or an event of the pipeline
+type StepInfo struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Params      map[string]string `json:"params,omitempty"` // Parameters the step would be executed with
+	Steps       []StepInfo        `json:"steps,omitempty"`  // Steps contained by the element
+}
+
+// describedStep attaches informations to a step
+type describedStep struct {
+	Step
+	info StepInfo
+}
+
+func (d *describedStep) Info() StepInfo {
+	return d.info
+}
+
+// Describe attaches a name, a description and params to a step,
+// so they show up in the plan and the diagnostics of the pipeline
+func Describe(step Step, name, description string, params map[string]string) Step {
+	return &describedStep{
+		Step: step,
+		info: StepInfo{
+			Name:        name,
+			Description: description,
+			Params:      params,
+		},
+	}
+}
+
+// infoOf gives back the informations of a step or an event,
+// falling back to its name or its type
+func infoOf(element interface{}) StepInfo {
+	switch e := element.(type) {
+	case Describer:
+		return e.Info()
+	case Event:
+		return StepInfo{Name: e.GetName()}
+	case Exec:
+		return StepInfo{Name: "exec"}
+	}
+	return StepInfo{Name: fmt.Sprintf("%T", element)}
+}
+
+// Plan describes what the pipeline would execute, without executing anything
+func (p *Pipeline) Plan() []StepInfo {
+	plan := make([]StepInfo, len(p.events))
+	for i, evt := range p.events {
+		plan[i] = infoOf(evt)
+	}
+	return plan
+}
+
+func (s *stages) Info() StepInfo {
+	info := StepInfo{
+		Name:   s.name,
+		Params: map[string]string{"parallel": strconv.FormatBool(s.parallel)},
+		Steps:  make([]StepInfo, len(s.stages)),
+	}
+	for i, stage := range s.stages {
+		info.Steps[i] = infoOf(stage)
+	}
+	if s.post != nil {
+		info.Steps = append(info.Steps, s.post.Info())
+	}
+	return info
+}
+
+func (s *stage) Info() StepInfo {
+	info := StepInfo{
+		Name: s.name,
+		Params: map[string]string{
+			"tries":         strconv.Itoa(int(s.tries)),
+			"stop-if-error": strconv.FormatBool(s.shouldStopIfError),
+		},
+		Steps: make([]StepInfo, len(s.executors)),
+	}
+	if s.agentProvider != nil {
+		info.Params["own-agent"] = "true"
+	}
+	if len(s.changes) > 0 {
+		info.Params["on-changes"] = strings.Join(s.changes, ", ")
+	}
+	if s.cache != nil {
+		info.Params["cache-inputs"] = strings.Join(s.cache.inputs, ", ")
+		info.Params["cache-outputs"] = strings.Join(s.cache.outputs, ", ")
+	}
+	for i, ex := range s.executors {
+		info.Steps[i] = infoOf(ex)
+	}
+	if s.post != nil {
+		info.Steps = append(info.Steps, s.post.Info())
+	}
+	return info
+}
+
+func (e *executor) Info() StepInfo {
+	info := StepInfo{Name: "defer"}
+	if e.ex != nil {
+		info = infoOf(e.ex)
+	}
+	if e.recoveryFunc != nil {
+		info.Steps = append(info.Steps, StepInfo{
+			Name:        "recovery",
+			Description: "Executed if the step fails",
+			Steps:       []StepInfo{infoOf(e.recoveryFunc)},
+		})
+	}
+	if e.deferedFunc != nil {
+		info.Steps = append(info.Steps, StepInfo{
+			Name:        "defer",
+			Description: "Executed at the end of the stage",
+			Steps:       []StepInfo{infoOf(e.deferedFunc)},
+		})
+	}
+	return info
+}
+
+func (o *onceRunner) Info() StepInfo {
+	info := StepInfo{
+		Name:        o.GetName(),
+		Description: "Executed on the first run only, then copied from the cache",
+		Steps:       make([]StepInfo, len(o.executables)),
+	}
+	for i, ex := range o.executables {
+		info.Steps[i] = infoOf(ex)
+	}
+	return info
+}
+
+func (p *post) Info() StepInfo {
+	info := StepInfo{Name: "post"}
+	handlers := map[string]bool{
+		"success":    p.success != nil,
+		"failure":    p.failure != nil,
+		"unstable":   p.unstable != nil,
+		"aborted":    p.aborted != nil,
+		"fixed":      p.fixed != nil,
+		"regression": p.regression != nil,
+		"always":     p.always != nil,
+	}
+	info.Params = make(map[string]string)
+	for name, set := range handlers {
+		if set {
+			info.Params[name] = "set"
+		}
+	}
+	return info
+}
+
+// validator is implemented by the events that can be
+// misconfigured by the user
+type validator interface {
+	validate() error
+}
+
+// validateEvents checks that the events given to a
+// pipeline can be executed
+func validateEvents(events []Event) error {
+	for i, evt := range events {
+		if isNil(evt) {
+			return fmt.Errorf("Event n°%d of the pipeline is nil", i)
+		}
+		if v, ok := evt.(validator); ok {
+			if err := v.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *stages) validate() error {
+	for i, stage := range s.stages {
+		if stage == nil {
+			return fmt.Errorf("Stage n°%d of stages %s is nil", i, s.name)
+		}
+		if err := stage.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *stage) validate() error {
+	return s.err
+}
+
+// isNil tells if the value is nil, or an interface holding a nil value
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Func, reflect.Map, reflect.Slice, reflect.Chan, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+// _test_deploy is a step written outside of the
+// package, like helm.Deploy would be
+type _test_deploy struct {
+	release string
+	command []string // Executed with Run if not empty
+	ran     bool
+	out     string
+}
+
+func (d *_test_deploy) Execute(p *Pipeline, ctx context.Context) error {
+	d.ran = true
+	if len(d.command) == 0 {
+		return nil
+	}
+	out, err := p.Run(ctx, d.command[0], d.command[1:]...)
+	d.out = string(out)
+	return err
+}
+
+func (d *_test_deploy) Info() StepInfo {
+	return StepInfo{
+		Name:        "deploy",
+		Description: "Deploys a release",
+		Params:      map[string]string{"release": d.release},
+	}
+}
+
+func TestCustomStep(t *testing.T) {
+	p := _test_getPipeline("TestCustomStep")
+	p.Diagnostic = NewDiag("test")
+	deploy := &_test_deploy{release: "app"}
+	err := Stage("deploy", deploy).ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+	if !deploy.ran {
+		t.Fatal("custom step should have been executed")
+	}
+}
+
+func TestCustomStepRun(t *testing.T) {
+	p := _test_getPipeline("TestCustomStepRun")
+	p.Diagnostic = NewDiag("test")
+	p.mainDirectory = t.TempDir()
+	p.directory = p.mainDirectory
+	deploy := &_test_deploy{release: "app", command: []string{"sh", "-c", "pwd; ulimit -n"}}
+	p.Agent.Limits = &config.Limits{OpenFiles: 64}
+	err := Stage("deploy", deploy).ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(p.Workspace(context.Background())+"\n64\n", deploy.out, t)
+
+	// Goes over the limits of the agent like SH
+	p.Agent.Limits = &config.Limits{WallTime: 1}
+	deploy.command = []string{"sleep", "10"}
+	err = Stage("deploy", deploy).ExecuteStage(p, context.Background())
+	utils.FatalExpectedActual(LIMIT_WALL_TIME, limitOf(err), t)
+}
+
+func TestNilStep(t *testing.T) {
+	var deploy *_test_deploy
+	stage := Stage("deploy", SH("echo"), deploy)
+	utils.FatalNoError(stage.validate(), "nil step should be reported", t)
+
+	_, err := SetPipeline("test", AnyAgent(), Stages("stages", stage))
+	utils.FatalNoError(err, "pipeline with a nil step should not be created", t)
+
+	p := _test_getPipeline("TestNilStep")
+	p.Diagnostic = NewDiag("test")
+	err = stage.ExecuteStage(p, context.Background())
+	utils.FatalNoError(err, "stage with a nil step should fail", t)
+	utils.FatalExpectedActual(FAILURE, p.Diagnostic.Events[0].(*Diagnostic).Status, t)
+}
+
+func TestPlan(t *testing.T) {
+	p := _test_getPipeline("TestPlan")
+	p.events = []Event{
+		Stages("stages",
+			Stage("build",
+				SH("go", "build", "./..."),
+				ExecTryCatch(
+					func(p *Pipeline, ctx context.Context) error { return errors.New("test") },
+					&_test_deploy{release: "rollback"},
+				),
+			),
+			Stage("deploy", &_test_deploy{release: "app"}),
+		).Parallel(),
+		Post(nil, nil, nil),
+	}
+	plan := p.Plan()
+	utils.FatalExpectedActual(2, len(plan), t)
+	utils.FatalExpectedActual("true", plan[0].Params["parallel"], t)
+	build := plan[0].Steps[0]
+	utils.FatalExpectedActual("go build ./...", build.Steps[0].Params["command"], t)
+	utils.FatalExpectedActual("exec", build.Steps[1].Name, t)
+	utils.FatalExpectedActual("rollback", build.Steps[1].Steps[0].Steps[0].Params["release"], t)
+	utils.FatalExpectedActual("app", plan[0].Steps[1].Steps[0].Params["release"], t)
+	utils.FatalExpectedActual("post", plan[1].Name, t)
+}
@@ -2,55 +2,164 @@ package pipeline
 
 import (
 	"context"
+	"fmt"
 )
 
 type post struct {
-	success Success
-	failure Failure
-	always  Always
+	success    Success
+	failure    Failure
+	always     Always
+	unstable   Unstable
+	aborted    Aborted
+	fixed      Fixed
+	regression Regression
 }
 
 // Invoked by post in case of success
 type Success func(p *Pipeline, ctx context.Context) error
+
 // Invoked by post in case of failure
 type Failure func(p *Pipeline, ctx context.Context) error
+
 // Always invoked by post
 type Always func(p *Pipeline, ctx context.Context) error
 
+// Invoked by post if the execution is UNSTABLE, instead of Success
+type Unstable func(p *Pipeline, ctx context.Context) error
+
+// Invoked by post if the execution got canceled, instead of Failure
+type Aborted func(p *Pipeline, ctx context.Context) error
+
+// Invoked by post if the previous run failed or was unstable and this one succeeded
+type Fixed func(p *Pipeline, ctx context.Context) error
+
+// Invoked by post if the previous run succeeded and this one did not
+type Regression func(p *Pipeline, ctx context.Context) error
+
 func (p *post) ExecuteInPipeline(pipeline *Pipeline, ctx context.Context) error {
-    diag := NewDiag("post")
-    pipeline.Diagnostic.AddChild(diag)
-    pipeline.Diagnostic = diag
-    defer func(){
-        pipeline.ResetDiag()
-    }()
-    if pipeline.Inerror {
-        err := p.failure.ExecuteError(pipeline, ctx)
-        if err != nil {
-            return err
-        }
-    } else {
-        err := p.success.ExecuteSuccess(pipeline, ctx)
-        if err != nil {
-            return err
-        }
-    }
-    return p.always.ExecuteAlways(pipeline, ctx)
+	diag := NewDiag("post")
+	pipeline.Diagnostic.AddChild(diag)
+	pipeline.Diagnostic = diag
+	defer func() {
+		pipeline.ResetDiag()
+	}()
+
+	var previous *ERunStatus
+	if record := pipeline.previousRun(); record != nil {
+		previous = &record.Status
+	}
+	err := p.execute(pipeline, ctx, pipeline.GetStatus().Worst(SUCCESS), previous)
+	diag.SetStatus(statusFromError(err))
+	return err
+}
+
+// executeFor runs the post handlers attached to a stage or a
+// group of stages, given the status it ended with
+func (p *post) executeFor(pipeline *Pipeline, ctx context.Context, parent *Diagnostic, name string, status ERunStatus) error {
+	diag := NewDiag(fmt.Sprintf("%s | post %s", pipeline.Name, name))
+	parent.AddChild(diag)
+
+	var previous *ERunStatus
+	if record := pipeline.previousRun(); record != nil {
+		if stageStatus, ok := record.Stages[name]; ok {
+			previous = &stageStatus
+		}
+	}
+	err := p.execute(pipeline, ctx, status, previous)
+	diag.SetStatus(statusFromError(err))
+	return err
+}
+
+// execute calls the handlers matching the status of the execution.
+//
+// previous is the status of the same element in the previous
+// run, or nil if it was never executed
+func (p *post) execute(pipeline *Pipeline, ctx context.Context, status ERunStatus, previous *ERunStatus) error {
+	handlers := []func(p *Pipeline, ctx context.Context) error{}
+
+	switch {
+	case status == UNSTABLE && p.unstable != nil:
+		handlers = append(handlers, p.unstable)
+	case status == ABORTED && p.aborted != nil:
+		handlers = append(handlers, p.aborted)
+	case status.Failed():
+		if p.failure != nil {
+			handlers = append(handlers, p.failure)
+		}
+	default:
+		if p.success != nil {
+			handlers = append(handlers, p.success)
+		}
+	}
+
+	if previous != nil {
+		passed := !status.Failed() && status != UNSTABLE
+		previousPassed := !previous.Failed() && *previous != UNSTABLE
+		if p.fixed != nil && passed && !previousPassed && *previous != ABORTED {
+			handlers = append(handlers, p.fixed)
+		}
+		if p.regression != nil && !passed && status != ABORTED && previousPassed {
+			handlers = append(handlers, p.regression)
+		}
+	}
+
+	for _, handler := range handlers {
+		err := handler(pipeline, ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.always != nil {
+		return p.always.ExecuteAlways(pipeline, ctx)
+	}
+	return nil
 }
 
 func (p *post) GetName() string {
-    return "Post pipeline job"
+	return "Post pipeline job"
 }
 
 // Functions to execute after executing stages.
 // Technically, you could use Post anywhere in the
-// pipeline, but it is not recommended
+// pipeline, but it is not recommended.
+//
+// Any of the functions can be nil. Post can also be attached to a
+// stage or a group of stages with their Post method.
 func Post(success Success, failure Failure, always Always) *post {
-    return &post{
-    	success: success,
-    	failure: failure,
-    	always:  always,
-    }
+	return &post{
+		success: success,
+		failure: failure,
+		always:  always,
+	}
+}
+
+// OnUnstable sets the function to execute instead of success
+// if the execution is UNSTABLE
+func (p *post) OnUnstable(unstable Unstable) *post {
+	p.unstable = unstable
+	return p
+}
+
+// OnAborted sets the function to execute instead of failure
+// if the execution got canceled
+func (p *post) OnAborted(aborted Aborted) *post {
+	p.aborted = aborted
+	return p
+}
+
+// OnFixed sets the function to execute if the previous run
+// failed or was unstable, and this one passed
+func (p *post) OnFixed(fixed Fixed) *post {
+	p.fixed = fixed
+	return p
+}
+
+// OnRegression sets the function to execute if the previous run
+// passed, and this one failed or is unstable
+func (p *post) OnRegression(regression Regression) *post {
+	p.regression = regression
+	return p
 }
 
 // GetShouldStopIfError must always return true for this struct
@@ -59,13 +168,13 @@ func (p *post) GetShouldStopIfError() bool {
 }
 
 func (s Success) ExecuteSuccess(p *Pipeline, ctx context.Context) error {
-    return s(p, ctx)
+	return s(p, ctx)
 }
 
 func (f Failure) ExecuteError(p *Pipeline, ctx context.Context) error {
-    return f(p, ctx)
+	return f(p, ctx)
 }
 
 func (a Always) ExecuteAlways(p *Pipeline, ctx context.Context) error {
-    return a(p, ctx)
+	return a(p, ctx)
 }
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func TestPostNilHandlers(t *testing.T) {
+	p := _test_getPipeline("TestPostNilHandlers")
+	post := Post(nil, nil, nil)
+	utils.FatalError(post.execute(p, context.Background(), SUCCESS, nil), t)
+	utils.FatalError(post.execute(p, context.Background(), FAILURE, nil), t)
+}
+
+func TestPostConditions(t *testing.T) {
+	p := _test_getPipeline("TestPostConditions")
+	called := []string{}
+	handler := func(name string) func(p *Pipeline, ctx context.Context) error {
+		return func(p *Pipeline, ctx context.Context) error {
+			called = append(called, name)
+			return nil
+		}
+	}
+	post := Post(handler("success"), handler("failure"), handler("always")).
+		OnUnstable(handler("unstable")).
+		OnAborted(handler("aborted")).
+		OnFixed(handler("fixed")).
+		OnRegression(handler("regression"))
+
+	previous := FAILURE
+	utils.FatalError(post.execute(p, context.Background(), SUCCESS, &previous), t)
+	utils.FatalExpectedActual("success,fixed,always", strings.Join(called, ","), t)
+
+	called = []string{}
+	previous = SUCCESS
+	utils.FatalError(post.execute(p, context.Background(), UNSTABLE, &previous), t)
+	utils.FatalExpectedActual("unstable,regression,always", strings.Join(called, ","), t)
+
+	called = []string{}
+	utils.FatalError(post.execute(p, context.Background(), ABORTED, &previous), t)
+	utils.FatalExpectedActual("aborted,always", strings.Join(called, ","), t)
+
+	called = []string{}
+	utils.FatalError(post.execute(p, context.Background(), FAILURE, nil), t)
+	utils.FatalExpectedActual("failure,always", strings.Join(called, ","), t)
+}
+
+func TestPostFromHistory(t *testing.T) {
+	shouldFail := true
+	fixed := 0
+	stageFixed := 0
+	state := _test_getState()
+	p := setPipelineWithState("test_post_history",
+		Agent("test"),
+		state,
+		Stages("stages",
+			Stage("flaky",
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					if shouldFail {
+						return errors.New("test")
+					}
+					return nil
+				}),
+			).Post(Post(nil, nil, nil).OnFixed(func(p *Pipeline, ctx context.Context) error {
+				stageFixed++
+				return nil
+			})),
+		),
+		Post(nil, nil, nil).OnFixed(func(p *Pipeline, ctx context.Context) error {
+			fixed++
+			return nil
+		}),
+	)
+
+	clone := p.Clone()
+	utils.FatalError(clone.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual(FAILURE, clone.Status, t)
+	utils.FatalExpectedActual(0, fixed, t)
+
+	shouldFail = false
+	clone = p.Clone()
+	utils.FatalError(clone.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual(SUCCESS, clone.Status, t)
+	utils.FatalExpectedActual(1, fixed, t)
+	utils.FatalExpectedActual(1, stageFixed, t)
+
+	record := GetStore().LastRun(p.Name, clone.EndTime)
+	utils.FatalExpectedActual(SUCCESS, record.Stages["flaky"], t)
+}
@@ -0,0 +1,249 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+const (
+	PRESERVED_METADATA  = "preserved.json" // Description of the preserved run, at the root of its directory
+	PRESERVED_WORKSPACE = "workspace"      // Directory of the workspace of the pipeline in the one of the run
+	PRESERVED_STAGES    = "stages"         // Directory of the workspaces of the stages with their own agent
+)
+
+// Serializes the changes to the preserved directory, so
+// retention and purges don't remove a run being written
+var preservedMu sync.Mutex
+
+// RetentionPolicy tells which workspaces are kept after a run instead
+// of being removed, and for how long.
+//
+// The zero value keeps the workspaces of the failed runs forever
+type RetentionPolicy struct {
+	Always bool          `json:"always"` // Keeps the workspaces of every run, not only the failed ones
+	Last   int           `json:"last"`   // Number of preserved runs kept for the pipeline. 0 keeps them all
+	For    time.Duration `json:"for"`    // Time the preserved runs are kept. 0 keeps them forever
+}
+
+// keeps tells if a workspace that ended with the status should be preserved
+func (r *RetentionPolicy) keeps(status ERunStatus) bool {
+	return r != nil && (r.Always || status.Failed())
+}
+
+// PreservedRun describes the workspaces kept after a run
+type PreservedRun struct {
+	Pipeline string     `json:"pipeline"`
+	Id       string     `json:"id"`               // Id of the run
+	Status   ERunStatus `json:"status"`           // Status the run ended with
+	Agent    string     `json:"agent"`            // Agent that executed the run
+	Time     time.Time  `json:"time"`             // Time the run ended
+	Path     string     `json:"path"`             // Directory containing the workspaces of the run
+	Stages   []string   `json:"stages,omitempty"` // Stages with their own agent whose workspace got kept
+}
+
+// KeepWorkspaces moves the workspaces of the runs in the preserved
+// directory instead of removing them, following the policy
+func (p *Pipeline) KeepWorkspaces(policy RetentionPolicy) {
+	p.Retention = &policy
+}
+
+// preservedPath gives back the directory of the run in the preserved directory
+func (p *Pipeline) preservedPath() string {
+	return filepath.Join(p.globalState.PreservedDirectory(), p.Name, p.Id.String())
+}
+
+// releaseExecutor cleans up the workspace of the executor and frees it.
+//
+// If the retention policy keeps workspaces ending with the status, it
+// gets moved to the directory name of the preserved run beforehand
+func (p *Pipeline) releaseExecutor(executor *config.Executor, workspace, name string, status ERunStatus, diag *Diagnostic) error {
+	persistent := workspace != "" && name == PRESERVED_WORKSPACE && p.persistent != nil && executor.Remote == nil
+	if workspace != "" && p.Retention.keeps(status) {
+		p.preserveWorkspace(executor.Agent, workspace, name, persistent, diag)
+	}
+	if persistent {
+		if err := p.saveWorkspace(workspace); err != nil {
+			diag.LogEvent(ERROR, fmt.Sprintf("Workspace could not be kept for the next run because of error %v", err))
+		}
+	}
+	return executor.CleanUp()
+}
+
+// preserveWorkspace moves the workspace of the agent to the
+// directory name of the preserved run, or copies it if it is still needed
+func (p *Pipeline) preserveWorkspace(agent *config.Agent, workspace, name string, duplicate bool, diag *Diagnostic) error {
+	dst := filepath.Join(p.preservedPath(), name)
+	err := preserve(agent, workspace, dst, duplicate)
+	if err != nil {
+		diag.LogEvent(ERROR, fmt.Sprintf("Workspace %s could not be preserved because of error %v", workspace, err))
+		return err
+	}
+	diag.LogEvent(INFO, fmt.Sprintf("Workspace preserved in %s", dst))
+	p.Lock()
+	p.PreservedWorkspace = p.preservedPath()
+	if name != PRESERVED_WORKSPACE {
+		p.preservedStages = append(p.preservedStages, filepath.Base(name))
+	}
+	p.Unlock()
+	return nil
+}
+
+// preserve moves the workspace of the agent to dst, or copies it
+func preserve(agent *config.Agent, workspace, dst string, duplicate bool) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if agent.Remote != nil {
+		return fromAgent(agent, workspace, dst)
+	}
+	if duplicate {
+		return utils.CopyDir(workspace, dst)
+	}
+	// Renaming fails across filesystems, the workspace
+	// gets copied there instead
+	if err := os.Rename(workspace, dst); err != nil {
+		os.RemoveAll(dst)
+		return utils.CopyDir(workspace, dst)
+	}
+	return nil
+}
+
+// savePreserved writes the description of the preserved run, then
+// removes the runs of the pipeline the retention policy doesn't keep anymore
+func (p *Pipeline) savePreserved() error {
+	p.Lock()
+	run := PreservedRun{
+		Pipeline: p.Name,
+		Id:       p.Id.String(),
+		Status:   p.Status,
+		Time:     p.EndTime,
+		Path:     p.PreservedWorkspace,
+		Stages:   slices.Clone(p.preservedStages),
+	}
+	p.Unlock()
+	if p.Agent != nil {
+		run.Agent = p.Agent.Identifier
+	}
+	bytes, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	preservedMu.Lock()
+	defer preservedMu.Unlock()
+	err = os.WriteFile(filepath.Join(run.Path, PRESERVED_METADATA), bytes, 0644)
+	if err != nil {
+		return err
+	}
+	return applyRetention(p.globalState.PreservedDirectory(), p.Name, p.Retention, p.EndTime)
+}
+
+// ApplyRetention removes the preserved runs of the pipeline its retention
+// policy doesn't keep anymore at the given time. It already happens when a
+// run gets preserved, the server also calls it at startup and periodically
+// so the runs of pipelines not running anymore get removed too
+func (p *Pipeline) ApplyRetention(now time.Time) error {
+	preservedMu.Lock()
+	defer preservedMu.Unlock()
+	return applyRetention(p.globalState.PreservedDirectory(), p.Name, p.Retention, now)
+}
+
+// applyRetention removes the preserved runs of the pipeline that are
+// too old, or past the number of runs to keep
+//
+// MUST BE CALLED WITH preservedMu
+func applyRetention(dir, pipeline string, policy *RetentionPolicy, now time.Time) error {
+	if policy == nil || (policy.Last <= 0 && policy.For <= 0) {
+		return nil
+	}
+	runs, err := listPreserved(dir, pipeline)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, run := range runs {
+		tooMany := policy.Last > 0 && i >= policy.Last
+		tooOld := policy.For > 0 && now.Sub(run.Time) > policy.For
+		if tooMany || tooOld {
+			errs = append(errs, os.RemoveAll(run.Path))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ListPreserved gives back the preserved runs of the pipeline, the most
+// recent first. An empty name gives back the runs of every pipeline
+func ListPreserved(dir, pipeline string) ([]PreservedRun, error) {
+	preservedMu.Lock()
+	defer preservedMu.Unlock()
+	return listPreserved(dir, pipeline)
+}
+
+func listPreserved(dir, pipeline string) ([]PreservedRun, error) {
+	if pipeline != "" && (filepath.Base(pipeline) != pipeline || pipeline == "..") {
+		return nil, fmt.Errorf("Invalid pipeline name %s", pipeline)
+	}
+	pattern := filepath.Join(dir, "*", "*", PRESERVED_METADATA)
+	if pipeline != "" {
+		pattern = filepath.Join(dir, pipeline, "*", PRESERVED_METADATA)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	runs := []PreservedRun{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var run PreservedRun
+		if err = json.Unmarshal(content, &run); err != nil {
+			return nil, fmt.Errorf("Preserved run %s is not valid : %v", file, err)
+		}
+		// The directory may have been moved since the run
+		run.Path = filepath.Dir(file)
+		runs = append(runs, run)
+	}
+	slices.SortStableFunc(runs, func(a, b PreservedRun) int {
+		return b.Time.Compare(a.Time)
+	})
+	return runs, nil
+}
+
+// PurgePreserved removes the preserved runs of the pipeline. If id is not
+// empty, only the run with this id is removed. An empty name removes
+// the runs of every pipeline.
+//
+// Gives back the runs that got removed
+func PurgePreserved(dir, pipeline, id string) ([]PreservedRun, error) {
+	preservedMu.Lock()
+	defer preservedMu.Unlock()
+	runs, err := listPreserved(dir, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	purged := []PreservedRun{}
+	for _, run := range runs {
+		if id != "" && run.Id != id {
+			continue
+		}
+		if err := os.RemoveAll(run.Path); err != nil {
+			return purged, err
+		}
+		purged = append(purged, run)
+	}
+	if id != "" && len(purged) == 0 {
+		return purged, fmt.Errorf("No preserved run with id %s", id)
+	}
+	return purged, nil
+}
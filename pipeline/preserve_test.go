@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func _test_preserveState(t *testing.T) *config.GlobalStateProvider {
+	dir := t.TempDir()
+	return config.GetStateCustomConf(&config.Config{
+		AgentDir:             filepath.Join(dir, "agent"),
+		PipelineDir:          filepath.Join(dir, "pipeline"),
+		JerminalResourcePath: "../resources/jerminal.json",
+		AgentResourcePath:    "../resources/agents.json",
+	})
+}
+
+func _test_preservedPipeline(state *config.GlobalStateProvider, fail bool) *Pipeline {
+	p := setPipelineWithState("test_preserve", Agent("test_preserve"), state,
+		Stages("stages",
+			Stage("write",
+				SH("sh", "-c", "echo hello > file"),
+			),
+			Stage("stage_agent",
+				SH("touch", "stage_file"),
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					if fail {
+						return errors.New("failure")
+					}
+					return nil
+				}),
+			).OnAgent(Agent("test_preserve_stage")),
+		),
+	)
+	p.KeepWorkspaces(RetentionPolicy{Last: 2})
+	return p
+}
+
+func TestPreservedWorkspace(t *testing.T) {
+	state := _test_preserveState(t)
+	dir := state.PreservedDirectory()
+
+	// Successful runs are not kept
+	p := _test_preservedPipeline(state, false)
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual("", p.PreservedWorkspace, t)
+
+	p = _test_preservedPipeline(state, true)
+	p.ExecutePipeline(context.Background())
+	utils.FatalExpectedActual(FAILURE, p.GetStatus(), t)
+	utils.FatalExpectedActual(filepath.Join(dir, "test_preserve", p.Id.String()), p.PreservedWorkspace, t)
+	content, err := os.ReadFile(filepath.Join(p.PreservedWorkspace, PRESERVED_WORKSPACE, "file"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("hello\n", string(content), t)
+	_, err = os.Stat(filepath.Join(p.PreservedWorkspace, PRESERVED_STAGES, "stage_agent", "stage_file"))
+	utils.FatalError(err, t)
+
+	// The agents got their workspace removed and were released
+	_, err = os.Stat(filepath.Join(state.AgentDir, "test_preserve"))
+	utils.FatalNoError(err, "workspace of the agent should have been moved", t)
+	utils.FatalExpectedActual(true, state.GetAgent("test_preserve").TryAcquire() != nil, t)
+
+	runs, err := ListPreserved(dir, "test_preserve")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(1, len(runs), t)
+	utils.FatalExpectedActual(p.Id.String(), runs[0].Id, t)
+	utils.FatalExpectedActual(FAILURE, runs[0].Status, t)
+	utils.FatalExpectedActual("test_preserve", runs[0].Agent, t)
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	state := _test_preserveState(t)
+	dir := state.PreservedDirectory()
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		p := _test_preservedPipeline(state, true)
+		p.ExecutePipeline(context.Background())
+		ids = append(ids, p.Id.String())
+	}
+
+	// Only the last two runs are kept, the most recent first
+	runs, err := ListPreserved(dir, "")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(2, len(runs), t)
+	utils.FatalExpectedActual(ids[2], runs[0].Id, t)
+	utils.FatalExpectedActual(ids[1], runs[1].Id, t)
+
+	// Runs older than the duration get removed, without a new run
+	p := _test_preservedPipeline(state, true)
+	p.KeepWorkspaces(RetentionPolicy{For: time.Hour})
+	utils.FatalError(p.ApplyRetention(time.Now().Add(30*time.Minute)), t)
+	runs, err = ListPreserved(dir, "test_preserve")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(2, len(runs), t)
+	utils.FatalError(p.ApplyRetention(time.Now().Add(2*time.Hour)), t)
+	runs, err = ListPreserved(dir, "test_preserve")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(0, len(runs), t)
+}
+
+func TestPurgePreserved(t *testing.T) {
+	state := _test_preserveState(t)
+	dir := state.PreservedDirectory()
+	first := _test_preservedPipeline(state, true)
+	first.ExecutePipeline(context.Background())
+	second := _test_preservedPipeline(state, true)
+	second.ExecutePipeline(context.Background())
+
+	purged, err := PurgePreserved(dir, "test_preserve", first.Id.String())
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(1, len(purged), t)
+	_, err = os.Stat(first.PreservedWorkspace)
+	utils.FatalNoError(err, "purged run should have been removed", t)
+
+	_, err = PurgePreserved(dir, "test_preserve", first.Id.String())
+	utils.FatalNoError(err, "purging an unknown run should give back an error", t)
+	_, err = ListPreserved(dir, "../test_preserve")
+	utils.FatalNoError(err, "pipeline names should not escape the preserved directory", t)
+
+	purged, err = PurgePreserved(dir, "", "")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(1, len(purged), t)
+}
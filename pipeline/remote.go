@@ -0,0 +1,142 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+// remoteOf gives back the connection to the agent the executable
+// runs on, or nil if the agent runs in the server process
+func (p *Pipeline) remoteOf(ctx context.Context) config.Remote {
+	if agent := p.CurrentAgent(ctx); agent != nil {
+		return agent.Remote
+	}
+	return nil
+}
+
+// execRemote executes a command in the current directory
+// of an agent running on another machine
+func (p *Pipeline) execRemote(ctx context.Context, remote config.Remote, name string, args ...string) ([]byte, error) {
+	res, err := remote.Exec(ctx, config.ExecRequest{
+		Workspace: p.Workspace(ctx),
+		Dir:       p.WorkingDirectory(ctx),
+		Name:      name,
+		Args:      args,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Warning != "" {
+		p.StageDiagnostic(ctx).LogEvent(WARN, res.Warning)
+	}
+	if res.Error == "" {
+		return res.Output, nil
+	}
+	err = errors.New(res.Error)
+	switch res.Limit {
+	case "":
+		return res.Output, err
+	case LIMIT_WALL_TIME:
+		err = fmt.Errorf("%w : %s", context.DeadlineExceeded, res.Error)
+	}
+	return res.Output, &LimitError{Limit: res.Limit, Err: err}
+}
+
+// seedWorkspace puts the cache of the pipeline in the workspace
+// of the agent, logging the time it took
+func (p *Pipeline) seedWorkspace(agent *config.Agent, workspace string, diag *Diagnostic) error {
+	if agent.Remote != nil {
+		start := time.Now()
+		err := toAgent(agent, p.pipelineDir, workspace)
+		if err == nil {
+			diag.LogEvent(DEBUG, fmt.Sprintf("Workspace provisioned in %d ms (sent to the remote agent)", time.Since(start).Milliseconds()))
+		}
+		return err
+	}
+	methods := []utils.ProvisionMethod{}
+	if p.Config != nil {
+		for _, method := range p.Config.Provisioning {
+			methods = append(methods, utils.ProvisionMethod(method))
+		}
+	}
+	stats, err := utils.Provision(p.pipelineDir, workspace, methods...)
+	if err == nil {
+		diag.LogEvent(DEBUG, fmt.Sprintf("Workspace provisioned in %s", stats))
+	}
+	return err
+}
+
+// seedStage puts the cache of the pipeline, if there is one, in the
+// workspace of a stage running on its own agent
+func (p *Pipeline) seedStage(agent *config.Agent, workspace string, diag *Diagnostic) error {
+	// The run may already hold the lock if its RunOnce didn't get executed yet
+	if p.cacheUnlock == nil {
+		mu := p.cacheMutex()
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	if _, err := os.Stat(p.pipelineDir); err != nil {
+		return nil
+	}
+	return p.seedWorkspace(agent, workspace, diag)
+}
+
+// toAgent copies a file or the content of a directory of the
+// server in the directory dst of the agent
+func toAgent(agent *config.Agent, src, dst string) error {
+	archive, err := utils.Tar(src)
+	if err != nil {
+		return err
+	}
+	if agent.Remote == nil {
+		return utils.Untar(archive, dst)
+	}
+	return agent.Remote.PutFiles(dst, archive)
+}
+
+// fromAgent copies a file or the content of a directory of
+// the agent in the directory dst of the server
+func fromAgent(agent *config.Agent, src, dst string) error {
+	var archive []byte
+	var err error
+	if agent.Remote == nil {
+		archive, err = utils.Tar(src)
+	} else {
+		archive, err = agent.Remote.GetFiles(src)
+	}
+	if err != nil {
+		return err
+	}
+	return utils.Untar(archive, dst)
+}
+
+// Upload copies a file or the content of a directory of the server
+// in a directory of the agent, relative to the current directory
+func Upload(src, dst string) Step {
+	return Describe(Exec(func(p *Pipeline, ctx context.Context) error {
+		return toAgent(p.CurrentAgent(ctx), src, p.agentPath(ctx, dst))
+	}), "upload", "Copies files of the server to the agent", map[string]string{"src": src, "dst": dst})
+}
+
+// Download copies a file or the content of a directory of the agent,
+// relative to the current directory, in a directory of the server
+func Download(src, dst string) Step {
+	return Describe(Exec(func(p *Pipeline, ctx context.Context) error {
+		return fromAgent(p.CurrentAgent(ctx), p.agentPath(ctx, src), dst)
+	}), "download", "Copies files of the agent to the server", map[string]string{"src": src, "dst": dst})
+}
+
+// agentPath resolves a path of the agent relative to the current directory
+func (p *Pipeline) agentPath(ctx context.Context, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(p.WorkingDirectory(ctx), path)
+}
@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+// fakeRemote executes the work of a remote agent in a local
+// directory, recording the commands it got
+type fakeRemote struct {
+	dir      string
+	commands []string
+}
+
+func (f *fakeRemote) Prepare(identifier string) (string, error) {
+	path := filepath.Join(f.dir, identifier)
+	return path, os.Mkdir(path, os.ModePerm)
+}
+
+func (f *fakeRemote) CleanUp(identifier string) error {
+	return os.RemoveAll(filepath.Join(f.dir, identifier))
+}
+
+func (f *fakeRemote) Exec(ctx context.Context, req config.ExecRequest) (*config.ExecResult, error) {
+	f.commands = append(f.commands, req.Name)
+	out, warning, err := RunCommand(ctx, nil, req.Workspace, req.Dir, req.Name, req.Args...)
+	res := &config.ExecResult{Output: out, Warning: warning}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res, nil
+}
+
+func (f *fakeRemote) IsDir(path string) (bool, error) {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir(), nil
+}
+
+func (f *fakeRemote) PutFiles(dir string, archive []byte) error {
+	return utils.Untar(archive, dir)
+}
+
+func (f *fakeRemote) GetFiles(path string) ([]byte, error) {
+	return utils.Tar(path)
+}
+
+func TestRemoteAgentPipeline(t *testing.T) {
+	state := _test_getState()
+	remote := &fakeRemote{dir: t.TempDir()}
+	err := state.AddAgent(&config.Agent{Identifier: "test_remote", Remote: remote})
+	utils.FatalError(err, t)
+	defer state.RemoveAgent(state.GetAgent("test_remote"))
+
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "input"), []byte("hello"), 0644)
+	dst := t.TempDir()
+
+	p := setPipelineWithState("test_remote_pipeline",
+		Agent("test_remote"),
+		state,
+		Stages("stages",
+			Stage("remote",
+				SH("mkdir", "sub"),
+				CD("sub"),
+				Upload(src, "."),
+				SH("sh", "-c", "cat input > output"),
+				Download("output", dst),
+			),
+			Stage("background",
+				SHBackground("true"),
+			).DontStopIfErr(),
+		),
+	)
+	err = p.ExecutePipeline(context.Background())
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(UNSTABLE, p.GetStatus(), t)
+
+	content, err := os.ReadFile(filepath.Join(dst, "output"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("hello", string(content), t)
+	utils.FatalExpectedActual(2, len(remote.commands), t)
+
+	// Workspace got removed on the machine of the agent
+	_, err = os.Stat(filepath.Join(remote.dir, "test_remote"))
+	utils.FatalNoError(err, "workspace of the remote agent should have been removed", t)
+}
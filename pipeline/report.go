@@ -44,8 +44,12 @@ func (r *Report) Report(p *Pipeline) error {
 
 			clone.Diagnostic = clone.Diagnostic.FilterBasedOnImportance(r.LogLevel)
 			filePath := filepath.Join(dirPath, fileName)
+			// The record lets the history be loaded again after a restart
 			fileContent, err := json.MarshalIndent(
-				clone,
+				struct {
+					Pipeline
+					Record *RunRecord `json:"record"`
+				}{clone, p.record()},
 				"",
 				"  ",
 			)
@@ -0,0 +1,151 @@
+//go:build linux
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Cyber-cicco/jerminal/config"
+)
+
+// sandboxScript runs as PID 1 of the new namespaces. It makes the
+// workspace and the writable paths their own mounts, remounts every
+// other mount read-only, gives a fresh /tmp unless it would hide a
+// writable path, then executes the command without any capability,
+// so it can't remount anything. The working directory is entered
+// again so it points to the new mounts. Any failure aborts the command.
+//
+// Arguments : setpriv, number of writable paths, writable paths,
+// number of mounts, mount points and their options, command
+const sandboxScript = `set -e
+mount --make-rprivate /
+setpriv=$1; shift
+n=$1; shift
+writable=""
+while [ "$n" -gt 0 ]; do
+	mount --rbind "$1" "$1"
+	writable="$writable|$1|"
+	shift; n=$((n-1))
+done
+n=$1; shift
+while [ "$n" -gt 0 ]; do
+	case "$writable" in
+		*"|$1|"*) ;;
+		*) mount -o "remount,bind,ro$2" "$1" ;;
+	esac
+	shift 2; n=$((n-1))
+done
+mount -t proc proc /proc
+case "$writable" in
+	*"|/tmp|"* | *"|/tmp/"*) ;;
+	*) mount -t tmpfs tmpfs /tmp ;;
+esac
+cd "$(pwd)"
+exec "$setpriv" --no-new-privs --inh-caps=-all --ambient-caps=-all --bounding-set=-all -- "$@"`
+
+// Flags kept when a mount gets remounted read-only. The ones locked by the
+// user namespace can't be removed, so they have to be given again
+var remountFlags = []string{"nosuid", "nodev", "noexec", "noatime", "nodiratime", "relatime", "strictatime"}
+
+// mounts gives back the mount points of the process and the flags
+// they should be remounted with, the last mount of a path being the visible one
+func mounts() ([][2]string, error) {
+	content, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	indexes := map[string]int{}
+	points := [][2]string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		point := unescapeMountinfo(fields[4])
+		flags := ""
+		for _, flag := range strings.Split(fields[5], ",") {
+			if slices.Contains(remountFlags, flag) {
+				flags += "," + flag
+			}
+		}
+		if i, ok := indexes[point]; ok {
+			points[i][1] = flags
+			continue
+		}
+		indexes[point] = len(points)
+		points = append(points, [2]string{point, flags})
+	}
+	return points, nil
+}
+
+// unescapeMountinfo decodes the octal escapes of the
+// spaces, tabs, newlines and backslashes of mountinfo
+func unescapeMountinfo(field string) string {
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// sandbox makes the command run in new mount, PID and network namespaces,
+// with only the workspace and the writable paths of the config writable
+func sandbox(cmd *exec.Cmd, sb *config.Sandbox, workspace string) error {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return err
+	}
+	setpriv, err := exec.LookPath("setpriv")
+	if err != nil {
+		return fmt.Errorf("Sandboxed agents need setpriv to drop the capabilities of the commands : %w", err)
+	}
+	points, err := mounts()
+	if err != nil {
+		return err
+	}
+	target := cmd.Path
+	if cmd.Err != nil || target == "" {
+		target = cmd.Args[0]
+	}
+
+	writable := append([]string{workspace}, sb.WritablePaths...)
+	args := []string{"sh", "-c", sandboxScript, "jerminal-sandbox", setpriv, strconv.Itoa(len(writable))}
+	args = append(args, writable...)
+	args = append(args, strconv.Itoa(len(points)))
+	for _, point := range points {
+		args = append(args, point[0], point[1])
+	}
+	args = append(args, target)
+	cmd.Path = sh
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Err = nil
+
+	flags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID)
+	if !sb.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	attr := &syscall.SysProcAttr{Cloneflags: flags}
+
+	// Unprivileged users need their own user namespace to mount things
+	if uid := os.Getuid(); uid != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+	}
+	cmd.SysProcAttr = attr
+	return nil
+}
@@ -0,0 +1,92 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func _test_sandboxedPipeline(t *testing.T, sb *config.Sandbox) *Pipeline {
+	p := _test_getPipeline("TestSandbox")
+	p.Agent.Sandbox = sb
+	p.Diagnostic = NewDiag("test")
+	p.mainDirectory = t.TempDir()
+	p.directory = p.mainDirectory
+	err := Stage("probe", SH("true")).ExecuteStage(p, context.Background())
+	if err != nil {
+		t.Skipf("namespaces are not available : %v", err)
+	}
+	return p
+}
+
+func _test_sandboxedSH(p *Pipeline, script string) (string, error) {
+	err := Stage("sandboxed", SH("sh", "-c", script)).ExecuteStage(p, context.Background())
+	out, _ := GetAs[string](p.Outputs("sandboxed"), CmdOutKey)
+	return out, err
+}
+
+func TestSandboxFilesystem(t *testing.T) {
+	outside := t.TempDir()
+	writable := t.TempDir()
+	p := _test_sandboxedPipeline(t, &config.Sandbox{WritablePaths: []string{writable}})
+
+	_, err := _test_sandboxedSH(p, "echo ok > file")
+	utils.FatalError(err, t)
+	content, err := os.ReadFile(filepath.Join(p.mainDirectory, "file"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("ok\n", string(content), t)
+
+	_, err = _test_sandboxedSH(p, "echo ok > "+filepath.Join(writable, "file"))
+	utils.FatalError(err, t)
+
+	_, err = _test_sandboxedSH(p, "echo ko > "+filepath.Join(outside, "file"))
+	utils.FatalNoError(err, "writing outside of the workspace should fail", t)
+	_, err = os.Stat(filepath.Join(outside, "file"))
+	utils.FatalNoError(err, "file outside of the workspace should not exist", t)
+}
+
+func TestSandboxNamespaces(t *testing.T) {
+	p := _test_sandboxedPipeline(t, &config.Sandbox{})
+
+	out, err := _test_sandboxedSH(p, "echo $$")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("1", strings.TrimSpace(out), t)
+
+	// Only the loopback interface exists in a new network namespace
+	out, err = _test_sandboxedSH(p, "tail -n +3 /proc/net/dev | wc -l")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("1", strings.TrimSpace(out), t)
+
+	p.Agent.Sandbox.Network = true
+	out, err = _test_sandboxedSH(p, "tail -n +3 /proc/net/dev | wc -l")
+	utils.FatalError(err, t)
+	if strings.TrimSpace(out) == "1" {
+		t.Log("host only has a loopback interface, could not check network access")
+	}
+}
+
+func TestSandboxCapabilities(t *testing.T) {
+	outside := t.TempDir()
+	p := _test_sandboxedPipeline(t, &config.Sandbox{})
+
+	// Mounts can't be made writable again from inside
+	_, err := _test_sandboxedSH(p, "mount -o remount,rw,bind / || mount -o remount,rw,bind "+outside+"; echo ko > "+filepath.Join(outside, "file"))
+	utils.FatalNoError(err, "remounting should not give access outside of the workspace", t)
+	_, err = os.Stat(filepath.Join(outside, "file"))
+	utils.FatalNoError(err, "file outside of the workspace should not exist", t)
+
+	out, err := _test_sandboxedSH(p, "grep CapEff /proc/self/status")
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("CapEff:\t0000000000000000", strings.TrimSpace(out), t)
+}
+
+func TestUnescapeMountinfo(t *testing.T) {
+	utils.FatalExpectedActual("/mnt/with space", unescapeMountinfo(`/mnt/with\040space`), t)
+	utils.FatalExpectedActual("/mnt/back\\slash\ttab", unescapeMountinfo(`/mnt/back\134slash\011tab`), t)
+	utils.FatalExpectedActual(`/mnt/end\04`, unescapeMountinfo(`/mnt/end\04`), t)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package pipeline
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/Cyber-cicco/jerminal/config"
+)
+
+// sandbox is only supported on Linux, where namespaces exist
+func sandbox(cmd *exec.Cmd, sb *config.Sandbox, workspace string) error {
+	return errors.New("Sandboxed agents are only supported on Linux")
+}
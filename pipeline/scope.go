@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Cyber-cicco/jerminal/config"
+)
+
+type scopeKey struct{}
+
+type parallelKey struct{}
+
+// stageScope holds what belongs to the stage being executed.
+//
+// It travels in the context given to the executables, so stages
+// running in parallel don't step on each other
+type stageScope struct {
+	sync.Mutex
+	name          string           // Name of the stage
+	diag          *Diagnostic      // Diagnostic of the stage
+	unstable      bool             // true if an executable marked the stage as unstable
+	agent         *config.Executor // Executor of the stage if it does not run on the one of the pipeline
+	mainDirectory string           // Workspace of the agent of the stage
+	directory     string           // Working directory in the workspace of the agent of the stage
+}
+
+// withStage gives back a context carrying the scope of the stage
+func withStage(ctx context.Context, scope *stageScope) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope)
+}
+
+// stageFrom gives back the scope of the stage being executed,
+// or nil if the context does not come from a stage
+func stageFrom(ctx context.Context) *stageScope {
+	scope, _ := ctx.Value(scopeKey{}).(*stageScope)
+	return scope
+}
+
+// inParallel tells if the executable runs in a stage executed
+// at the same time as other ones
+func inParallel(ctx context.Context) bool {
+	parallel, _ := ctx.Value(parallelKey{}).(bool)
+	return parallel
+}
+
+// StageDiagnostic gives back the diagnostic of the stage being executed.
+// If the executable does not run in a stage, gives back the current
+// diagnostic of the pipeline
+func (p *Pipeline) StageDiagnostic(ctx context.Context) *Diagnostic {
+	if scope := stageFrom(ctx); scope != nil {
+		return scope.diag
+	}
+	return p.Diagnostic
+}
+
+// MarkUnstable marks the stage being executed and the pipeline as UNSTABLE,
+// without stopping the execution
+func (p *Pipeline) MarkUnstable(ctx context.Context, reason string) {
+	if scope := stageFrom(ctx); scope != nil {
+		scope.Lock()
+		scope.unstable = true
+		scope.Unlock()
+	}
+	p.StageDiagnostic(ctx).LogEvent(WARN, fmt.Sprintf("Marked as unstable : %s", reason))
+	p.MarkStatus(UNSTABLE)
+}
+
+// isUnstable tells if an executable marked the stage as unstable
+func (s *stageScope) isUnstable() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.unstable
+}
+
+// ownAgent gives back the scope of the stage being executed if
+// it runs on its own agent, nil otherwise
+func ownAgent(ctx context.Context) *stageScope {
+	if scope := stageFrom(ctx); scope != nil && scope.agent != nil {
+		return scope
+	}
+	return nil
+}
+
+// CurrentAgent gives back the agent the executable runs on
+func (p *Pipeline) CurrentAgent(ctx context.Context) *config.Agent {
+	if scope := ownAgent(ctx); scope != nil {
+		return scope.agent.Agent
+	}
+	if p.Agent == nil {
+		return nil
+	}
+	return p.Agent.Agent
+}
+
+// WorkingDirectory gives back the directory the executable runs in
+func (p *Pipeline) WorkingDirectory(ctx context.Context) string {
+	if scope := ownAgent(ctx); scope != nil {
+		scope.Lock()
+		defer scope.Unlock()
+		return scope.directory
+	}
+	return p.directory
+}
+
+// Workspace gives back the directory of the agent the executable runs on.
+// For an agent running on another machine, it is relative to the directory
+// of the agent on that machine, and can only be used through Run
+func (p *Pipeline) Workspace(ctx context.Context) string {
+	if scope := ownAgent(ctx); scope != nil {
+		return scope.mainDirectory
+	}
+	return p.mainDirectory
+}
+
+// setWorkingDirectory changes the directory the executables
+// of the stage run in
+func (p *Pipeline) setWorkingDirectory(ctx context.Context, dir string) {
+	if scope := ownAgent(ctx); scope != nil {
+		scope.Lock()
+		defer scope.Unlock()
+		scope.directory = dir
+		return
+	}
+	p.directory = dir
+}
@@ -0,0 +1,387 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+// stageCache tells what a stage using CacheOn reads and produces
+type stageCache struct {
+	inputs  []string // Patterns of the files the result of the stage depends on
+	outputs []string // Patterns of the files produced by the stage
+}
+
+// cacheEntry lists the outputs produced by a stage for a key
+type cacheEntry struct {
+	Key     string       `json:"key"`
+	Stage   string       `json:"stage"`
+	Created time.Time    `json:"created"`
+	Files   []cachedFile `json:"files"`
+}
+
+// cachedFile is an output of a stage, stored in the cache
+type cachedFile struct {
+	Path   string      `json:"path"`             // Relative to the working directory, with / as separator
+	Mode   fs.FileMode `json:"mode"`             // Permissions of the file
+	Object string      `json:"object,omitempty"` // Hash of the content of the file. Empty for symlinks
+	Link   string      `json:"link,omitempty"`   // Target of the symlink
+}
+
+// CacheOn skips the stage if it already got executed with the same input
+// files, commands and environment, and restores the output files it produced
+// then. The stage gets the CACHED status instead of being executed.
+//
+// The environment is the one of the server, which the commands inherit, so
+// changing one of its variables makes every stage using CacheOn execute again.
+// A stage running on its own agent doesn't wait for it when it is cached,
+// and doesn't restore the outputs in a workspace that would get removed.
+//
+// Patterns are relative to the working directory and work like the ones of
+// OnChanges. The code of Exec steps can't be compared, so what it depends on
+// should be in the inputs. Only the files are restored, not the outputs of the stage.
+// Not supported by agents running on other machines
+func (s *stage) CacheOn(inputs, outputs []string) *stage {
+	s.cache = &stageCache{
+		inputs:  slices.Clone(inputs),
+		outputs: slices.Clone(outputs),
+	}
+	return s
+}
+
+// lookupCache restores the outputs of the stage if the cache has them.
+//
+// Gives back the key the outputs should be stored under after the execution,
+// or an empty string if they can't be
+func (s *stage) lookupCache(p *Pipeline, ctx context.Context, diag *Diagnostic) (string, bool) {
+	if p.remoteOf(ctx) != nil {
+		diag.LogEvent(WARN, fmt.Sprintf("Stage %s can't be cached on agents running on other machines, executing it", s.name))
+		return "", false
+	}
+	dir := p.WorkingDirectory(ctx)
+	key, err := s.cacheKey(dir)
+	if err != nil {
+		diag.LogEvent(WARN, fmt.Sprintf("Inputs of stage %s could not be read, executing it without cache : %v", s.name, err))
+		return "", false
+	}
+	root := p.globalState.CacheDirectory()
+	entry, err := readCacheEntry(root, key)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			diag.LogEvent(WARN, fmt.Sprintf("Cache of stage %s is unusable, executing it : %v", s.name, err))
+		}
+		diag.LogEvent(DEBUG, fmt.Sprintf("No outputs cached for stage %s under key %s", s.name, key))
+		return key, false
+	}
+	if err := entry.restore(root, dir); err != nil {
+		diag.LogEvent(WARN, fmt.Sprintf("Outputs of stage %s could not be restored from the cache, executing it : %v", s.name, err))
+		return key, false
+	}
+	diag.LogEvent(INFO, fmt.Sprintf("Stage %s restored %d files from the cache instead of being executed", s.name, len(entry.Files)))
+	return key, true
+}
+
+// cachedForAgent tells if a stage running on its own agent has its outputs
+// cached, before it waits for the agent. The workspace of the agent would
+// get the cache of the pipeline, so its files are the inputs.
+//
+// The outputs are not restored, the workspace would be removed with them
+func (s *stage) cachedForAgent(p *Pipeline, diag *Diagnostic) bool {
+	// The run may already hold the lock if its RunOnce didn't get executed yet
+	if p.cacheUnlock == nil {
+		mu := p.cacheMutex()
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	key, err := s.cacheKey(p.pipelineDir)
+	if err != nil {
+		return false
+	}
+	if _, err := readCacheEntry(p.globalState.CacheDirectory(), key); err != nil {
+		return false
+	}
+	diag.LogEvent(INFO, fmt.Sprintf("Stage %s has its outputs cached, it is not executed and does not wait for an agent", s.name))
+	return true
+}
+
+// storeCache stores the outputs of the stage under the key
+func (s *stage) storeCache(p *Pipeline, ctx context.Context, diag *Diagnostic, key string) {
+	dir := p.WorkingDirectory(ctx)
+	root := p.globalState.CacheDirectory()
+	entry := &cacheEntry{Key: key, Stage: s.name, Created: time.Now()}
+	err := func() error {
+		files, err := matchFiles(dir, s.cache.outputs)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			cached, err := storeFile(root, dir, file)
+			if err != nil {
+				return err
+			}
+			entry.Files = append(entry.Files, cached)
+		}
+		return entry.write(root)
+	}()
+	if err != nil {
+		diag.LogEvent(WARN, fmt.Sprintf("Outputs of stage %s could not be cached : %v", s.name, err))
+		return
+	}
+	diag.LogEvent(DEBUG, fmt.Sprintf("%d outputs of stage %s cached under key %s", len(entry.Files), s.name, key))
+}
+
+// cacheKey identifies the definition of the stage, the environment
+// of its commands and the content of its input files
+func (s *stage) cacheKey(dir string) (string, error) {
+	hash := sha256.New()
+	env := os.Environ()
+	slices.Sort(env)
+	definition, err := json.Marshal(struct {
+		Stage StepInfo `json:"stage"`
+		Env   []string `json:"env"`
+	}{s.Info(), env})
+	if err != nil {
+		return "", err
+	}
+	hash.Write(definition)
+
+	files, err := matchFiles(dir, s.cache.inputs)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		infos, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		if infos.Mode()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(hash, "link %s %s\n", file, link)
+			continue
+		}
+		fmt.Fprintf(hash, "file %s %d %o\n", file, infos.Size(), infos.Mode().Perm())
+		if err := copyContent(hash, path); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// matchFiles lists the files of the directory matching one of the patterns,
+// relative to it with / as separator. The directories of git are left out
+func matchFiles(dir string, patterns []string) ([]string, error) {
+	files := []string{}
+	if len(patterns) == 0 {
+		return files, nil
+	}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		// A directory that doesn't exist has no files
+		if path == dir && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range patterns {
+			if matchChange(pattern, rel) {
+				files = append(files, rel)
+				break
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// storeFile puts the content of the file in the objects of the cache
+func storeFile(root, dir, file string) (cachedFile, error) {
+	path := filepath.Join(dir, filepath.FromSlash(file))
+	infos, err := os.Lstat(path)
+	if err != nil {
+		return cachedFile{}, err
+	}
+	cached := cachedFile{Path: file, Mode: infos.Mode().Perm()}
+	if infos.Mode()&fs.ModeSymlink != 0 {
+		cached.Link, err = os.Readlink(path)
+		return cached, err
+	}
+
+	objects := filepath.Join(root, "objects")
+	if err := os.MkdirAll(objects, os.ModePerm); err != nil {
+		return cached, err
+	}
+	// Written next to the objects, so it can be renamed once its hash is known
+	tmp, err := os.CreateTemp(objects, "tmp-*")
+	if err != nil {
+		return cached, err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	err = copyContent(io.MultiWriter(tmp, hash), path)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return cached, err
+	}
+	cached.Object = hex.EncodeToString(hash.Sum(nil))
+
+	object := objectPath(root, cached.Object)
+	if _, err := os.Stat(object); err == nil {
+		return cached, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(object), os.ModePerm); err != nil {
+		return cached, err
+	}
+	return cached, os.Rename(tmp.Name(), object)
+}
+
+// restore puts the outputs of the entry in the directory, replacing
+// the files already there
+func (e *cacheEntry) restore(root, dir string) error {
+	// Checked first, so a damaged entry doesn't leave half of its files
+	links := map[string]bool{}
+	for _, file := range e.Files {
+		if file.Link != "" {
+			links[file.Path] = true
+		}
+	}
+	for _, file := range e.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Path)) {
+			return fmt.Errorf("Cached file %s is outside of the working directory", file.Path)
+		}
+		if _, err := utils.SafeJoin(dir, filepath.FromSlash(file.Path)); err != nil {
+			return fmt.Errorf("Cached file refused : %w", err)
+		}
+		for parent := path.Dir(file.Path); parent != "."; parent = path.Dir(parent) {
+			if links[parent] {
+				return fmt.Errorf("Cached file %s goes through the cached symlink %s", file.Path, parent)
+			}
+		}
+		if file.Link == "" {
+			if _, err := hex.DecodeString(file.Object); err != nil || len(file.Object) != sha256.Size*2 {
+				return fmt.Errorf("Cached file %s has an invalid object %q", file.Path, file.Object)
+			}
+			if _, err := os.Stat(objectPath(root, file.Object)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, file := range e.Files {
+		dst, err := utils.SafeJoin(dir, filepath.FromSlash(file.Path))
+		if err != nil {
+			return fmt.Errorf("Cached file refused : %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+		if file.Link != "" {
+			if err := os.Symlink(file.Link, dst); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := restoreObject(objectPath(root, file.Object), dst, file.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreObject(object, dst string, perm fs.FileMode) error {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	err = copyContent(out, object)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// The umask may have removed some of them
+	return os.Chmod(dst, perm)
+}
+
+// write saves the entry, once all of its objects got stored
+func (e *cacheEntry) write(root string) error {
+	entries := filepath.Join(root, "entries")
+	if err := os.MkdirAll(entries, os.ModePerm); err != nil {
+		return err
+	}
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(entries, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(entries, e.Key+".json"))
+}
+
+func readCacheEntry(root, key string) (*cacheEntry, error) {
+	content, err := os.ReadFile(filepath.Join(root, "entries", key+".json"))
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(content, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// objectPath gives back where the content with the hash is stored
+func objectPath(root, object string) string {
+	return filepath.Join(root, "objects", object[:2], object)
+}
+
+func copyContent(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
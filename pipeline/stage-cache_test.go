@@ -0,0 +1,142 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func TestCacheOn(t *testing.T) {
+	state := _test_preserveState(t)
+	executed := 0
+	run := func(input string) (*Pipeline, string) {
+		restored := ""
+		p := setPipelineWithState("test_cache_on", Agent("test_cache_on"), state,
+			Stages("stages",
+				Stage("input", Exec(func(p *Pipeline, ctx context.Context) error {
+					return os.WriteFile(filepath.Join(p.WorkingDirectory(ctx), "input.txt"), []byte(input), 0644)
+				})),
+				Stage("generate",
+					Exec(func(p *Pipeline, ctx context.Context) error {
+						executed++
+						return nil
+					}),
+					SH("sh", "-c", "mkdir -p out/nested && cp input.txt out/nested/gen.txt && ln -s nested/gen.txt out/link"),
+				).CacheOn([]string{"input.txt"}, []string{"out/"}),
+				Stage("read", Exec(func(p *Pipeline, ctx context.Context) error {
+					content, err := os.ReadFile(filepath.Join(p.WorkingDirectory(ctx), "out", "link"))
+					restored = string(content)
+					return err
+				})),
+			),
+		)
+		utils.FatalError(p.ExecutePipeline(context.Background()), t)
+		utils.FatalExpectedActual(SUCCESS, p.GetStatus(), t)
+		return p, restored
+	}
+
+	p, restored := run("first")
+	utils.FatalExpectedActual(1, executed, t)
+	utils.FatalExpectedActual("first", restored, t)
+	utils.FatalExpectedActual(SUCCESS, p.record().Stages["generate"], t)
+
+	// Same inputs, the outputs come from the cache
+	p, restored = run("first")
+	utils.FatalExpectedActual(1, executed, t)
+	utils.FatalExpectedActual("first", restored, t)
+	utils.FatalExpectedActual(CACHED, p.record().Stages["generate"], t)
+
+	_, restored = run("second")
+	utils.FatalExpectedActual(2, executed, t)
+	utils.FatalExpectedActual("second", restored, t)
+
+	// Stored outputs of both inputs are kept
+	_, restored = run("first")
+	utils.FatalExpectedActual(2, executed, t)
+	utils.FatalExpectedActual("first", restored, t)
+
+	// Missing objects make the stage execute again
+	utils.FatalError(os.RemoveAll(filepath.Join(state.CacheDirectory(), "objects")), t)
+	p, restored = run("first")
+	utils.FatalExpectedActual(3, executed, t)
+	utils.FatalExpectedActual("first", restored, t)
+	utils.FatalExpectedActual(SUCCESS, p.record().Stages["generate"], t)
+}
+
+func TestCacheOnFailure(t *testing.T) {
+	state := _test_preserveState(t)
+	p := setPipelineWithState("test_cache_on_failure", Agent("test_cache_on_failure"), state,
+		Stages("stages",
+			Stage("fail", SH("sh", "-c", "touch out && false")).CacheOn(nil, []string{"out"}),
+		),
+	)
+	utils.FatalError(p.ExecutePipeline(context.Background()), t)
+	utils.FatalExpectedActual(FAILURE, p.GetStatus(), t)
+	_, err := os.Stat(filepath.Join(state.CacheDirectory(), "entries"))
+	utils.FatalExpectedActual(true, os.IsNotExist(err), t)
+}
+
+func TestCacheRestoreThroughSymlink(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	outside := t.TempDir()
+	utils.FatalError(os.WriteFile(filepath.Join(dir, "content"), []byte("cached"), 0644), t)
+	cached, err := storeFile(root, dir, "content")
+	utils.FatalError(err, t)
+
+	// A symlink of the workspace must not be written through
+	utils.FatalError(os.Symlink(outside, filepath.Join(dir, "out")), t)
+	entry := &cacheEntry{Files: []cachedFile{{Path: "out/file", Mode: 0644, Object: cached.Object}}}
+	utils.FatalNoError(entry.restore(root, dir), "restore should refuse the symlink of the workspace", t)
+
+	// Nor one restored by the entry itself
+	entry = &cacheEntry{Files: []cachedFile{
+		{Path: "link", Mode: 0777, Link: outside},
+		{Path: "link/file", Mode: 0644, Object: cached.Object},
+	}}
+	utils.FatalNoError(entry.restore(root, dir), "restore should refuse the symlink of the entry", t)
+
+	entries, err := os.ReadDir(outside)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(0, len(entries), t)
+}
+
+func TestCacheOnAgent(t *testing.T) {
+	state := _test_preserveState(t)
+	executed := 0
+	run := func() *Pipeline {
+		p := setPipelineWithState("test_cache_agent", Agent("test_cache_agent_main"), state,
+			Stages("stages",
+				Stage("generate",
+					Exec(func(p *Pipeline, ctx context.Context) error {
+						executed++
+						return nil
+					}),
+					SH("touch", "out"),
+				).OnAgent(Agent("test_cache_agent")).CacheOn(nil, []string{"out"}),
+			),
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		utils.FatalError(p.ExecutePipeline(ctx), t)
+		utils.FatalExpectedActual(SUCCESS, p.GetStatus(), t)
+		return p
+	}
+
+	run()
+	utils.FatalExpectedActual(1, executed, t)
+
+	// Cached stages don't wait for their agent
+	busy := state.GetAgent("test_cache_agent").TryAcquire()
+	if busy == nil {
+		t.Fatal("agent of the stage should have been released")
+	}
+	defer busy.CleanUp()
+	p := run()
+	utils.FatalExpectedActual(1, executed, t)
+	utils.FatalExpectedActual(CACHED, p.record().Stages["generate"], t)
+}
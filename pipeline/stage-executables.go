@@ -18,14 +18,19 @@ type stage struct {
 	tries             uint16        // Number of times you have to try to execute the stage before accepting failure
 	delay             time.Duration // Delay between the tries
 	executionOrder    uint32        // Execution order in the stages
+	post              *post         // Handlers to execute once the stage ended
+	err               error         // Error found when building the stage
+	agentProvider     AgentProvider // Provides the agent of the stage. Nil if it runs on the agent of the pipeline
+	changes           []string      // Patterns of the files whose changes make the stage execute. Empty if it always does
+	cache             *stageCache   // Files the outputs of the stage get cached on. Nil if it is not cached
 }
 
 // executor represents a task within a stage. It includes a main executable
 // and an optional recovery function to handle errors.
 type executor struct {
-	ex           executable // Main task to execute.
-	recoveryFunc executable // Recovery task to execute in case of failure.
-	deferedFunc  executable // Task to execute at the end of the stage
+	ex           Step // Main task to execute.
+	recoveryFunc Step // Recovery task to execute in case of failure.
+	deferedFunc  Step // Task to execute at the end of the stage
 }
 
 // Exec defines a function type that performs a task within a pipeline.
@@ -36,30 +41,41 @@ func (e Exec) Execute(p *Pipeline, ctx context.Context) error {
 	return e(p, ctx)
 }
 
-// Stage initializes a new stage with the provided executables.
-func Stage(name string, executables ...executable) *stage {
-	executors := make([]*executor, len(executables))
-	for i, ex := range executables {
-		switch ex.(type) {
+// Stage initializes a new stage with the provided steps.
+//
+// Any implementation of Step is accepted. A nil step makes the
+// stage fail, and SetPipeline give back an error
+func Stage(name string, steps ...Step) *stage {
+	s := &stage{
+		name:              name,
+		executors:         make([]*executor, 0, len(steps)),
+		shouldStopIfError: true,
+		tries:             1,
+		delay:             1,
+	}
+	for i, step := range steps {
+		switch ex := step.(type) {
 
 		case *executor:
-			n, _ := ex.(*executor)
-			executors[i] = n
+			if ex != nil {
+				s.executors = append(s.executors, ex)
+				continue
+			}
 
-		case Exec:
-			executors[i] = &executor{
-				ex:           ex,
-				recoveryFunc: nil,
+		default:
+			if !isNil(ex) {
+				s.executors = append(s.executors, &executor{
+					ex:           ex,
+					recoveryFunc: nil,
+				})
+				continue
 			}
 		}
+		if s.err == nil {
+			s.err = fmt.Errorf("Step n°%d of stage %s is nil", i, name)
+		}
 	}
-	return &stage{
-		name:              name,
-		executors:         executors,
-		shouldStopIfError: true,
-		tries:             1,
-		delay:             1,
-	}
+	return s
 }
 
 // ExecuteStage runs the executables in a stage sequentially and records the elapsed time.
@@ -67,7 +83,41 @@ func Stage(name string, executables ...executable) *stage {
 func (s *stage) ExecuteStage(p *Pipeline, ctx context.Context) error {
 	diag := NewDiag(fmt.Sprintf("%s | stage %s", p.Name, s.name))
 	p.Diagnostic.AddChild(diag)
+	scope := &stageScope{name: s.name, diag: diag}
+	ctx = withStage(ctx, scope)
+	if s.err != nil {
+		diag.LogEvent(ERROR, s.err.Error())
+		s.recordStatus(p, scope, s.err)
+		return s.err
+	}
+	if skip, reason := s.skippedByChanges(p); skip {
+		diag.LogEvent(INFO, reason)
+		diag.SetStatus(SKIPPED)
+		p.recordStageStatus(s.name, SKIPPED)
+		return nil
+	}
 	var err error
+	// Waiting for an agent is not worth it if the outputs are cached
+	if s.cache != nil && s.agentProvider != nil && s.cachedForAgent(p, diag) {
+		return s.endCached(p, ctx, scope)
+	}
+	if s.agentProvider != nil {
+		release, agentErr := p.useAgent(ctx, scope, s.agentProvider)
+		if agentErr != nil {
+			diag.LogEvent(ERROR, fmt.Sprintf("Stage %s could not get an agent : %v", s.name, agentErr))
+			s.recordStatus(p, scope, agentErr)
+			return agentErr
+		}
+		defer func() { release(statusFromError(err)) }()
+	}
+	key := ""
+	if s.cache != nil {
+		var hit bool
+		if key, hit = s.lookupCache(p, ctx, diag); hit {
+			err = s.endCached(p, ctx, scope)
+			return err
+		}
+	}
 	var i uint16 = 0
 	for true {
 		err = s.simpleExec(p, diag, ctx)
@@ -79,9 +129,62 @@ func (s *stage) ExecuteStage(p *Pipeline, ctx context.Context) error {
 		}
 		break
 	}
+	// Unstable results are not worth restoring
+	if key != "" && err == nil && !scope.isUnstable() {
+		s.storeCache(p, ctx, diag, key)
+	}
+	if s.post != nil {
+		postErr := s.post.executeFor(p, ctx, diag, s.name, s.statusFor(scope, err))
+		if err == nil {
+			err = postErr
+		}
+	}
+	s.recordStatus(p, scope, err)
 	return err
 }
 
+// statusFor gives back the status of the stage based on the
+// error it ended with
+func (s *stage) statusFor(scope *stageScope, err error) ERunStatus {
+	status := statusFromError(err)
+	if status == FAILURE && !s.shouldStopIfError {
+		return UNSTABLE
+	}
+	if status == SUCCESS && scope.isUnstable() {
+		return UNSTABLE
+	}
+	return status
+}
+
+// recordStatus sets the status of the stage based on the error
+// it ended with. Non blocking failures make the pipeline UNSTABLE
+func (s *stage) recordStatus(p *Pipeline, scope *stageScope, err error) {
+	status := s.statusFor(scope, err)
+	if status == UNSTABLE {
+		p.MarkStatus(UNSTABLE)
+	}
+	if limit := limitOf(err); limit != "" {
+		scope.diag.LogEvent(ERROR, fmt.Sprintf("Stage %s got stopped by the %s limit of the agent", s.name, limit))
+		scope.diag.SetCause(limit)
+	}
+	scope.diag.SetStatus(status)
+	p.recordStageStatus(s.name, status)
+}
+
+// endCached ends a stage whose outputs were found in the cache,
+// executing its post handlers
+func (s *stage) endCached(p *Pipeline, ctx context.Context, scope *stageScope) error {
+	if s.post != nil {
+		if err := s.post.executeFor(p, ctx, scope.diag, s.name, CACHED); err != nil {
+			s.recordStatus(p, scope, err)
+			return err
+		}
+	}
+	scope.diag.SetStatus(CACHED)
+	p.recordStageStatus(s.name, CACHED)
+	return nil
+}
+
 // Runs the executables without caring about the number of tries
 func (s *stage) simpleExec(p *Pipeline, diag *Diagnostic, ctx context.Context) error {
 	var lastErr error
@@ -106,7 +209,7 @@ func (s *stage) simpleExec(p *Pipeline, diag *Diagnostic, ctx context.Context) e
 
 	for i, ex := range s.executors {
 		if ex.ex != nil {
-			diag.LogEvent(DEBUG, fmt.Sprintf("executing task n°%d of stage", i))
+			diag.LogEvent(DEBUG, fmt.Sprintf("executing task n°%d of stage : %s", i, infoOf(ex.ex).Name))
 			err := ex.Execute(p, ctx)
 			if err != nil {
 				diag.LogEvent(ERROR, fmt.Sprintf("Stage %s got error %v in execution n°%d", s.name, err, i))
@@ -135,6 +238,24 @@ func (s *stage) DontStopIfErr() *stage {
 	return s
 }
 
+// Post attaches handlers to execute once the stage ended,
+// depending on its status
+func (s *stage) Post(post *post) *stage {
+	s.post = post
+	return s
+}
+
+// OnAgent makes the stage run on its own agent, in its own workspace
+// initialized with the cache of the pipeline and cleaned up once the
+// stage ended.
+//
+// The provider must not give back the agent of the pipeline, which
+// stays busy during the whole run
+func (s *stage) OnAgent(provider AgentProvider) *stage {
+	s.agentProvider = provider
+	return s
+}
+
 // Retry tells the current stage to retry x times with y seconds delay
 // between each try
 func (s *stage) Retry(retries uint16, delaySeconds time.Duration) *stage {
@@ -153,7 +274,7 @@ func (e *executor) Execute(p *Pipeline, ctx context.Context) error {
 }
 
 // ExecTryCatch wraps an executable with a recovery function to handle errors.
-func ExecTryCatch(ex Exec, recovery executable) executable {
+func ExecTryCatch(ex Exec, recovery Step) Step {
 	return &executor{
 		ex:           ex,
 		recoveryFunc: recovery,
@@ -162,7 +283,7 @@ func ExecTryCatch(ex Exec, recovery executable) executable {
 }
 
 // ExecDefer wraps an executable with a defered function to execute at the end of the stage.
-func ExecDefer(ex Exec, defered executable) executable {
+func ExecDefer(ex Exec, defered Step) Step {
 	return &executor{
 		ex:           ex,
 		recoveryFunc: nil,
@@ -171,7 +292,7 @@ func ExecDefer(ex Exec, defered executable) executable {
 }
 
 // Defer wraps an executable with a defered function to execute at the end of the stage.
-func Defer(defered Exec) executable {
+func Defer(defered Exec) Step {
 	return &executor{
 		ex:           nil,
 		recoveryFunc: nil,
@@ -180,9 +301,9 @@ func Defer(defered Exec) executable {
 }
 
 // Cache copies a directory in the cache
-func Cache(dirname string) executable {
-	return Exec(func(p *Pipeline, ctx context.Context) error {
-		targetPath := filepath.Join(p.directory, dirname)
+func Cache(dirname string) Step {
+	return Describe(Exec(func(p *Pipeline, ctx context.Context) error {
+		targetPath := filepath.Join(p.WorkingDirectory(ctx), dirname)
 		cachePath := filepath.Join(p.pipelineDir, dirname)
 		p.Diagnostic.LogEvent(INFO, fmt.Sprintf("Caching directory %s", targetPath))
 		_, err := os.Stat(targetPath)
@@ -204,5 +325,5 @@ func Cache(dirname string) executable {
 		err = sh.Execute(p, ctx)
 
 		return err
-	})
+	}), "cache", "Copies a directory in the cache of the pipeline", map[string]string{"directory": dirname})
 }
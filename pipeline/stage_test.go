@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/Cyber-cicco/jerminal/utils"
 )
 
 func TestStageExecute1(t *testing.T) {
@@ -183,3 +185,50 @@ func TestCache(t *testing.T) {
         t.Fatalf("Expected no error, got %s", err)
     }
 }
+
+func TestStageOnAgent(t *testing.T) {
+	state := _test_getState()
+	agents := make(chan string, 3)
+	p := setPipelineWithState("test_stage_agent",
+		Agent("test_stage_main"),
+		state,
+		Stages("stages",
+			Stage("light",
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					agents <- p.CurrentAgent(ctx).Identifier
+					return nil
+				}),
+			),
+			Stage("heavy",
+				SH("touch", "file"),
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					agents <- p.CurrentAgent(ctx).Identifier
+					_, err := os.Stat(filepath.Join(p.WorkingDirectory(ctx), "file"))
+					return err
+				}),
+			).OnAgent(Agent("test_stage_heavy")),
+			Stage("other",
+				Exec(func(p *Pipeline, ctx context.Context) error {
+					agents <- p.CurrentAgent(ctx).Identifier
+					return nil
+				}),
+			).OnAgent(Agent("test_stage_other")),
+		).Parallel(),
+	)
+	err := p.ExecutePipeline(context.Background())
+	utils.FatalError(err, t)
+	close(agents)
+	seen := map[string]bool{}
+	for agent := range agents {
+		seen[agent] = true
+	}
+	utils.FatalExpectedActual(3, len(seen), t)
+	if !seen["test_stage_main"] || !seen["test_stage_heavy"] || !seen["test_stage_other"] {
+		t.Fatalf("stages should have run on their own agents, got %v", seen)
+	}
+
+	// Workspace of the stage got cleaned and its agent released
+	_, err = os.Stat(filepath.Join(state.AgentDir, "test_stage_heavy"))
+	utils.FatalNoError(err, "workspace of the stage should have been removed", t)
+	utils.FatalExpectedActual(true, state.GetAgent("test_stage_heavy").TryAcquire() != nil, t)
+}
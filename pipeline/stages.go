@@ -14,6 +14,7 @@ type stages struct {
 	stages            []*stage // List of stages in the pipeline.
 	shouldStopIfError bool     // Determines whether execution should stop on error.
 	parallel          bool     // Determines wether execution of stages should be put in goroutines
+	post              *post    // Handlers to execute once the stages ended
 }
 
 // Stages initializes a new set of stages to execute in sequence by default.
@@ -28,7 +29,7 @@ func Stages(name string, _stages ...*stage) *stages {
 }
 
 // ExecuteInPipeline executes all the stages within the pipeline.
-func (s *stages) ExecuteInPipeline(p *Pipeline, ctx context.Context) error {
+func (s *stages) ExecuteInPipeline(p *Pipeline, ctx context.Context) (err error) {
 
 	diag := NewDiag(fmt.Sprintf("%s | stages %s", p.Name, s.name))
 	p.Diagnostic.AddChild(diag)
@@ -39,7 +40,20 @@ func (s *stages) ExecuteInPipeline(p *Pipeline, ctx context.Context) error {
 	defer func() {
 		end := time.Now().UnixMilli()
 		elapsedTime := end - beginning
-		diag.LogEvent(INFO, fmt.Sprintf("stages %s ended successfully. Took %d ms", s.name, elapsedTime))
+		status := statusFromError(err)
+		if status == SUCCESS {
+			status = diag.childrenStatus()
+		}
+		if s.post != nil {
+			postErr := s.post.executeFor(p, ctx, diag, s.name, status)
+			if err == nil && postErr != nil {
+				err = postErr
+				status = statusFromError(err)
+			}
+		}
+		diag.SetStatus(status)
+		p.recordStageStatus(s.name, status)
+		diag.LogEvent(INFO, fmt.Sprintf("stages %s ended with status %s. Took %d ms", s.name, status, elapsedTime))
 		p.ResetDiag()
 	}()
 
@@ -47,6 +61,7 @@ func (s *stages) ExecuteInPipeline(p *Pipeline, ctx context.Context) error {
 	// Parallel execution seem to pose a problem with diags in stages
 	if s.parallel {
 		diag.LogEvent(DEBUG, "starting parallel tasks")
+		ctx := context.WithValue(ctx, parallelKey{}, true)
 		var wg sync.WaitGroup
 		errchan := make(chan error, len(s.stages))
 		for _, s := range s.stages {
@@ -78,15 +93,17 @@ func (s *stages) ExecuteInPipeline(p *Pipeline, ctx context.Context) error {
 
 	}
 
-	for _, stage := range s.stages {
+	for i, stage := range s.stages {
 		select {
 		case <-ctx.Done():
 			diag.LogEvent(WARN, fmt.Sprintf("Stages got canceled before finishing"))
+			s.skipFrom(p, diag, i, "Skipped because the pipeline got canceled")
 			return ctx.Err()
 		default:
 			err := stage.ExecuteStage(p, ctx)
 			if err != nil {
 				if stage.shouldStopIfError {
+					s.skipFrom(p, diag, i+1, fmt.Sprintf("Skipped because of blocking error in stage %s", stage.name))
 					return err
 				}
 				diag.LogEvent(WARN, fmt.Sprintf("got non blocking error in stage %s : %v", s.name, err))
@@ -96,6 +113,13 @@ func (s *stages) ExecuteInPipeline(p *Pipeline, ctx context.Context) error {
 	return nil
 }
 
+// skipFrom marks the stages from index i as skipped
+func (s *stages) skipFrom(p *Pipeline, diag *Diagnostic, i int, reason string) {
+	for _, stage := range s.stages[i:] {
+		diag.skippedDiag(fmt.Sprintf("%s | stage %s", p.Name, stage.name), reason)
+	}
+}
+
 func (s *stages) GetName() string {
 	return s.name
 }
@@ -106,6 +130,13 @@ func (s *stages) Parallel() *stages {
 	return s
 }
 
+// Post attaches handlers to execute once the stages ended,
+// depending on their status
+func (s *stages) Post(post *post) *stages {
+	s.post = post
+	return s
+}
+
 // GetShouldStopIfError returns whether the pipeline should stop if an error occurs in a stage.
 func (s *stages) GetShouldStopIfError() bool {
 	return s.shouldStopIfError
@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ERunStatus is the state of a run of a pipeline, or of
+// one of its elements
+type ERunStatus uint8
+
+const (
+	PENDING   = ERunStatus(iota) // Waiting to be executed
+	RUNNING                      // Being executed
+	SUCCESS                      // Executed without error
+	UNSTABLE                     // Executed, but something non blocking went wrong
+	FAILURE                      // Stopped by an error
+	ABORTED                      // Canceled before finishing
+	SKIPPED                      // Not executed
+	TIMED_OUT                    // Stopped because it took too long
+	CACHED                       // Not executed, its outputs got restored from the cache
+)
+
+var STATUS_STR = [9]string{"PENDING", "RUNNING", "SUCCESS", "UNSTABLE", "FAILURE", "ABORTED", "SKIPPED", "TIMED_OUT", "CACHED"}
+
+// Severity of each status, used to know which status should be kept
+// when two of them are combined
+var statusSeverity = [9]uint8{0, 0, 1, 2, 3, 4, 1, 4, 1}
+
+// Failed tells if the status means the execution did not go through
+func (s ERunStatus) Failed() bool {
+	return s == FAILURE || s == ABORTED || s == TIMED_OUT
+}
+
+// Finished tells if the status is a final one
+func (s ERunStatus) Finished() bool {
+	return s != PENDING && s != RUNNING
+}
+
+// Worst gives back the most severe of the two statuses
+func (s ERunStatus) Worst(other ERunStatus) ERunStatus {
+	if statusSeverity[other] > statusSeverity[s] {
+		return other
+	}
+	return s
+}
+
+func (s ERunStatus) String() string {
+	if int(s) < len(STATUS_STR) {
+		return STATUS_STR[s]
+	}
+	return fmt.Sprintf("STATUS(%d)", uint8(s))
+}
+
+// statusFromError gives back the status corresponding to the
+// error that stopped an execution
+func statusFromError(err error) ERunStatus {
+	switch {
+	case err == nil:
+		return SUCCESS
+	case errors.Is(err, context.Canceled):
+		return ABORTED
+	case errors.Is(err, context.DeadlineExceeded):
+		return TIMED_OUT
+	default:
+		return FAILURE
+	}
+}
+
+// MarkStatus combines the status with the current status of the pipeline,
+// keeping the most severe one.
+//
+// Can be used by executables to mark the run as UNSTABLE
+func (p *Pipeline) MarkStatus(status ERunStatus) {
+	p.Lock()
+	defer p.Unlock()
+	p.Status = p.Status.Worst(status)
+}
+
+// setStatus replaces the status of the pipeline
+func (p *Pipeline) setStatus(status ERunStatus) {
+	p.Lock()
+	defer p.Unlock()
+	p.Status = status
+}
+
+// GetStatus gives back the current status of the pipeline
+func (p *Pipeline) GetStatus() ERunStatus {
+	p.Lock()
+	defer p.Unlock()
+	return p.Status
+}
+
+// MarshalJSON converts ERunStatus to the corresponding string
+func (s ERunStatus) MarshalJSON() ([]byte, error) {
+	if int(s) < len(STATUS_STR) {
+		return json.Marshal(STATUS_STR[s])
+	}
+	return json.Marshal(uint8(s))
+}
+
+// UnmarshalJSON converts string back to ERunStatus
+func (s *ERunStatus) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		for i, st := range STATUS_STR {
+			if st == str {
+				*s = ERunStatus(i)
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid status string: %s", str)
+	}
+
+	return fmt.Errorf("invalid status value: %s", string(data))
+}
@@ -0,0 +1,73 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func TestStatusFromError(t *testing.T) {
+	utils.FatalExpectedActual(SUCCESS, statusFromError(nil), t)
+	utils.FatalExpectedActual(FAILURE, statusFromError(errors.New("test")), t)
+	utils.FatalExpectedActual(ABORTED, statusFromError(context.Canceled), t)
+	utils.FatalExpectedActual(TIMED_OUT, statusFromError(fmt.Errorf("wrapped: %w", context.DeadlineExceeded)), t)
+}
+
+func TestStatusWorst(t *testing.T) {
+	utils.FatalExpectedActual(SUCCESS, RUNNING.Worst(SUCCESS), t)
+	utils.FatalExpectedActual(UNSTABLE, SUCCESS.Worst(UNSTABLE), t)
+	utils.FatalExpectedActual(FAILURE, FAILURE.Worst(UNSTABLE), t)
+	utils.FatalExpectedActual(ABORTED, UNSTABLE.Worst(ABORTED), t)
+}
+
+func TestStatusJSON(t *testing.T) {
+	bytes, err := json.Marshal(TIMED_OUT)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(`"TIMED_OUT"`, string(bytes), t)
+
+	var status ERunStatus
+	utils.FatalError(json.Unmarshal(bytes, &status), t)
+	utils.FatalExpectedActual(TIMED_OUT, status, t)
+}
+
+func TestStagesStatus(t *testing.T) {
+	p := _test_getPipeline("TestStagesStatus")
+	p.Diagnostic = NewDiag("test")
+	stages := Stages("stages",
+		Stage("non_blocking",
+			Exec(func(p *Pipeline, ctx context.Context) error {
+				return errors.New("test")
+			}),
+		).DontStopIfErr(),
+		Stage("blocking",
+			Exec(func(p *Pipeline, ctx context.Context) error {
+				return errors.New("test")
+			}),
+		),
+		Stage("skipped",
+			Exec(func(p *Pipeline, ctx context.Context) error {
+				return nil
+			}),
+		),
+	)
+	err := stages.ExecuteInPipeline(p, context.Background())
+	utils.FatalNoError(err, "blocking stage should have failed", t)
+
+	stagesDiag := p.Diagnostic.Events[0].(*Diagnostic)
+	utils.FatalExpectedActual(FAILURE, stagesDiag.Status, t)
+
+	expected := []ERunStatus{UNSTABLE, FAILURE, SKIPPED}
+	i := 0
+	for _, evt := range stagesDiag.Events {
+		if diag, ok := evt.(*Diagnostic); ok {
+			utils.FatalExpectedActual(expected[i], diag.Status, t)
+			i++
+		}
+	}
+	utils.FatalExpectedActual(len(expected), i, t)
+	utils.FatalExpectedActual(UNSTABLE, p.Status, t)
+}
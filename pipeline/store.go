@@ -6,6 +6,7 @@ type Store struct {
 	sync.Mutex
 	ActivePipelines map[string]*Pipeline
 	GlobalPipelines map[string]*Pipeline
+	History         map[string][]*RunRecord // Finished runs, by name of pipeline
 }
 
 var store *Store
@@ -16,6 +17,7 @@ func GetStore() *Store {
 		store = &Store{
 			ActivePipelines: make(map[string]*Pipeline),
 			GlobalPipelines: make(map[string]*Pipeline),
+			History:         make(map[string][]*RunRecord),
 		}
 	}
     return store
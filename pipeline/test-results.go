@@ -0,0 +1,303 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TestCase is the result of a single test
+type TestCase struct {
+	Package  string     `json:"package"`          // Package, or class name for JUnit reports
+	Name     string     `json:"name"`             // Name of the test
+	Duration float64    `json:"duration"`         // Time it took to execute the test, in seconds
+	Status   ERunStatus `json:"status"`           // SUCCESS, FAILURE or SKIPPED
+	Output   string     `json:"output,omitempty"` // Output of the test if it failed
+}
+
+// TestSummary holds the totals of a set of tests
+type TestSummary struct {
+	Total    int     `json:"total"`
+	Passed   int     `json:"passed"`
+	Failed   int     `json:"failed"`
+	Skipped  int     `json:"skipped"`
+	Duration float64 `json:"duration"` // Sum of the durations of the tests, in seconds
+}
+
+// PackageError is a package that failed without any of its tests
+// failing, which happens when it does not compile
+type PackageError struct {
+	Package string `json:"package"`
+	Output  string `json:"output,omitempty"` // Output of the package
+}
+
+// TestReport holds the results of the tests executed by a stage
+type TestReport struct {
+	TestSummary
+	Cases         []TestCase     `json:"cases"`
+	PackageErrors []PackageError `json:"package-errors,omitempty"` // Packages that failed on their own, not counted as tests
+}
+
+// add records a test case and updates the totals
+func (r *TestReport) add(tc TestCase) {
+	r.Cases = append(r.Cases, tc)
+	r.TestSummary.add(tc)
+}
+
+// add updates the totals with a test case
+func (s *TestSummary) add(tc TestCase) {
+	s.Total++
+	s.Duration += tc.Duration
+	switch tc.Status {
+	case FAILURE:
+		s.Failed++
+	case SKIPPED:
+		s.Skipped++
+	default:
+		s.Passed++
+	}
+}
+
+// merge adds the totals of another summary
+func (s *TestSummary) merge(other TestSummary) {
+	s.Total += other.Total
+	s.Passed += other.Passed
+	s.Failed += other.Failed
+	s.Skipped += other.Skipped
+	s.Duration += other.Duration
+}
+
+// recordTests attaches the test results to the diagnostic of the stage,
+// adds them to the totals of the pipeline, and marks the run as
+// UNSTABLE if a test failed
+func (p *Pipeline) recordTests(ctx context.Context, report *TestReport) {
+	diag := p.StageDiagnostic(ctx)
+	diag.Lock()
+	if diag.Tests == nil {
+		diag.Tests = &TestReport{Cases: []TestCase{}}
+	}
+	for _, tc := range report.Cases {
+		diag.Tests.add(tc)
+	}
+	diag.Tests.PackageErrors = append(diag.Tests.PackageErrors, report.PackageErrors...)
+	diag.Unlock()
+
+	p.Lock()
+	if p.Tests == nil {
+		p.Tests = &TestSummary{}
+	}
+	p.Tests.merge(report.TestSummary)
+	p.Unlock()
+
+	diag.LogEvent(INFO, fmt.Sprintf("%d tests executed : %d passed, %d failed, %d skipped", report.Total, report.Passed, report.Failed, report.Skipped))
+	for _, pkgErr := range report.PackageErrors {
+		diag.LogEvent(ERROR, fmt.Sprintf("Package %s failed without a failing test : %s", pkgErr.Package, pkgErr.Output))
+	}
+	if report.Failed > 0 {
+		p.MarkUnstable(ctx, fmt.Sprintf("%d tests failed", report.Failed))
+	}
+}
+
+// TestResults parses the JUnit XML reports matching the globs, relative
+// to the current directory of the pipeline, and attaches the results
+// to the stage.
+//
+// Failed tests mark the run as UNSTABLE.
+func TestResults(globs ...string) Step {
+	return Describe(Exec(func(p *Pipeline, ctx context.Context) error {
+		report := &TestReport{Cases: []TestCase{}}
+		found := 0
+		for _, glob := range globs {
+			matches, err := filepath.Glob(filepath.Join(p.WorkingDirectory(ctx), glob))
+			if err != nil {
+				return err
+			}
+			for _, match := range matches {
+				file, err := os.Open(match)
+				if err != nil {
+					return err
+				}
+				err = parseJUnit(file, report)
+				file.Close()
+				if err != nil {
+					return fmt.Errorf("could not parse test report %s : %v", match, err)
+				}
+				found++
+			}
+		}
+		if found == 0 {
+			return fmt.Errorf("no test report matching %v", globs)
+		}
+		p.recordTests(ctx, report)
+		return nil
+	}), "test-results", "Parses JUnit XML reports", map[string]string{"globs": strings.Join(globs, " ")})
+}
+
+// GoTest executes go test with the -json flag and the given arguments in
+// the current directory of the pipeline, and attaches the results to
+// the stage.
+//
+// Failed tests mark the run as UNSTABLE. Failures not coming from
+// tests, like a build error, fail the stage.
+func GoTest(args ...string) Step {
+	return Describe(Exec(func(p *Pipeline, ctx context.Context) error {
+		cmd, err := p.command(ctx, "go", append([]string{"test", "-json"}, args...)...)
+		if err != nil {
+			return err
+		}
+		p.StageDiagnostic(ctx).LogEvent(DEBUG, fmt.Sprintf("Executing command go test -json %s", strings.Join(args, " ")))
+		out, err := cmd.output()
+		report := &TestReport{Cases: []TestCase{}}
+		parseErr := parseGoTest(strings.NewReader(string(out)), report)
+		if parseErr != nil {
+			return parseErr
+		}
+		p.recordTests(ctx, report)
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && limitOf(err) == "" && report.Failed > 0 && len(report.PackageErrors) == 0 {
+			return nil
+		}
+		if exitErr != nil && len(exitErr.Stderr) > 0 {
+			p.StageDiagnostic(ctx).LogEvent(ERROR, fmt.Sprintf("go test failed : %s", string(exitErr.Stderr)))
+		}
+		return err
+	}), "go-test", "Executes go test and parses its results", map[string]string{"args": strings.Join(args, " ")})
+}
+
+// goTestEvent is a line of the output of go test -json
+type goTestEvent struct {
+	Action  string  `json:"Action"`
+	Package string  `json:"Package"`
+	Test    string  `json:"Test"`
+	Elapsed float64 `json:"Elapsed"`
+	Output  string  `json:"Output"`
+}
+
+// parseGoTest reads the output of go test -json and adds the test cases
+// to the report. Packages that fail without a failing test are recorded
+// as package errors.
+func parseGoTest(r io.Reader, report *TestReport) error {
+	outputs := make(map[string]*strings.Builder)
+	failedTests := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var evt goTestEvent
+		if err := json.Unmarshal(line, &evt); err != nil {
+			return fmt.Errorf("invalid go test output : %v", err)
+		}
+		id := evt.Package + "." + evt.Test
+		switch evt.Action {
+		case "output":
+			if outputs[id] == nil {
+				outputs[id] = &strings.Builder{}
+			}
+			outputs[id].WriteString(evt.Output)
+		case "pass", "fail", "skip":
+			status := map[string]ERunStatus{"pass": SUCCESS, "fail": FAILURE, "skip": SKIPPED}[evt.Action]
+			if evt.Test == "" {
+				// Results of the package, only kept if it failed on its own
+				if status == FAILURE && !failedTests[evt.Package] {
+					pkgErr := PackageError{Package: evt.Package}
+					if outputs[id] != nil {
+						pkgErr.Output = outputs[id].String()
+					}
+					report.PackageErrors = append(report.PackageErrors, pkgErr)
+				}
+				continue
+			}
+			if status == FAILURE {
+				failedTests[evt.Package] = true
+			}
+			tc := TestCase{
+				Package:  evt.Package,
+				Name:     evt.Test,
+				Duration: evt.Elapsed,
+				Status:   status,
+			}
+			if status == FAILURE && outputs[id] != nil {
+				tc.Output = outputs[id].String()
+			}
+			report.add(tc)
+		}
+	}
+	return scanner.Err()
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+	SystemOut string        `xml:"system-out"`
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Cases  []junitCase  `xml:"testcase"`
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+// parseJUnit reads a JUnit XML report, with either testsuites or
+// testsuite as root element, and adds the test cases to the report
+func parseJUnit(r io.Reader, report *TestReport) error {
+	var root junitSuite
+	err := xml.NewDecoder(r).Decode(&root)
+	if err != nil {
+		return err
+	}
+	addJUnitSuite(root, report)
+	return nil
+}
+
+func addJUnitSuite(suite junitSuite, report *TestReport) {
+	for _, c := range suite.Cases {
+		duration, _ := strconv.ParseFloat(c.Time, 64)
+		tc := TestCase{
+			Package:  c.ClassName,
+			Name:     c.Name,
+			Duration: duration,
+			Status:   SUCCESS,
+		}
+		if tc.Package == "" {
+			tc.Package = suite.Name
+		}
+		failure := c.Failure
+		if failure == nil {
+			failure = c.Error
+		}
+		switch {
+		case failure != nil:
+			tc.Status = FAILURE
+			tc.Output = strings.TrimSpace(failure.Message + "\n" + failure.Content + "\n" + c.SystemOut)
+		case c.Skipped != nil:
+			tc.Status = SKIPPED
+		}
+		report.add(tc)
+	}
+	for _, s := range suite.Suites {
+		addJUnitSuite(s, report)
+	}
+}
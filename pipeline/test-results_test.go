@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+const _test_junit = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="suite">
+    <testcase classname="app.Foo" name="passes" time="0.5"/>
+    <testcase classname="app.Foo" name="fails" time="1.5">
+      <failure message="expected 1">stack</failure>
+    </testcase>
+    <testcase name="skipped"><skipped/></testcase>
+  </testsuite>
+</testsuites>`
+
+const _test_gotest = `{"Action":"run","Package":"app","Test":"TestOk"}
+{"Action":"pass","Package":"app","Test":"TestOk","Elapsed":0.1}
+{"Action":"run","Package":"app","Test":"TestKo"}
+{"Action":"output","Package":"app","Test":"TestKo","Output":"boom\n"}
+{"Action":"fail","Package":"app","Test":"TestKo","Elapsed":0.2}
+{"Action":"fail","Package":"app","Elapsed":0.3}
+{"Action":"output","Package":"broken","Output":"broken.go:3: undefined: x\n"}
+{"Action":"fail","Package":"broken","Elapsed":0}
+`
+
+func TestParseJUnit(t *testing.T) {
+	report := &TestReport{}
+	err := parseJUnit(strings.NewReader(_test_junit), report)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(3, report.Total, t)
+	utils.FatalExpectedActual(1, report.Passed, t)
+	utils.FatalExpectedActual(1, report.Failed, t)
+	utils.FatalExpectedActual(1, report.Skipped, t)
+	utils.FatalExpectedActual(2.0, report.Duration, t)
+	utils.FatalExpectedActual("suite", report.Cases[2].Package, t)
+	utils.FatalExpectedActual("expected 1\nstack", report.Cases[1].Output, t)
+}
+
+func TestParseGoTest(t *testing.T) {
+	report := &TestReport{}
+	err := parseGoTest(strings.NewReader(_test_gotest), report)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(2, report.Total, t)
+	utils.FatalExpectedActual(1, report.Failed, t)
+	utils.FatalExpectedActual("boom\n", report.Cases[1].Output, t)
+
+	// A package failing without failed test is not a test
+	utils.FatalExpectedActual(1, len(report.PackageErrors), t)
+	utils.FatalExpectedActual(PackageError{Package: "broken", Output: "broken.go:3: undefined: x\n"}, report.PackageErrors[0], t)
+}
+
+func TestTestResults(t *testing.T) {
+	p := _test_getPipeline("TestTestResults")
+	p.Diagnostic = NewDiag("test")
+	p.directory = t.TempDir()
+	err := os.WriteFile(filepath.Join(p.directory, "report.xml"), []byte(_test_junit), os.ModePerm)
+	utils.FatalError(err, t)
+
+	stage := Stage("tests", TestResults("*.xml"))
+	err = stage.ExecuteStage(p, context.Background())
+	utils.FatalError(err, t)
+
+	diag := p.Diagnostic.Events[0].(*Diagnostic)
+	utils.FatalExpectedActual(UNSTABLE, diag.Status, t)
+	utils.FatalExpectedActual(3, diag.Tests.Total, t)
+	utils.FatalExpectedActual(UNSTABLE, p.Status, t)
+	utils.FatalExpectedActual(1, p.Tests.Failed, t)
+
+	stage = Stage("no_report", TestResults("*.json"))
+	err = stage.ExecuteStage(p, context.Background())
+	utils.FatalNoError(err, "no report should fail the stage", t)
+}
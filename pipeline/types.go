@@ -42,11 +42,12 @@ func (imp *EImportance) UnmarshalJSON(data []byte) error {
     return fmt.Errorf("invalid importance value: %s", string(data))
 }
 
-// pipelineEvents represents a generic event of the pipeline.
+// Event represents a generic event of the pipeline.
 // Each event must be able to execute within a pipeline and provide metadata.
 //
-// Implemented by : stages, OnceRunner, Post
-type pipelineEvents interface {
+// Implemented by : stages, OnceRunner, Post. Can be implemented
+// outside of the package to add new kinds of events to SetPipeline
+type Event interface {
 	ExecuteInPipeline(p *Pipeline, ctx context.Context) error // Executes the component within the pipeline.
 	GetShouldStopIfError() bool          // Indicates if the pipeline should stop on error.
 	GetName() string
@@ -57,9 +58,17 @@ type pipelineLog interface {
     Log()
 }
 
-// executable represents an entity that can be executed within a pipeline.
+// Step represents an entity that can be executed within a stage.
 //
-// Implemented by Exec, executor
-type executable interface {
+// Implemented by Exec, executor. Can be implemented outside of the
+// package to write reusable steps, which can also implement Describer
+// to show up in the plan of the pipeline
+type Step interface {
 	Execute(p *Pipeline, ctx context.Context) error // Executes the entity.
 }
+
+// Describer is implemented by Steps and Events giving
+// informations about themselves
+type Describer interface {
+	Info() StepInfo
+}
@@ -0,0 +1,359 @@
+package remote
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/pipeline"
+	"github.com/Cyber-cicco/jerminal/server/rpc"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+const RETRY_DELAY = 5 * time.Second
+
+// ErrUnauthorized tells that the server refused the agent
+var ErrUnauthorized = errors.New("Agent got refused by the server")
+
+// ErrUnknownServer tells that the server could not prove it knows the secret
+var ErrUnknownServer = errors.New("Server does not know the secret")
+
+// Daemon executes the work the server gives to an agent,
+// on the machine the daemon runs on
+type Daemon struct {
+	Address  string        // Address of the server
+	Secret   string        // Secret of the server
+	Name     string        // Name of the agent
+	Labels   []string      // Labels of the agent
+	Capacity int           // Number of runs the agent can execute at the same time
+	Dir      string        // Directory the workspaces get created in
+	Agent    *config.Agent // Limits and sandbox applied to the commands. Can be nil
+}
+
+// Run serves the server, connecting again every RETRY_DELAY when
+// the connection gets lost, until ctx is done, the server refuses the agent
+// or the server does not know the secret
+func (d *Daemon) Run(ctx context.Context) error {
+	for {
+		err := d.Serve(ctx)
+		if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrUnknownServer) || ctx.Err() != nil {
+			return err
+		}
+		fmt.Printf("Lost connection to the server : %v\n", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(RETRY_DELAY):
+		}
+	}
+}
+
+// Serve connects to the server, authenticates, then executes its requests
+// until the connection is lost or ctx is done.
+//
+// Commands still running when it returns get killed
+func (d *Daemon) Serve(ctx context.Context) error {
+	root, err := filepath.Abs(d.Dir)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(root, os.ModePerm); err != nil {
+		return err
+	}
+	dialer := net.Dialer{Timeout: HANDSHAKE_TIMEOUT}
+	netConn, err := dialer.DialContext(ctx, "tcp", d.Address)
+	if err != nil {
+		return err
+	}
+	c := newConn(netConn)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	identifier, err := d.handshake(c)
+	if err != nil {
+		return err
+	}
+	// Workspaces left by a previous connection are not known by the server anymore
+	os.RemoveAll(filepath.Join(root, identifier))
+	fmt.Printf("Agent registered by the server as %s\n", identifier)
+
+	s := &session{
+		conn:    c,
+		daemon:  d,
+		root:    root,
+		running: make(map[int]context.CancelFunc),
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	for {
+		msg, err := c.receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if msg.Id == nil {
+			continue
+		}
+		if msg.Method == METHOD_CANCEL {
+			s.cancel(msg)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(ctx, *msg.Id, msg)
+		}()
+	}
+}
+
+// handshake answers the challenge of the server, checks that the server
+// knows the secret too, and gives back the identifier it registered the agent with
+func (d *Daemon) handshake(c *conn) (string, error) {
+	c.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer c.SetDeadline(time.Time{})
+
+	msg, err := c.receive()
+	if err != nil {
+		return "", err
+	}
+	if msg.Method != METHOD_CHALLENGE || msg.Id == nil {
+		return "", fmt.Errorf("Expected a challenge from the server, got '%s'", msg.Method)
+	}
+	challenge := ChallengeParams{}
+	if err = json.Unmarshal(msg.Params, &challenge); err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	hello := Hello{
+		Name:      d.Name,
+		Labels:    d.Labels,
+		Capacity:  d.Capacity,
+		Signature: sign(d.Secret, challenge.Nonce),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	if d.Agent != nil {
+		hello.Limits = d.Agent.Limits
+		hello.Sandbox = d.Agent.Sandbox
+	}
+	if err = c.respond(*msg.Id, hello, nil); err != nil {
+		return "", err
+	}
+
+	msg, err = c.receive()
+	if err != nil {
+		return "", err
+	}
+	if msg.Error != nil {
+		return "", fmt.Errorf("%w : %s", ErrUnauthorized, msg.Error.Message)
+	}
+	registered := RegisteredParams{}
+	if msg.Method != METHOD_REGISTERED {
+		return "", fmt.Errorf("Expected the registration of the agent, got '%s'", msg.Method)
+	}
+	if err = json.Unmarshal(msg.Params, &registered); err != nil {
+		return "", err
+	}
+	// Nothing the server sends can be trusted before that
+	if !hmac.Equal([]byte(registered.Signature), []byte(serverProof(d.Secret, challenge.Nonce, hello.Nonce))) {
+		return "", ErrUnknownServer
+	}
+	if registered.Identifier == "" || registered.Identifier != filepath.Base(registered.Identifier) {
+		return "", fmt.Errorf("Invalid identifier '%s'", registered.Identifier)
+	}
+	c.authenticated()
+	return registered.Identifier, nil
+}
+
+// session is a connection of the daemon to the server
+type session struct {
+	*conn
+	daemon  *Daemon
+	root    string                     // Absolute path of the directory of the workspaces
+	mu      sync.Mutex                 // Protects running
+	running map[int]context.CancelFunc // Cancels the commands being executed, by request id
+}
+
+// handle executes a request of the server and sends back the result
+func (s *session) handle(ctx context.Context, id int, msg *envelope) {
+	var value any
+	var err error
+	switch msg.Method {
+	case METHOD_PREPARE:
+		value, err = s.prepare(msg.Params)
+	case METHOD_CLEAN_UP:
+		value, err = s.cleanUp(msg.Params)
+	case METHOD_EXEC:
+		value, err = s.exec(ctx, id, msg.Params)
+	case METHOD_IS_DIR:
+		value, err = s.isDir(msg.Params)
+	case METHOD_PUT_FILES:
+		value, err = s.putFiles(msg.Params)
+	case METHOD_GET_FILES:
+		value, err = s.getFiles(msg.Params)
+	default:
+		s.send(rpc.NewError(&id, rpc.ErrorData{
+			Code:    rpc.METHOD_NOT_FOUND,
+			Message: fmt.Sprintf("Unknown method '%s'", msg.Method),
+		}))
+		return
+	}
+	s.respond(id, value, err)
+}
+
+// cancel kills the command executed by a request
+func (s *session) cancel(msg *envelope) {
+	params := CancelParams{}
+	if json.Unmarshal(msg.Params, &params) != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.running[params.Id]; ok {
+		cancel()
+	}
+}
+
+// path checks that the path asked by the server is in the
+// directory of the workspaces, and gives it back cleaned
+func (s *session) path(path string) (string, error) {
+	path = filepath.Clean(path)
+	if !filepath.IsAbs(path) || !utils.IsWithin(s.root, path) {
+		return "", fmt.Errorf("Path %s is outside of the directory of the agent", path)
+	}
+	return path, nil
+}
+
+// workspace gives back the path of a workspace asked by the server
+func (s *session) workspace(params json.RawMessage) (string, error) {
+	p := WorkspaceParams{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.root, p.Workspace)
+	if filepath.IsAbs(p.Workspace) || path == s.root || !utils.IsWithin(s.root, path) {
+		return "", fmt.Errorf("Invalid workspace '%s'", p.Workspace)
+	}
+	return path, nil
+}
+
+func (s *session) prepare(params json.RawMessage) (any, error) {
+	path, err := s.workspace(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(path); err == nil {
+		return nil, fmt.Errorf("directory should not exist, agent has not cleaned up his directory from previous job. %s", filepath.Base(path))
+	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return path, os.Mkdir(path, os.ModePerm)
+}
+
+func (s *session) cleanUp(params json.RawMessage) (any, error) {
+	path, err := s.workspace(params)
+	if err != nil {
+		return nil, err
+	}
+	return true, os.RemoveAll(path)
+}
+
+func (s *session) exec(ctx context.Context, id int, params json.RawMessage) (any, error) {
+	req := config.ExecRequest{}
+	if err := json.Unmarshal(params, &req); err != nil {
+		return nil, err
+	}
+	workspace, err := s.path(req.Workspace)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := s.path(req.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	s.running[id] = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, id)
+		s.mu.Unlock()
+	}()
+
+	out, warning, err := pipeline.RunCommand(ctx, s.daemon.Agent, workspace, dir, req.Name, req.Args...)
+	res := &config.ExecResult{Output: out, Warning: warning}
+	if err != nil {
+		res.Error = err.Error()
+		var limitErr *pipeline.LimitError
+		if errors.As(err, &limitErr) {
+			res.Error = limitErr.Err.Error()
+			res.Limit = limitErr.Limit
+		}
+	}
+	return res, nil
+}
+
+func (s *session) isDir(params json.RawMessage) (any, error) {
+	p := PathParams{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	path, err := s.path(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, nil
+	}
+	return info.IsDir(), nil
+}
+
+func (s *session) putFiles(params json.RawMessage) (any, error) {
+	p := PutFilesParams{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	dir, err := s.path(p.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return true, utils.Untar(p.Archive, dir)
+}
+
+func (s *session) getFiles(params json.RawMessage) (any, error) {
+	p := PathParams{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	path, err := s.path(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return utils.Tar(path)
+}
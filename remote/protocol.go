@@ -0,0 +1,195 @@
+// Package remote lets agents run on other machines than the server.
+//
+// The agent daemon connects to the server over TCP, and both of them prove
+// they know the secret of the server. The server then sends it JSON RPC
+// requests framed like the ones of the unix socket, and the daemon answers them.
+//
+// The connection is not encrypted, it should go through a trusted
+// network or a tunnel.
+package remote
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/server/rpc"
+)
+
+// Methods of the protocol
+const (
+	METHOD_CHALLENGE  = "challenge"  // Server -> agent, first message of the connection
+	METHOD_REGISTERED = "registered" // Server -> agent, sent once the agent got authenticated
+	METHOD_PREPARE    = "prepare"
+	METHOD_CLEAN_UP   = "clean-up"
+	METHOD_EXEC       = "exec"
+	METHOD_CANCEL     = "cancel" // Kills a command being executed. Gets no response
+	METHOD_IS_DIR     = "is-dir"
+	METHOD_PUT_FILES  = "put-files"
+	METHOD_GET_FILES  = "get-files"
+)
+
+const (
+	MAX_MESSAGE_SIZE       = 512 * 1024 * 1024 // Archives of workspaces can get big
+	MAX_HANDSHAKE_MSG_SIZE = 16 * 1024         // Messages sent before both sides got authenticated
+	HANDSHAKE_TIMEOUT      = 10 * time.Second
+)
+
+// ErrMessageTooLong is given back when the peer sends a message
+// bigger than what the connection accepts
+var ErrMessageTooLong = errors.New("Message too long")
+
+// envelope is any message of the protocol. Requests have a method,
+// responses have a value or an error
+type envelope struct {
+	Method string          `json:"method"`
+	Id     *int            `json:"id"`
+	Params json.RawMessage `json:"params"`
+	Value  json.RawMessage `json:"value"`
+	Error  *rpc.ErrorData  `json:"error"`
+}
+
+type request[T any] struct {
+	rpc.JRPCRequest
+	Params T `json:"params"`
+}
+
+func newRequest[T any](id int, method string, params T) request[T] {
+	return request[T]{
+		JRPCRequest: rpc.JRPCRequest{JsonRpcVersion: "2.0", Id: id, Method: method},
+		Params:      params,
+	}
+}
+
+type ChallengeParams struct {
+	Nonce string `json:"nonce"` // Random string the agent signs with the secret
+}
+
+// Hello is the answer of the agent to the challenge
+type Hello struct {
+	Name      string          `json:"name"`      // Name of the agent, used as the identifier of its workspaces
+	Labels    []string        `json:"labels"`    // Labels of the agent
+	Capacity  int             `json:"capacity"`  // Number of runs the agent can execute at the same time
+	Limits    *config.Limits  `json:"limits"`    // Limits the agent applies to its commands
+	Sandbox   *config.Sandbox `json:"sandbox"`   // Sandbox the agent runs its commands in
+	Signature string          `json:"signature"` // HMAC of the nonce with the secret
+	Nonce     string          `json:"nonce"`     // Random string the server signs with the secret
+}
+
+type RegisteredParams struct {
+	Identifier string `json:"identifier"` // Identifier the server registered the agent with
+	Signature  string `json:"signature"`  // Proof that the server knows the secret, given by serverProof
+}
+
+type WorkspaceParams struct {
+	Workspace string `json:"workspace"` // Workspace, relative to the directory of the agent
+}
+
+type CancelParams struct {
+	Id int `json:"id"` // Id of the exec request to cancel
+}
+
+type PathParams struct {
+	Path string `json:"path"`
+}
+
+type PutFilesParams struct {
+	Dir     string `json:"dir"`
+	Archive []byte `json:"archive"`
+}
+
+// sign gives back the signature of the nonce with the secret
+func sign(secret, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serverProof gives back the signature proving to the agent that the server
+// knows the secret. It signs both nonces, and differs from the signature of
+// the agent, so the answer of an agent can't be replayed to it
+func serverProof(secret, challenge, nonce string) string {
+	return sign(secret, "server:"+challenge+":"+nonce)
+}
+
+// conn sends and receives the framed messages of the protocol
+type conn struct {
+	net.Conn
+	scanner *bufio.Scanner
+	writeMu sync.Mutex
+	maxSize atomic.Int64 // Size of the biggest message accepted
+}
+
+// newConn gives back a connection only accepting small messages,
+// until authenticated gets called
+func newConn(c net.Conn) *conn {
+	res := &conn{Conn: c}
+	res.maxSize.Store(MAX_HANDSHAKE_MSG_SIZE)
+	res.scanner = bufio.NewScanner(c)
+	res.scanner.Buffer(make([]byte, 0, 4*1024), MAX_MESSAGE_SIZE)
+	res.scanner.Split(res.split)
+	return res
+}
+
+// authenticated lets the peer send messages up to MAX_MESSAGE_SIZE.
+// Must only be called once the peer proved it knows the secret
+func (c *conn) authenticated() {
+	c.maxSize.Store(MAX_MESSAGE_SIZE)
+}
+
+// split frames the messages, refusing the ones bigger than the
+// connection accepts before the buffer grows to hold them
+func (c *conn) split(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := rpc.SplitFunc(data, atEOF)
+	if err == nil && token == nil && int64(len(data)) >= c.maxSize.Load() {
+		return 0, nil, ErrMessageTooLong
+	}
+	if len(token) > 0 && int64(len(token)) > c.maxSize.Load() {
+		return 0, nil, ErrMessageTooLong
+	}
+	return advance, token, err
+}
+
+// send writes a message on the connection
+func (c *conn) send(msg any) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.Write(rpc.JRPCRes(bytes))
+	return err
+}
+
+// receive blocks until the next message arrives
+func (c *conn) receive() (*envelope, error) {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	msg, _, err := rpc.DecodeMessage[envelope](c.scanner.Bytes())
+	return msg, err
+}
+
+// respond sends the result of a request, or its error
+func (c *conn) respond(id int, value any, err error) error {
+	if err != nil {
+		return c.send(rpc.NewError(&id, rpc.ErrorData{
+			Code:    rpc.INTERNAL_ERROR,
+			Message: err.Error(),
+		}))
+	}
+	return c.send(rpc.NewResult(id, value))
+}
@@ -0,0 +1,290 @@
+package remote
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+const TEST_SECRET = "test-secret"
+
+// TestHelperAgent is not a real test, it runs the agent daemon
+// in the process started by the other tests
+func TestHelperAgent(t *testing.T) {
+	if os.Getenv("JERMINAL_HELPER_AGENT") != "1" {
+		return
+	}
+	daemon := &Daemon{
+		Address:  os.Getenv("JERMINAL_HELPER_ADDRESS"),
+		Secret:   os.Getenv("JERMINAL_HELPER_SECRET"),
+		Name:     "helper",
+		Labels:   []string{"remote-test"},
+		Capacity: 2,
+		Dir:      os.Getenv("JERMINAL_HELPER_DIR"),
+	}
+	err := daemon.Serve(context.Background())
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// _test_serve starts a server accepting agents on localhost
+func _test_serve(t *testing.T) (*config.GlobalStateProvider, string) {
+	dir := t.TempDir()
+	agentsPath := filepath.Join(dir, "agents.json")
+	os.WriteFile(agentsPath, []byte("[]"), 0644)
+	state := config.GetStateCustomConf(&config.Config{
+		AgentDir:          filepath.Join(dir, "agent"),
+		PipelineDir:       filepath.Join(dir, "pipeline"),
+		AgentResourcePath: agentsPath,
+		Secret:            TEST_SECRET,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.FatalError(err, t)
+	t.Cleanup(func() { listener.Close() })
+	go Serve(listener, state)
+	return state, listener.Addr().String()
+}
+
+// _test_waitForAgents waits until the number of agents with the label is n
+func _test_waitForAgents(state *config.GlobalStateProvider, n int, t *testing.T) []*config.Agent {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		agents := state.AgentsWithLabels("remote-test")
+		if len(agents) == n {
+			return agents
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected %d remote agents", n)
+	return nil
+}
+
+func TestRemoteAgent(t *testing.T) {
+	state, address := _test_serve(t)
+	agentDir := t.TempDir()
+
+	helper := exec.Command(os.Args[0], "-test.run=TestHelperAgent")
+	helper.Env = append(os.Environ(),
+		"JERMINAL_HELPER_AGENT=1",
+		"JERMINAL_HELPER_ADDRESS="+address,
+		"JERMINAL_HELPER_SECRET="+TEST_SECRET,
+		"JERMINAL_HELPER_DIR="+agentDir,
+	)
+	utils.FatalError(helper.Start(), t)
+	t.Cleanup(func() {
+		helper.Process.Kill()
+		helper.Wait()
+	})
+
+	_test_waitForAgents(state, 1, t)
+	agent := state.GetAgent("helper")
+	if agent.Remote == nil {
+		t.Fatal("helper should be a remote agent")
+	}
+	utils.FatalExpectedActual(2, agent.Executors, t)
+
+	// Workspace setup and file transfer
+	executor := agent.TryAcquire()
+	workspace, err := executor.Prepare()
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(filepath.Join(agentDir, "helper", "1"), workspace, t)
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "input"), []byte("hello"), 0644)
+	archive, err := utils.Tar(src)
+	utils.FatalError(err, t)
+	utils.FatalError(agent.Remote.PutFiles(workspace, archive), t)
+
+	// Commands run in the process of the agent
+	res, err := agent.Remote.Exec(context.Background(), config.ExecRequest{
+		Workspace: workspace,
+		Dir:       workspace,
+		Name:      "sh",
+		Args:      []string{"-c", "cat input > output && echo $JERMINAL_HELPER_AGENT"},
+	})
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("", res.Error, t)
+	utils.FatalExpectedActual("1\n", string(res.Output), t)
+
+	res, err = agent.Remote.Exec(context.Background(), config.ExecRequest{
+		Workspace: workspace,
+		Dir:       workspace,
+		Name:      "false",
+	})
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("exit status 1", res.Error, t)
+
+	archive, err = agent.Remote.GetFiles(filepath.Join(workspace, "output"))
+	utils.FatalError(err, t)
+	dst := t.TempDir()
+	utils.FatalError(utils.Untar(archive, dst), t)
+	content, err := os.ReadFile(filepath.Join(dst, "output"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("hello", string(content), t)
+
+	isDir, err := agent.Remote.IsDir(workspace)
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(true, isDir, t)
+
+	// Paths outside of the directory of the agent are refused
+	_, err = agent.Remote.GetFiles("/etc/passwd")
+	utils.FatalNoError(err, "files outside of the agent directory should be refused", t)
+
+	// Canceling the context kills the command
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = agent.Remote.Exec(ctx, config.ExecRequest{
+		Workspace: workspace,
+		Dir:       workspace,
+		Name:      "sleep",
+		Args:      []string{"10"},
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the command to be canceled, got %v after %v", err, time.Since(start))
+	}
+
+	utils.FatalError(executor.CleanUp(), t)
+	_, err = os.Stat(workspace)
+	utils.FatalNoError(err, "workspace should have been removed", t)
+
+	// Agents disappear with their connection
+	helper.Process.Kill()
+	_test_waitForAgents(state, 0, t)
+}
+
+func TestRemoteAgentWrongSecret(t *testing.T) {
+	state, address := _test_serve(t)
+	daemon := &Daemon{
+		Address: address,
+		Secret:  "wrong",
+		Name:    "intruder",
+		Labels:  []string{"remote-test"},
+		Dir:     t.TempDir(),
+	}
+	err := daemon.Run(context.Background())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected the agent to be refused, got %v", err)
+	}
+	utils.FatalExpectedActual(0, len(state.AgentsWithLabels("remote-test")), t)
+}
+
+func TestRemoteAgentUnknownServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.FatalError(err, t)
+	defer listener.Close()
+	executed := make(chan bool, 1)
+
+	// Server answering without knowing the secret
+	go func() {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		c := newConn(netConn)
+		defer c.Close()
+		c.send(newRequest(0, METHOD_CHALLENGE, ChallengeParams{Nonce: "nonce"}))
+		if _, err := c.receive(); err != nil {
+			return
+		}
+		c.send(newRequest(0, METHOD_REGISTERED, RegisteredParams{Identifier: "helper", Signature: sign("wrong", "nonce")}))
+		c.send(newRequest(1, METHOD_EXEC, config.ExecRequest{Name: "touch", Args: []string{"pwned"}}))
+		_, err = c.receive()
+		executed <- err == nil
+	}()
+
+	dir := t.TempDir()
+	daemon := &Daemon{
+		Address: listener.Addr().String(),
+		Secret:  TEST_SECRET,
+		Name:    "helper",
+		Dir:     dir,
+	}
+	err = daemon.Run(context.Background())
+	if !errors.Is(err, ErrUnknownServer) {
+		t.Fatalf("expected the server to be refused, got %v", err)
+	}
+	utils.FatalExpectedActual(false, <-executed, t)
+}
+
+func TestUntarThroughSymlink(t *testing.T) {
+	outside := t.TempDir()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside})
+	tw.WriteHeader(&tar.Header{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("evil"))
+	tw.Close()
+	gz.Close()
+
+	err := utils.Untar(buf.Bytes(), t.TempDir())
+	utils.FatalNoError(err, "entries going through a symlink should be refused", t)
+	_, err = os.Stat(filepath.Join(outside, "evil"))
+	utils.FatalNoError(err, "file outside of the destination should not exist", t)
+}
+
+func TestTarSymlinks(t *testing.T) {
+	src := t.TempDir()
+	utils.FatalError(os.MkdirAll(filepath.Join(src, "node_modules", ".bin"), os.ModePerm), t)
+	utils.FatalError(os.WriteFile(filepath.Join(src, "node_modules", "tool.js"), []byte("tool"), 0755), t)
+	utils.FatalError(os.Symlink("../tool.js", filepath.Join(src, "node_modules", ".bin", "tool")), t)
+
+	archive, err := utils.Tar(src)
+	utils.FatalError(err, t)
+	dst := t.TempDir()
+	utils.FatalError(utils.Untar(archive, dst), t)
+
+	link, err := os.Readlink(filepath.Join(dst, "node_modules", ".bin", "tool"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("../tool.js", link, t)
+	content, err := os.ReadFile(filepath.Join(dst, "node_modules", ".bin", "tool"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual("tool", string(content), t)
+	infos, err := os.Stat(filepath.Join(dst, "node_modules", "tool.js"))
+	utils.FatalError(err, t)
+	utils.FatalExpectedActual(os.FileMode(0755), infos.Mode().Perm(), t)
+}
+
+func TestHandshakeMessageSize(t *testing.T) {
+	message := func(size int) []byte {
+		return []byte(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", size, strings.Repeat("a", size)))
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	c := newConn(server)
+	defer c.Close()
+	go client.Write(message(MAX_HANDSHAKE_MSG_SIZE * 4))
+	// Refused before being read in full
+	_, err := c.receive()
+	if !errors.Is(err, ErrMessageTooLong) {
+		t.Fatalf("expected the message to be refused, got %v", err)
+	}
+
+	server, client = net.Pipe()
+	defer client.Close()
+	c = newConn(server)
+	defer c.Close()
+	c.authenticated()
+	go client.Write(message(MAX_HANDSHAKE_MSG_SIZE * 4))
+	_, err = c.receive()
+	// Not JSON, but read in full
+	if errors.Is(err, ErrMessageTooLong) {
+		t.Fatalf("authenticated peers should send big messages, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package remote
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/server/rpc"
+)
+
+// Serve accepts the agents connecting to the listener and registers them
+// in the state of the application until the listener gets closed.
+//
+// Agents are removed from the state when their connection is lost
+func Serve(listener net.Listener, state *config.GlobalStateProvider) error {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go handleAgent(newConn(c), state)
+	}
+}
+
+// handleAgent authenticates the agent, then forwards
+// its responses until the connection is lost
+func handleAgent(c *conn, state *config.GlobalStateProvider) {
+	defer c.Close()
+	agentConn, hello, err := authenticate(c, state.CloneConfig().Secret)
+	if err != nil {
+		fmt.Printf("Agent from %v got refused : %v\n", c.RemoteAddr(), err)
+		return
+	}
+
+	agent, err := register(agentConn, hello, state)
+	if err != nil {
+		fmt.Printf("Agent %s got refused : %v\n", hello.Name, err)
+		refuse(c, err)
+		return
+	}
+	fmt.Printf("Agent %s connected from %v with %d executors\n", hello.Name, c.RemoteAddr(), agent.Executors)
+
+	agentConn.readResponses()
+
+	state.RemoveAgent(agent)
+	fmt.Printf("Agent %s disconnected : %v\n", hello.Name, agentConn.err)
+}
+
+// authenticate checks that the agent knows the secret of the server
+func authenticate(c *conn, secret string) (*agentConn, *Hello, error) {
+	if secret == "" {
+		return nil, nil, errors.New("Remote agents need a secret in the config of the server")
+	}
+	c.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer c.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	challenge := ChallengeParams{Nonce: hex.EncodeToString(nonce)}
+	if err := c.send(newRequest(0, METHOD_CHALLENGE, challenge)); err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := c.receive()
+	if err != nil {
+		return nil, nil, err
+	}
+	hello := &Hello{}
+	if msg.Error != nil {
+		return nil, nil, errors.New(msg.Error.Message)
+	}
+	if err = json.Unmarshal(msg.Value, hello); err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal([]byte(hello.Signature), []byte(sign(secret, challenge.Nonce))) {
+		err = errors.New("Wrong secret")
+		refuse(c, err)
+		return nil, nil, err
+	}
+	if hello.Name == "" || hello.Name != filepath.Base(hello.Name) || hello.Name == "." || hello.Name == ".." {
+		err = fmt.Errorf("Invalid agent name '%s'", hello.Name)
+		refuse(c, err)
+		return nil, nil, err
+	}
+	if hello.Nonce == "" {
+		err = errors.New("Agent sent no nonce to authenticate the server")
+		refuse(c, err)
+		return nil, nil, err
+	}
+	c.authenticated()
+	return &agentConn{
+		conn:    c,
+		name:    hello.Name,
+		proof:   serverProof(secret, challenge.Nonce, hello.Nonce),
+		pending: make(map[int]chan *envelope),
+		closed:  make(chan struct{}),
+	}, hello, nil
+}
+
+// refuse tells the agent why it could not be registered
+func refuse(c *conn, err error) {
+	c.send(rpc.NewError(nil, rpc.ErrorData{
+		Code:    rpc.UNAUTHORIZED,
+		Message: err.Error(),
+	}))
+}
+
+// register adds the agent to the state, with one executor
+// per run it can execute at the same time
+func register(c *agentConn, hello *Hello, state *config.GlobalStateProvider) (*config.Agent, error) {
+	agent := &config.Agent{
+		Identifier: hello.Name,
+		Labels:     hello.Labels,
+		Limits:     hello.Limits,
+		Sandbox:    hello.Sandbox,
+		Executors:  max(hello.Capacity, 1),
+		Remote:     c,
+	}
+	if err := state.AddAgent(agent); err != nil {
+		return nil, err
+	}
+	err := c.send(newRequest(0, METHOD_REGISTERED, RegisteredParams{
+		Identifier: agent.Identifier,
+		Signature:  c.proof,
+	}))
+	if err != nil {
+		state.RemoveAgent(agent)
+		return nil, err
+	}
+	return agent, nil
+}
+
+// agentConn is the connection of the server to a remote agent.
+//
+// It implements config.Remote
+type agentConn struct {
+	*conn
+	name    string
+	proof   string // Proves to the agent that the server knows the secret
+	mu      sync.Mutex
+	nextId  int
+	pending map[int]chan *envelope // Requests waiting for their response, by id
+	closed  chan struct{}          // Closed when the connection is lost
+	err     error                  // Error that closed the connection
+}
+
+// readResponses gives the responses of the agent to the requests
+// waiting for them, until the connection is lost
+func (a *agentConn) readResponses() {
+	for {
+		msg, err := a.receive()
+		if err != nil {
+			a.err = err
+			close(a.closed)
+			return
+		}
+		if msg.Id == nil {
+			continue
+		}
+		a.mu.Lock()
+		res, ok := a.pending[*msg.Id]
+		a.mu.Unlock()
+		if ok {
+			res <- msg
+		}
+	}
+}
+
+// call sends a request to the agent and waits for its response.
+//
+// If ctx is done before the response arrives, the agent is told to cancel the request
+func (a *agentConn) call(ctx context.Context, method string, params any, result any) error {
+	res := make(chan *envelope, 1)
+	a.mu.Lock()
+	a.nextId++
+	id := a.nextId
+	a.pending[id] = res
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.pending, id)
+		a.mu.Unlock()
+	}()
+
+	if err := a.send(newRequest(id, method, params)); err != nil {
+		return err
+	}
+	select {
+	case msg := <-res:
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Value, result)
+	case <-a.closed:
+		return fmt.Errorf("Connection to agent %s got lost", a.name)
+	case <-ctx.Done():
+		a.send(newRequest(0, METHOD_CANCEL, CancelParams{Id: id}))
+		return ctx.Err()
+	}
+}
+
+func (a *agentConn) Prepare(workspace string) (string, error) {
+	var path string
+	err := a.call(context.Background(), METHOD_PREPARE, WorkspaceParams{Workspace: workspace}, &path)
+	return path, err
+}
+
+func (a *agentConn) CleanUp(workspace string) error {
+	return a.call(context.Background(), METHOD_CLEAN_UP, WorkspaceParams{Workspace: workspace}, nil)
+}
+
+func (a *agentConn) Exec(ctx context.Context, req config.ExecRequest) (*config.ExecResult, error) {
+	res := &config.ExecResult{}
+	err := a.call(ctx, METHOD_EXEC, req, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (a *agentConn) IsDir(path string) (bool, error) {
+	var isDir bool
+	err := a.call(context.Background(), METHOD_IS_DIR, PathParams{Path: path}, &isDir)
+	return isDir, err
+}
+
+func (a *agentConn) PutFiles(dir string, archive []byte) error {
+	return a.call(context.Background(), METHOD_PUT_FILES, PutFilesParams{Dir: dir, Archive: archive}, nil)
+}
+
+func (a *agentConn) GetFiles(path string) ([]byte, error) {
+	var archive []byte
+	err := a.call(context.Background(), METHOD_GET_FILES, PathParams{Path: path}, &archive)
+	return archive, err
+}
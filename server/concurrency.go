@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/pipeline"
+)
+
+// ErrRunSkipped is given back when the SKIP_IF_RUNNING policy
+// of the pipeline drops a new run
+var ErrRunSkipped = errors.New("Run skipped")
+
+// runTracker keeps track of the runs of a single pipeline so the
+// server can apply its concurrency policy
+type runTracker struct {
+	sync.Mutex
+	running map[string]context.CancelFunc // runs that are executing, by id
+	queued  map[string]context.CancelFunc // runs admitted and waiting in the queue, by id
+	trigger *time.Timer                   // trigger waiting for the quiet period to end
+	changes []string                      // Files changed by the triggers waiting for the quiet period
+	unknown bool                          // true if one of the triggers did not know which files changed
+}
+
+func newRunTracker() *runTracker {
+	return &runTracker{
+		running: make(map[string]context.CancelFunc),
+		queued:  make(map[string]context.CancelFunc),
+	}
+}
+
+// getTracker returns the tracker of the pipeline, creating it if
+// it does not exist yet
+func (s *Server) getTracker(name string) *runTracker {
+	tracker, _ := s.trackers.LoadOrStore(name, newRunTracker())
+	return tracker.(*runTracker)
+}
+
+// debounce (re)starts the quiet period of the pipeline. The function
+// only gets called once no new trigger happened during the period
+func (t *runTracker) debounce(period time.Duration, fn func()) {
+	t.Lock()
+	defer t.Unlock()
+	if t.trigger != nil {
+		t.trigger.Stop()
+	}
+	var trigger *time.Timer
+	trigger = time.AfterFunc(period, func() {
+		t.Lock()
+		// A timer that fired while being replaced must not run
+		current := t.trigger == trigger
+		if current {
+			t.trigger = nil
+		}
+		t.Unlock()
+		if current {
+			fn()
+		}
+	})
+	t.trigger = trigger
+}
+
+// mergeChanges adds the files changed by a trigger to the ones of the
+// triggers waiting for the quiet period. Nil means they are not known
+func (t *runTracker) mergeChanges(files []string) {
+	t.Lock()
+	defer t.Unlock()
+	if files == nil {
+		t.unknown = true
+		return
+	}
+	t.changes = append(t.changes, files...)
+}
+
+// takeChanges gives back the files changed by the triggers coalesced by the
+// quiet period, or nil if one of them did not know them
+func (t *runTracker) takeChanges() []string {
+	t.Lock()
+	defer t.Unlock()
+	changes, unknown := t.changes, t.unknown
+	t.changes, t.unknown = nil, false
+	if unknown {
+		return nil
+	}
+	if changes == nil {
+		return []string{}
+	}
+	return changes
+}
+
+// admit applies the concurrency policy to a new run, counting the runs
+// executing and the ones waiting in the queue, then marks it as queued.
+//
+// It returns an error if the run must be skipped, and cancels the
+// other runs if the policy asks for it.
+func (t *runTracker) admit(id string, cancel context.CancelFunc, policy pipeline.ConcurrencyPolicy) error {
+	canceled := []context.CancelFunc{}
+	// Canceling a queued run releases it, so it happens once unlocked
+	defer func() {
+		for _, cancelRun := range canceled {
+			cancelRun()
+		}
+	}()
+	t.Lock()
+	defer t.Unlock()
+
+	if policy.Reached(len(t.running) + len(t.queued)) {
+		switch policy.Mode {
+		case pipeline.SKIP_IF_RUNNING:
+			return fmt.Errorf("%w : pipeline already has %d run(s) in progress or queued", ErrRunSkipped, len(t.running)+len(t.queued))
+		case pipeline.CANCEL_IN_PROGRESS:
+			for _, cancelRun := range t.running {
+				canceled = append(canceled, cancelRun)
+			}
+			// Canceled runs of the queue never start, they can be forgotten right away
+			for queuedId, cancelRun := range t.queued {
+				canceled = append(canceled, cancelRun)
+				delete(t.queued, queuedId)
+			}
+		}
+	}
+	t.queued[id] = cancel
+	return nil
+}
+
+// start marks the queued run as running if the concurrency
+// policy allows it to start right now.
+//
+// queued is false if the run is not queued anymore, because
+// another run canceled it meanwhile
+func (t *runTracker) start(id string, policy pipeline.ConcurrencyPolicy) (started bool, queued bool) {
+	t.Lock()
+	defer t.Unlock()
+	cancel, ok := t.queued[id]
+	if !ok {
+		return false, false
+	}
+	if policy.Reached(len(t.running)) {
+		return false, true
+	}
+	t.running[id] = cancel
+	delete(t.queued, id)
+	return true, true
+}
+
+// requeue puts a started run back in the queued ones,
+// when it could not get an agent after all
+func (t *runTracker) requeue(id string) {
+	t.Lock()
+	defer t.Unlock()
+	if cancel, ok := t.running[id]; ok {
+		t.queued[id] = cancel
+		delete(t.running, id)
+	}
+}
+
+// release removes the run from the running or queued ones
+func (t *runTracker) release(id string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.running, id)
+	delete(t.queued, id)
+}
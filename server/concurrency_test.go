@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/config"
+	"github.com/Cyber-cicco/jerminal/pipeline"
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+// started tells if the run got started by the tracker
+func started(tracker *runTracker, id string, policy pipeline.ConcurrencyPolicy) bool {
+	ok, _ := tracker.start(id, policy)
+	return ok
+}
+
+func TestRunTrackerSkip(t *testing.T) {
+	tracker := newRunTracker()
+	policy := pipeline.ConcurrencyPolicy{Mode: pipeline.SKIP_IF_RUNNING}
+
+	utils.FatalError(tracker.admit("first", func() {}, policy), t)
+	// Queued runs count too, so a burst of triggers gives a single run
+	err := tracker.admit("second", func() {}, policy)
+	utils.FatalExpectedActual(true, errors.Is(err, ErrRunSkipped), t)
+
+	utils.FatalExpectedActual(true, started(tracker, "first", policy), t)
+	utils.FatalNoError(tracker.admit("third", func() {}, policy), "third run should have been skipped", t)
+
+	tracker.release("first")
+	utils.FatalError(tracker.admit("fourth", func() {}, policy), t)
+}
+
+func TestRunTrackerCancelInProgress(t *testing.T) {
+	tracker := newRunTracker()
+	policy := pipeline.ConcurrencyPolicy{Mode: pipeline.CANCEL_IN_PROGRESS}
+
+	running, cancelRunning := context.WithCancel(context.Background())
+	utils.FatalError(tracker.admit("first", cancelRunning, policy), t)
+	utils.FatalExpectedActual(true, started(tracker, "first", policy), t)
+
+	queued, cancelQueued := context.WithCancel(context.Background())
+	utils.FatalError(tracker.admit("second", cancelQueued, policy), t)
+	utils.FatalExpectedActual(context.Canceled, running.Err(), t)
+	utils.FatalExpectedActual(false, started(tracker, "second", policy), t)
+
+	// Older queued runs get canceled too
+	utils.FatalError(tracker.admit("third", func() {}, policy), t)
+	utils.FatalExpectedActual(context.Canceled, queued.Err(), t)
+	// Dispatching it afterwards must not start it
+	_, stillQueued := tracker.start("second", policy)
+	utils.FatalExpectedActual(false, stillQueued, t)
+
+	tracker.release("first")
+	utils.FatalExpectedActual(true, started(tracker, "third", policy), t)
+}
+
+func TestRunTrackerQueue(t *testing.T) {
+	tracker := newRunTracker()
+	policy := pipeline.ConcurrencyPolicy{Mode: pipeline.QUEUE, MaxRuns: 2}
+
+	for _, id := range []string{"first", "second", "third"} {
+		utils.FatalError(tracker.admit(id, func() {}, policy), t)
+	}
+	utils.FatalExpectedActual(true, started(tracker, "first", policy), t)
+	utils.FatalExpectedActual(true, started(tracker, "second", policy), t)
+	utils.FatalExpectedActual(false, started(tracker, "third", policy), t)
+
+	// A run that could not get an agent waits again
+	tracker.requeue("second")
+	utils.FatalExpectedActual(true, started(tracker, "third", policy), t)
+}
+
+func TestRunTrackerDebounce(t *testing.T) {
+	tracker := newRunTracker()
+	var runs atomic.Int32
+
+	for i := 0; i < 5; i++ {
+		tracker.debounce(50*time.Millisecond, func() { runs.Add(1) })
+	}
+	time.Sleep(150 * time.Millisecond)
+	utils.FatalExpectedActual(int32(1), runs.Load(), t)
+}
+
+func TestRunTrackerChanges(t *testing.T) {
+	tracker := newRunTracker()
+	tracker.mergeChanges([]string{"a"})
+	tracker.mergeChanges([]string{"b"})
+	utils.FatalExpectedActual("[a b]", fmt.Sprint(tracker.takeChanges()), t)
+
+	// Pushes without changes are known to change nothing
+	tracker.mergeChanges([]string{})
+	utils.FatalExpectedActual(true, tracker.takeChanges() != nil, t)
+
+	// A single trigger not knowing its changes makes every stage run
+	tracker.mergeChanges([]string{"a"})
+	tracker.mergeChanges(nil)
+	utils.FatalExpectedActual(true, tracker.takeChanges() == nil, t)
+}
+
+func TestWebhookChangedFiles(t *testing.T) {
+	payload := WebhookPayload{Commits: []Commit{
+		{Added: []string{"web/new.ts"}, Modified: []string{"api/main.go"}},
+		{Removed: []string{"docs/old.md"}, Modified: []string{"api/main.go"}},
+	}}
+	utils.FatalExpectedActual("[api/main.go docs/old.md web/new.ts]", fmt.Sprint(payload.ChangedFiles()), t)
+
+	payload.Forced = true
+	utils.FatalExpectedActual(true, payload.ChangedFiles() == nil, t)
+	utils.FatalExpectedActual(true, (&WebhookPayload{}).ChangedFiles() == nil, t)
+
+	// GitHub only lists some of the commits of big pushes
+	payload = WebhookPayload{Commits: make([]Commit, MAX_WEBHOOK_COMMITS)}
+	utils.FatalExpectedActual(true, payload.ChangedFiles() == nil, t)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	s := &Server{config: config.GetStateCustomConf(&config.Config{GithubWebhookSecret: "secret"})}
+	for _, signature := range []string{"", "sha1=" + strings.Repeat("0", 40)} {
+		req := httptest.NewRequest(http.MethodPost, "/hook/github/pipeline", strings.NewReader(`{"commits": [{"added": ["a"]}]}`))
+		req.Header.Set("X-Hub-Signature", signature)
+		res := httptest.NewRecorder()
+		s.handleWebhook(res, req)
+		utils.FatalExpectedActual(http.StatusUnauthorized, res.Code, t)
+	}
+}
+
+func TestEnqueueBurst(t *testing.T) {
+	for _, mode := range []pipeline.EConcurrency{pipeline.SKIP_IF_RUNNING, pipeline.CANCEL_IN_PROGRESS} {
+		s := &Server{queue: newRunQueue()}
+		p := &pipeline.Pipeline{
+			Name:           "burst",
+			Concurrency:    pipeline.ConcurrencyPolicy{Mode: mode},
+			PipelineParams: &pipeline.PipelineParams{},
+		}
+		for i := 0; i < 3; i++ {
+			s.enqueue(p, nil, nil)
+		}
+		// A single run is left waiting for an agent
+		utils.FatalExpectedActual(1, len(s.queue.list()), t)
+		tracker := s.getTracker("burst")
+		utils.FatalExpectedActual(1, len(tracker.queued), t)
+	}
+}
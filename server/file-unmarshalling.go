@@ -32,7 +32,7 @@ func unMarshallFileFromReq(req *rpc.GetReportsReq, directory string, id string)
 		}
 	} else if len(req.Params.OmittedFields) > 0 {
 
-		allFields := [9]string{"name", "agent", "id", "parent", "time-ran", "in-error", "start-time", "diagnostics", "elapsed-time"}
+		allFields := [13]string{"name", "agent", "id", "parent", "time-ran", "status", "start-time", "diagnostics", "elapsed-time", "tests", "outputs", "preserved-workspace", "commit"}
 
 		omitMap := make(map[string]bool)
 		for _, field := range req.Params.OmittedFields {
@@ -1,6 +1,7 @@
 package server
 
 import (
+    "slices"
     "time"
 	"strings"
 	"crypto/hmac"
@@ -181,6 +182,26 @@ type Author struct {
 
 
 
+// Number of commits GitHub lists at most in the payload of a push
+const MAX_WEBHOOK_COMMITS = 20
+
+// ChangedFiles gives back the files added, removed or modified by the commits
+// of the push, or nil if they can't be known from the payload
+func (p *WebhookPayload) ChangedFiles() []string {
+	// Force pushes can remove commits that are not listed, and big pushes list only some of them
+	if len(p.Commits) == 0 || len(p.Commits) >= MAX_WEBHOOK_COMMITS || p.Forced || p.Deleted {
+		return nil
+	}
+	files := []string{}
+	for _, commit := range p.Commits {
+		files = append(files, commit.Added...)
+		files = append(files, commit.Removed...)
+		files = append(files, commit.Modified...)
+	}
+	slices.Sort(files)
+	return slices.Compact(files)
+}
+
 // Ensures that the request sending the webhook has the right signature
 func verifyGithubSignature(secret, signature string, body []byte) bool {
 	// The signature is in the format "sha1=hash"
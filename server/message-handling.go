@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Cyber-cicco/jerminal/pipeline"
 	"github.com/Cyber-cicco/jerminal/server/rpc"
@@ -26,6 +27,22 @@ func (s *Server) handleMessage(req *rpc.JRPCRequest, content []byte) []byte {
 		return s.startPipeline(req, content)
 	case "get-reports":
 		return s.getReports(req, content)
+	case "list-queue":
+		return s.listQueue(req, content)
+	case "set-run-priority":
+		return s.setRunPriority(req, content)
+	case "get-plan":
+		return s.getPlan(req, content)
+	case "list-agents":
+		return s.listAgents(req, content)
+	case "reload-agents":
+		return s.reloadAgents(req, content)
+	case "list-preserved-workspaces":
+		return s.listPreserved(req, content)
+	case "purge-preserved-workspaces":
+		return s.purgePreserved(req, content)
+	case "reset-pipeline-cache":
+		return s.resetCache(req, content)
 
 	default:
 		res := rpc.NewError(&req.Id, rpc.ErrorData{
@@ -65,8 +82,15 @@ func (s *Server) startPipeline(req *rpc.JRPCRequest, content []byte) []byte {
 	if err != nil {
 		return paramsError(req)
 	}
-	err = s.BeginPipeline(innerReq.Params.Name)
+	err = s.beginPipeline(innerReq.Params.Name, innerReq.Params.Priority, innerReq.Params.ChangedFiles)
 
+	if errors.Is(err, ErrRunSkipped) {
+		res := rpc.NewError(&req.Id, rpc.ErrorData{
+			Code:    rpc.RUN_SKIPPED,
+			Message: err.Error(),
+		})
+		return utils.MustMarshall(res)
+	}
 	if err != nil {
 		return invalidParamsError(req, err)
 	}
@@ -76,7 +100,7 @@ func (s *Server) startPipeline(req *rpc.JRPCRequest, content []byte) []byte {
 			ID:  &req.Id,
 		},
 		Value: rpc.SimpleMessage{
-			Message: fmt.Sprintf("Pipeline %s started successfully", innerReq.Params.Name),
+			Message: fmt.Sprintf("Pipeline %s queued successfully", innerReq.Params.Name),
 		},
 	}
 	return utils.MustMarshall(res)
@@ -178,8 +202,31 @@ func invalidParamsError(req *rpc.JRPCRequest, err error) []byte {
 	return utils.MustMarshall(res)
 }
 
-// BeginPipeline starts a pipeline cloned from the original one.
+// BeginPipeline puts a run of the pipeline in the queue of the server,
+// with the default priority of the pipeline.
+//
+// If the pipeline has a quiet period, the run only gets queued once no
+// other trigger happened during the period.
 func (s *Server) BeginPipeline(id string) error {
+	return s.beginPipeline(id, nil, nil)
+}
+
+// BeginPipelineWithPriority puts a run of the pipeline in the queue
+// of the server with the given priority.
+func (s *Server) BeginPipelineWithPriority(id string, priority int) error {
+	return s.beginPipeline(id, &priority, nil)
+}
+
+// BeginPipelineWithChanges puts a run of the pipeline in the queue of the
+// server, knowing which files changed since the last successful run.
+//
+// Stages filtered by OnChanges are skipped if none of them concern them.
+// Nil means the files are not known
+func (s *Server) BeginPipelineWithChanges(id string, files []string) error {
+	return s.beginPipeline(id, nil, files)
+}
+
+func (s *Server) beginPipeline(id string, priority *int, changes []string) error {
 	s.store.Lock()
 	pipeline, ok := s.store.GlobalPipelines[id]
 	s.store.Unlock()
@@ -187,35 +234,172 @@ func (s *Server) BeginPipeline(id string) error {
 		return fmt.Errorf("Wrong id received %s", id)
 	}
 
+	if pipeline.Concurrency.QuietPeriod > 0 {
+		tracker := s.getTracker(pipeline.Name)
+		tracker.mergeChanges(changes)
+		tracker.debounce(pipeline.Concurrency.QuietPeriod, func() {
+			err := s.enqueue(pipeline, priority, tracker.takeChanges())
+			if err != nil {
+				fmt.Printf("Pipeline '%s' could not start: %v\n", pipeline.Name, err)
+			}
+		})
+		return nil
+	}
+	return s.enqueue(pipeline, priority, changes)
+}
+
+// enqueue applies the concurrency policy of the pipeline, then puts
+// a clone of it in the queue of the server
+func (s *Server) enqueue(pipeline *pipeline.Pipeline, priority *int, changes []string) error {
 	// Get a shallow copy of the pipeline
 	clone := pipeline.Clone()
+	clone.SetChangedFiles(changes)
 	ctx, cancelPipeline := context.WithCancel(context.Background())
-	s.activePipelines.Store(clone.GetId(), cancelPipeline)
+	run := &queuedRun{
+		Run:      &clone,
+		Id:       clone.GetId(),
+		Name:     clone.Name,
+		Priority: clone.Priority,
+		Enqueued: time.Now(),
+		ctx:      ctx,
+		cancel:   cancelPipeline,
+	}
+	if priority != nil {
+		run.Priority = *priority
+	}
+
+	tracker := s.getTracker(pipeline.Name)
+	cancel := context.CancelFunc(func() {
+		cancelPipeline()
+		if s.queue.remove(run.Id) {
+			s.activePipelines.Delete(run.Id)
+			tracker.release(run.Id)
+			fmt.Printf("Pipeline '%s' was cancelled before getting an agent\n", run.Name)
+		}
+	})
+	// Admitted and marked as queued at once, so simultaneous triggers see each other
+	if err := tracker.admit(run.Id, cancel, pipeline.Concurrency); err != nil {
+		cancelPipeline()
+		return err
+	}
+	s.activePipelines.Store(run.Id, cancel)
+	s.queue.push(run)
+	return nil
+}
 
-	go func() {
+// listQueue gives back the runs waiting for an agent, in the
+// order they will be dispatched
+func (s *Server) listQueue(req *rpc.JRPCRequest, content []byte) []byte {
+	res := rpc.NewResult(req.Id, s.queue.list())
+	return utils.MustMarshall(res)
+}
 
-		defer cancelPipeline()
+// listAgents gives back the agents of the server, with the
+// executors running a pipeline
+func (s *Server) listAgents(req *rpc.JRPCRequest, content []byte) []byte {
+	res := rpc.NewResult(req.Id, s.config.AgentsUsage())
+	return utils.MustMarshall(res)
+}
 
-		s.store.Lock()
-		s.store.ActivePipelines[clone.GetId()] = &clone
-		s.store.Unlock()
+// reloadAgents reads agents.json again and tells
+// which agents changed
+func (s *Server) reloadAgents(req *rpc.JRPCRequest, content []byte) []byte {
+	reload, err := s.config.ReloadAgents()
+	if err != nil {
+		res := rpc.NewError(&req.Id, rpc.ErrorData{
+			Code:    rpc.INTERNAL_ERROR,
+			Message: err.Error(),
+		})
+		return utils.MustMarshall(res)
+	}
+	res := rpc.NewResult(req.Id, reload)
+	return utils.MustMarshall(res)
+}
 
-		err := clone.ExecutePipeline(ctx)
-		if err != nil {
-			s.store.Lock()
-			defer s.store.Unlock()
-			if err == context.Canceled {
-				fmt.Printf("Pipeline '%s' was cancelled\n", pipeline.Name)
-			} else {
-				fmt.Printf("Pipeline '%s' failed with error: %v\n", pipeline.Name, err)
-			}
-			delete(s.store.ActivePipelines, clone.GetId())
-		}
-		s.store.Lock()
-		delete(s.store.ActivePipelines, clone.GetId())
-		s.store.Unlock()
-	}()
-	return nil
+// listPreserved gives back the runs whose workspaces were kept
+// by the retention policy of their pipeline
+func (s *Server) listPreserved(req *rpc.JRPCRequest, content []byte) []byte {
+	var params rpc.PreservedWorkspacesReq
+	err := json.Unmarshal(content, &params)
+	if err != nil {
+		return paramsError(req)
+	}
+	runs, err := pipeline.ListPreserved(s.config.CloneConfig().PreservedDirectory(), params.Params.Name)
+	if err != nil {
+		return invalidParamsError(req, err)
+	}
+	res := rpc.NewResult(req.Id, runs)
+	return utils.MustMarshall(res)
+}
+
+// purgePreserved removes the kept workspaces of a run, of a
+// pipeline, or of every pipeline
+func (s *Server) purgePreserved(req *rpc.JRPCRequest, content []byte) []byte {
+	var params rpc.PreservedWorkspacesReq
+	err := json.Unmarshal(content, &params)
+	if err != nil {
+		return paramsError(req)
+	}
+	purged, err := pipeline.PurgePreserved(s.config.CloneConfig().PreservedDirectory(), params.Params.Name, params.Params.Id)
+	if err != nil {
+		return invalidParamsError(req, err)
+	}
+	res := rpc.NewResult(req.Id, purged)
+	return utils.MustMarshall(res)
+}
+
+// setRunPriority changes the priority of a queued run, reordering
+// the queue
+func (s *Server) setRunPriority(req *rpc.JRPCRequest, content []byte) []byte {
+	var params rpc.SetRunPriorityReq
+	err := json.Unmarshal(content, &params)
+	if err != nil {
+		return paramsError(req)
+	}
+	if !s.queue.setPriority(params.Params.PipelineId, params.Params.Priority) {
+		return invalidParamsError(req, errors.New("Run not found in the queue"))
+	}
+	res := rpc.NewResult(req.Id, s.queue.list())
+	return utils.MustMarshall(res)
+}
+
+// getPlan describes what a pipeline would execute, without
+// executing anything
+func (s *Server) getPlan(req *rpc.JRPCRequest, content []byte) []byte {
+	var params rpc.GetPlanReq
+	err := json.Unmarshal(content, &params)
+	if err != nil {
+		return paramsError(req)
+	}
+	s.store.Lock()
+	pipeline, ok := s.store.GlobalPipelines[params.Params.Name]
+	s.store.Unlock()
+	if !ok {
+		return invalidParamsError(req, errors.New("Pipeline not found"))
+	}
+	res := rpc.NewResult(req.Id, pipeline.Plan())
+	return utils.MustMarshall(res)
+}
+
+// resetCache removes what the RunOnce of a pipeline cached,
+// so it gets executed again on its next run
+func (s *Server) resetCache(req *rpc.JRPCRequest, content []byte) []byte {
+	var params rpc.ResetCacheReq
+	err := json.Unmarshal(content, &params)
+	if err != nil {
+		return paramsError(req)
+	}
+	s.store.Lock()
+	pipeline, ok := s.store.GlobalPipelines[params.Params.Name]
+	s.store.Unlock()
+	if !ok {
+		return invalidParamsError(req, errors.New("Pipeline not found"))
+	}
+	if err := pipeline.ResetCache(); err != nil {
+		return invalidParamsError(req, err)
+	}
+	res := rpc.NewResult(req.Id, "cache reset")
+	return utils.MustMarshall(res)
 }
 
 func (s *Server) getReports(req *rpc.JRPCRequest, content []byte) []byte {
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/pipeline"
+)
+
+// queuedRun is a run of a pipeline waiting for the server
+// to give it an agent
+type queuedRun struct {
+	Run      *pipeline.Pipeline `json:"-"`
+	Id       string             `json:"id"`           // Id of the run
+	Name     string             `json:"name"`         // Name of the pipeline
+	Priority int                `json:"priority"`     // Runs with higher priority get an agent first
+	Enqueued time.Time          `json:"enqueue-time"` // Time the run was put in the queue
+	Position int                `json:"position"`     // Position in the queue at the time it was listed
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// runQueue holds the pending runs of the server
+type runQueue struct {
+	sync.Mutex
+	runs   []*queuedRun
+	wakeUp chan struct{} // Tells the dispatcher something changed
+}
+
+func newRunQueue() *runQueue {
+	return &runQueue{
+		runs:   []*queuedRun{},
+		wakeUp: make(chan struct{}, 1),
+	}
+}
+
+// push puts a run in the queue
+func (q *runQueue) push(run *queuedRun) {
+	q.Lock()
+	q.runs = append(q.runs, run)
+	q.Unlock()
+	q.notify()
+}
+
+// remove takes a run out of the queue. Returns false
+// if the run was not in the queue
+func (q *runQueue) remove(id string) bool {
+	q.Lock()
+	defer q.Unlock()
+	for i, run := range q.runs {
+		if run.Id == id {
+			q.runs = append(q.runs[:i], q.runs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// setPriority changes the priority of a queued run. Returns false
+// if the run was not in the queue
+func (q *runQueue) setPriority(id string, priority int) bool {
+	q.Lock()
+	found := false
+	for _, run := range q.runs {
+		if run.Id == id {
+			run.Priority = priority
+			found = true
+		}
+	}
+	q.Unlock()
+	if found {
+		q.notify()
+	}
+	return found
+}
+
+// ordered gives back a copy of the queue, sorted by priority, then by
+// time of arrival
+func (q *runQueue) ordered() []*queuedRun {
+	q.Lock()
+	defer q.Unlock()
+	runs := make([]*queuedRun, len(q.runs))
+	copy(runs, q.runs)
+	sort.SliceStable(runs, func(i, j int) bool {
+		if runs[i].Priority != runs[j].Priority {
+			return runs[i].Priority > runs[j].Priority
+		}
+		return runs[i].Enqueued.Before(runs[j].Enqueued)
+	})
+	return runs
+}
+
+// list gives back a snapshot of the queue that can be sent to a client
+func (q *runQueue) list() []queuedRun {
+	runs := q.ordered()
+	q.Lock()
+	defer q.Unlock()
+	list := make([]queuedRun, len(runs))
+	for i, run := range runs {
+		list[i] = *run
+		list[i].Position = i
+	}
+	return list
+}
+
+// notify wakes up the dispatcher without blocking
+func (q *runQueue) notify() {
+	select {
+	case q.wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch gives agents to the queued runs by order of priority
+// whenever something that could unblock them happens
+//
+// MUST BE CALLED IN A GOROUTINE BY THE SERVER
+func (s *Server) dispatch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		released := s.config.AgentReleased()
+		s.dispatchQueued()
+		select {
+		case <-s.queue.wakeUp:
+		case <-released:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchQueued starts every queued run that can get an agent
+// and is allowed to run by its concurrency policy
+func (s *Server) dispatchQueued() {
+	for _, run := range s.queue.ordered() {
+		tracker := s.getTracker(run.Name)
+		if run.ctx.Err() != nil {
+			s.queue.remove(run.Id)
+			s.activePipelines.Delete(run.Id)
+			tracker.release(run.Id)
+			continue
+		}
+		started, queued := tracker.start(run.Id, run.Run.Concurrency)
+		if !queued {
+			// Canceled by a new run, its cancel may not have been called yet
+			run.cancel()
+			s.queue.remove(run.Id)
+			s.activePipelines.Delete(run.Id)
+			continue
+		}
+		if !started {
+			continue
+		}
+		// Runs that can never get an agent still get executed,
+		// so they fail with the error in their diagnostic
+		reserved, err := run.Run.ReserveAgent()
+		if !reserved && err == nil {
+			tracker.requeue(run.Id)
+			continue
+		}
+		s.queue.remove(run.Id)
+		go s.execute(run, tracker)
+	}
+}
+
+// execute runs a pipeline that got out of the queue
+func (s *Server) execute(run *queuedRun, tracker *runTracker) {
+	defer run.cancel()
+	defer s.activePipelines.Delete(run.Id)
+	defer func() {
+		tracker.release(run.Id)
+		s.queue.notify()
+	}()
+
+	s.store.Lock()
+	s.store.ActivePipelines[run.Id] = run.Run
+	s.store.Unlock()
+
+	err := run.Run.ExecutePipeline(run.ctx)
+	if err != nil {
+		if err == context.Canceled {
+			fmt.Printf("Pipeline '%s' was cancelled\n", run.Name)
+		} else {
+			fmt.Printf("Pipeline '%s' failed with error: %v\n", run.Name, err)
+		}
+	}
+	s.store.Lock()
+	delete(s.store.ActivePipelines, run.Id)
+	s.store.Unlock()
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/utils"
+)
+
+func _test_queuedRun(id string, priority int, enqueued time.Time) *queuedRun {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &queuedRun{
+		Id:       id,
+		Name:     "test",
+		Priority: priority,
+		Enqueued: enqueued,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func TestRunQueueOrder(t *testing.T) {
+	q := newRunQueue()
+	now := time.Now()
+	q.push(_test_queuedRun("low", 0, now))
+	q.push(_test_queuedRun("high", 10, now.Add(time.Second)))
+	q.push(_test_queuedRun("low_late", 0, now.Add(2*time.Second)))
+	q.push(_test_queuedRun("high_late", 10, now.Add(3*time.Second)))
+
+	expected := []string{"high", "high_late", "low", "low_late"}
+	for i, run := range q.list() {
+		utils.FatalExpectedActual(expected[i], run.Id, t)
+		utils.FatalExpectedActual(i, run.Position, t)
+	}
+
+	utils.FatalExpectedActual(true, q.setPriority("low_late", 20), t)
+	utils.FatalExpectedActual("low_late", q.list()[0].Id, t)
+	utils.FatalExpectedActual(false, q.setPriority("unknown", 20), t)
+}
+
+func TestRunQueueRemove(t *testing.T) {
+	q := newRunQueue()
+	q.push(_test_queuedRun("first", 0, time.Now()))
+	q.push(_test_queuedRun("second", 0, time.Now()))
+
+	utils.FatalExpectedActual(true, q.remove("first"), t)
+	utils.FatalExpectedActual(false, q.remove("first"), t)
+	utils.FatalExpectedActual(1, len(q.list()), t)
+	utils.FatalExpectedActual("second", q.list()[0].Id, t)
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Cyber-cicco/jerminal/pipeline"
+)
+
+// Time between two applications of the retention policies of the pipelines
+const RETENTION_INTERVAL = 10 * time.Minute
+
+// enforceRetention removes the preserved runs the retention policies of the
+// pipelines don't keep anymore, even if the pipelines don't run anymore
+//
+// MUST BE CALLED IN A GOROUTINE BY THE SERVER
+func (s *Server) enforceRetention(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.store.Lock()
+		pipelines := make([]*pipeline.Pipeline, 0, len(s.store.GlobalPipelines))
+		for _, p := range s.store.GlobalPipelines {
+			pipelines = append(pipelines, p)
+		}
+		s.store.Unlock()
+		applyRetention(pipelines...)
+	}
+}
+
+// applyRetention removes the preserved runs of the pipelines
+// their retention policy doesn't keep anymore
+func applyRetention(pipelines ...*pipeline.Pipeline) {
+	for _, p := range pipelines {
+		if err := p.ApplyRetention(time.Now()); err != nil {
+			fmt.Printf("Retention policy of pipeline '%s' could not be applied because of error %v\n", p.Name, err)
+		}
+	}
+}
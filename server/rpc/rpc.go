@@ -13,6 +13,8 @@ const (
 	METHOD_NOT_FOUND = -32601
 	INVALID_PARAMS   = -32602
 	INTERNAL_ERROR   = -32603
+	UNAUTHORIZED     = -32001
+	RUN_SKIPPED      = -32002 // The concurrency policy of the pipeline dropped the run
 )
 
 // Received structure to decode in JSON
@@ -85,7 +87,47 @@ type StartPipelineReq struct {
 }
 
 type StartPipelineParams struct {
-	Name string
+	Name         string
+	Priority     *int     `json:"priority,omitempty"`      // Priority of the run in the queue. Defaults to the one of the pipeline
+	ChangedFiles []string `json:"changed-files,omitempty"` // Files changed since the last successful run. Unknown if missing
+}
+
+type SetRunPriorityReq struct {
+	JRPCRequest
+	Params SetRunPriorityParams `json:"params"`
+}
+
+type SetRunPriorityParams struct {
+	PipelineId string `json:"pipeline-id"` // Unique identifier of the queued run
+	Priority   int    `json:"priority"`    // New priority of the run
+}
+
+type GetPlanReq struct {
+	JRPCRequest
+	Params GetPlanParams `json:"params"`
+}
+
+type GetPlanParams struct {
+	Name string `json:"name"` // Name of the pipeline to describe
+}
+
+type ResetCacheReq struct {
+	JRPCRequest
+	Params ResetCacheParams `json:"params"`
+}
+
+type ResetCacheParams struct {
+	Name string `json:"name"` // Name of the pipeline whose RunOnce should be executed again
+}
+
+type PreservedWorkspacesReq struct {
+	JRPCRequest
+	Params PreservedWorkspacesParams `json:"params"`
+}
+
+type PreservedWorkspacesParams struct {
+	Name string `json:"name"` // Name of the pipeline. Empty for every pipeline
+	Id   string `json:"id"`   // Id of the run to purge. Empty for every run of the pipeline
 }
 
 type GetReportsReq struct {
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/Cyber-cicco/jerminal/config"
 	"github.com/Cyber-cicco/jerminal/pipeline"
+	"github.com/Cyber-cicco/jerminal/remote"
 	"github.com/Cyber-cicco/jerminal/server/rpc"
 )
 
@@ -21,6 +23,8 @@ import (
 type Server struct {
 	listener        net.Listener                // Unix socket listener
 	activePipelines sync.Map                    // map[string]context.CancelFunc
+	trackers        sync.Map                    // map[string]*runTracker, by pipeline name
+	queue           *runQueue                   // runs waiting for an agent
 	store           *pipeline.Store             //keeps track of the project pipelines activity
 	config          *config.GlobalStateProvider // constants of the process
 }
@@ -29,6 +33,7 @@ type Server struct {
 func New() *Server {
 	server := &Server{
 		store: pipeline.GetStore(),
+		queue: newRunQueue(),
 	}
 
 	socketPath := "/tmp/pipeline-control.sock"
@@ -51,11 +56,31 @@ func New() *Server {
 		os.Exit(1)
 	}
 
+	// Runs interrupted by a previous stop of the server left
+	// their workspaces behind, making their agents unusable
+	summary, err := pipeline.Recover(conf)
+	if err != nil {
+		fmt.Printf("Recovery of the previous execution got errors\n%v\n", err)
+	}
+	fmt.Println(summary)
+
+	// The history tells the runs what happened before them, like
+	// the commit of the last successful one
+	loaded, err := server.store.LoadHistory(conf.ReportDir)
+	if err != nil {
+		fmt.Printf("History of the pipelines could not be fully loaded\n%v\n", err)
+	}
+	fmt.Printf("Loaded %d runs in the history of the pipelines\n", loaded)
+
 	server.config = conf
 	server.listener = listener
 
 	// Start socket listener in goroutine
 	go server.listenSockets()
+	go conf.WatchAgents(context.Background(), config.AGENTS_POLL_INTERVAL)
+	go conf.RunPools(context.Background(), config.POOL_SCALE_INTERVAL)
+	go server.dispatch()
+	go server.enforceRetention(RETENTION_INTERVAL)
 
 	return server
 }
@@ -98,12 +123,16 @@ func (s *Server) listenSockets() {
 }
 
 // Puts the pipelines in the server
+//
+// Their retention policy gets applied right away, the preserved runs may
+// have expired while the server was stopped
 func (s *Server) SetPipelines(pipelines ...*pipeline.Pipeline) {
 	s.store.Lock()
-	defer s.store.Unlock()
 	for _, p := range pipelines {
 		s.store.GlobalPipelines[p.Name] = p
 	}
+	s.store.Unlock()
+	applyRetention(pipelines...)
 }
 
 // ListenGithubHooks for calls to hook
@@ -116,6 +145,23 @@ func (s *Server) ListenGithubHooks(port uint16) {
 	}
 }
 
+// ListenAgents accepts the agents running on other machines on the tcp
+// address. They authenticate with the secret of the config
+func (s *Server) ListenAgents(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Listening for agents on %v\n", listener.Addr())
+	go func() {
+		err := remote.Serve(listener, s.config)
+		if err != nil {
+			fmt.Printf("Stopped listening for agents because of error %v\n", err)
+		}
+	}()
+	return nil
+}
+
 // Function that handles weebooks by triggering the pipeline
 // with the id set in the url
 func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
@@ -127,17 +173,26 @@ func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, body, err := getBody(r.Body)
+	payload, body, err := getBody(r.Body)
 	defer r.Body.Close()
 
-	verifyGithubSignature(s.config.GithubWebhookSecret, r.Header.Get("X-Hub-Signature"), body)
-
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 		return
 	}
 
-	go s.BeginPipeline(id)
+	// Without a secret, the payload can't be trusted to tell which stages to skip
+	changes := []string(nil)
+	secret := s.config.CloneConfig().GithubWebhookSecret
+	if secret != "" {
+		if !verifyGithubSignature(secret, r.Header.Get("X-Hub-Signature"), body) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		changes = payload.ChangedFiles()
+	}
+
+	go s.beginPipeline(id, nil, changes)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Webhook received and verified"))
@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Tar gives back a gzipped tar archive of a file, or of the
+// content of a directory
+func Tar(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	if info.IsDir() {
+		err = tarDir(tw, path)
+	} else {
+		err = tarFile(tw, path, info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tarDir writes the content of the directory in the archive, relative to it.
+// Symlinks are kept as they are instead of being followed
+func tarDir(tw *tar.Writer, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		link := ""
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case !info.Mode().IsRegular() && !info.IsDir():
+			return fmt.Errorf("%s has an unsupported type", path)
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+}
+
+// tarFile writes a single file in the archive, under its base name
+func tarFile(tw *tar.Writer, path string, info fs.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(path)
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// Untar extracts an archive made by Tar in the directory dst,
+// creating it if it does not exist.
+//
+// Entries that would end up outside of dst, or that go through
+// a symlink, are refused
+func Untar(archive []byte, dst string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	if err = os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := SafeJoin(dst, header.Name)
+		if err != nil {
+			return fmt.Errorf("Archive entry refused : %w", err)
+		}
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode.Perm()|0700)
+		case tar.TypeReg:
+			err = untarFile(tr, target, mode.Perm())
+		case tar.TypeSymlink:
+			// Links left by a previous extraction get replaced
+			if err = os.Remove(target); err == nil || errors.Is(err, fs.ErrNotExist) {
+				err = os.Symlink(header.Linkname, target)
+			}
+		default:
+			err = fmt.Errorf("Archive entry %s has an unsupported type", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func untarFile(r io.Reader, target string, perm fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	// Replacing the file instead of truncating it leaves the files it is linked to as is
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SafeJoin joins name to root, refusing the names ending up outside of root
+// and the ones whose parents go through a symlink, as it could point anywhere.
+//
+// The target itself can be a symlink, it should be replaced instead of written through
+func SafeJoin(root, name string) (string, error) {
+	target := filepath.Join(root, name)
+	if !IsWithin(root, target) {
+		return "", fmt.Errorf("%s is outside of %s", name, root)
+	}
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil || target == filepath.Clean(root) || rel == "." {
+		return target, err
+	}
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s goes through the symlink %s", name, current)
+		}
+	}
+	return target, nil
+}
+
+// IsWithin tells if path is root or one of its descendants
+func IsWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
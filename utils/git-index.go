@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Mode of the entries of the index that are submodules
+const GITLINK_MODE = 0160000
+
+// GitIndexEntry is a file tracked by a git repository
+type GitIndexEntry struct {
+	Path string // Path relative to the root of the repository, with slashes
+	Mode uint32
+}
+
+// ReadGitIndex gives back the files tracked by the git repository
+// of the directory, as listed by its .git/index.
+//
+// Supports the versions 2 to 4 of the index format
+func ReadGitIndex(repository string) ([]GitIndexEntry, error) {
+	content, err := os.ReadFile(filepath.Join(repository, ".git", "index"))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < 12+sha1.Size {
+		return nil, errors.New("Git index is too short")
+	}
+	body, checksum := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], checksum) {
+		return nil, errors.New("Git index checksum does not match")
+	}
+	if string(body[:4]) != "DIRC" {
+		return nil, errors.New("Git index has an invalid signature")
+	}
+	version := binary.BigEndian.Uint32(body[4:8])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("Git index version %d is not supported", version)
+	}
+	count := binary.BigEndian.Uint32(body[8:12])
+
+	entries := make([]GitIndexEntry, 0, count)
+	offset := 12
+	previous := ""
+	for i := uint32(0); i < count; i++ {
+		// ctime, mtime, dev, ino, mode, uid, gid, size, sha and flags
+		const fixed = 62
+		if offset+fixed > len(body) {
+			return nil, errors.New("Git index entry is truncated")
+		}
+		start := offset
+		mode := binary.BigEndian.Uint32(body[offset+24 : offset+28])
+		flags := binary.BigEndian.Uint16(body[offset+60 : offset+62])
+		offset += fixed
+		if flags&0x4000 != 0 {
+			if version < 3 {
+				return nil, errors.New("Git index entry has extended flags in version 2")
+			}
+			offset += 2
+		}
+
+		var path string
+		if version == 4 {
+			// Paths are compressed against the previous entry
+			strip, n := gitVarint(body[offset:])
+			if n == 0 || strip > len(previous) {
+				return nil, errors.New("Git index entry has an invalid path prefix")
+			}
+			offset += n
+			end := bytes.IndexByte(body[offset:], 0)
+			if end < 0 {
+				return nil, errors.New("Git index entry is truncated")
+			}
+			path = previous[:len(previous)-strip] + string(body[offset:offset+end])
+			offset += end + 1
+		} else {
+			end := bytes.IndexByte(body[offset:], 0)
+			if end < 0 {
+				return nil, errors.New("Git index entry is truncated")
+			}
+			path = string(body[offset : offset+end])
+			// Entries are padded with 1 to 8 NUL bytes to a multiple of 8
+			length := offset + end - start
+			offset = start + length + 8 - length%8
+		}
+		if offset > len(body) {
+			return nil, errors.New("Git index entry is truncated")
+		}
+		previous = path
+		entries = append(entries, GitIndexEntry{Path: path, Mode: mode})
+	}
+
+	// Split indexes keep part of their entries in another file
+	for offset+8 <= len(body) {
+		signature := string(body[offset : offset+4])
+		size := int(binary.BigEndian.Uint32(body[offset+4 : offset+8]))
+		if signature == "link" {
+			return nil, errors.New("Split git indexes are not supported")
+		}
+		offset += 8 + size
+	}
+	return entries, nil
+}
+
+// gitVarint decodes the variable length integers of git, giving
+// back the value and the number of bytes read. 0 bytes means invalid
+func gitVarint(b []byte) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	value := int(b[0] & 0x7f)
+	n := 1
+	for b[n-1]&0x80 != 0 {
+		if n >= len(b) || n > 8 {
+			return 0, 0
+		}
+		value = ((value + 1) << 7) | int(b[n]&0x7f)
+		n++
+	}
+	return value, n
+}
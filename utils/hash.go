@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// HashPaths writes the names and the contents of the files in w, walking
+// the directories in lexical order so the same tree always gives the same bytes.
+//
+// Symlinks are written as their target, without being followed
+func HashPaths(w io.Writer, paths ...string) error {
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			switch {
+			case d.IsDir():
+				_, err = fmt.Fprintf(w, "dir %s\n", filepath.ToSlash(path))
+				return err
+			case d.Type()&fs.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintf(w, "link %s %s\n", filepath.ToSlash(path), link)
+				return err
+			}
+			infos, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "file %s %d %o\n", filepath.ToSlash(path), infos.Size(), infos.Mode().Perm()); err != nil {
+				return err
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = io.Copy(w, file)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
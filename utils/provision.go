@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ProvisionMethod is a way of putting the files of a directory in another one
+type ProvisionMethod string
+
+const (
+	PROVISION_REFLINK      ProvisionMethod = "reflink"      // Files share their blocks until one gets modified. Needs a filesystem like btrfs or xfs
+	PROVISION_COW_HARDLINK ProvisionMethod = "cow-hardlink" // Files are read-only hardlinks to copies of the ones of src. Replacing one gives dst its own copy
+	PROVISION_HARDLINK     ProvisionMethod = "hardlink"     // Files are shared, writing in one changes the other. Needs both directories on the same filesystem
+	PROVISION_COPY         ProvisionMethod = "copy"
+)
+
+// Methods tried when none are given. Plain hardlinks are left out, since
+// a file written in place would change in src too
+var DEFAULT_PROVISIONING = []ProvisionMethod{PROVISION_REFLINK, PROVISION_COW_HARDLINK, PROVISION_COPY}
+
+// ProvisionStats tells how the files got provisioned
+type ProvisionStats struct {
+	Files   map[ProvisionMethod]int // Number of files provisioned by each method
+	Elapsed time.Duration
+}
+
+func (s *ProvisionStats) String() string {
+	return fmt.Sprintf("%d ms (%d reflinked, %d hardlinked read-only, %d hardlinked, %d copied)",
+		s.Elapsed.Milliseconds(), s.Files[PROVISION_REFLINK], s.Files[PROVISION_COW_HARDLINK], s.Files[PROVISION_HARDLINK], s.Files[PROVISION_COPY])
+}
+
+// CowDir gives back the directory where the read-only copies of
+// the files of src are kept for PROVISION_COW_HARDLINK
+func CowDir(src string) string {
+	return filepath.Clean(src) + ".cow"
+}
+
+// Provision puts the content of the directory src in dst, trying each
+// method in order for every file. A method that is not supported between
+// the two directories is not tried again.
+//
+// Hardlinked files are the ones of src, so they should only be asked for
+// when the files are never written in place. Only replacing them gives
+// dst its own copy.
+//
+// Files provisioned with PROVISION_COW_HARDLINK are hardlinks to read-only
+// copies kept in CowDir(src), so src never changes. Writing them in place
+// gets refused, unless the process ignores permissions like root does.
+// A copy that changed since is made again the next time
+func Provision(src, dst string, methods ...ProvisionMethod) (*ProvisionStats, error) {
+	start := time.Now()
+	if len(methods) == 0 {
+		methods = DEFAULT_PROVISIONING
+	}
+	for _, method := range methods {
+		switch method {
+		case PROVISION_REFLINK, PROVISION_COW_HARDLINK, PROVISION_HARDLINK, PROVISION_COPY:
+		default:
+			return nil, fmt.Errorf("Unknown provisioning method %s", method)
+		}
+	}
+	stats := &ProvisionStats{Files: make(map[ProvisionMethod]int)}
+	unsupported := make(map[ProvisionMethod]bool)
+
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			return fmt.Errorf("File %s has an unsupported type", path)
+		}
+
+		for _, method := range methods {
+			if unsupported[method] {
+				continue
+			}
+			err := provisionFile(method, path, target, filepath.Join(CowDir(src), rel), info)
+			if err == nil {
+				stats.Files[method]++
+				return nil
+			}
+			if !isUnsupported(err) {
+				return err
+			}
+			unsupported[method] = true
+			os.Remove(target)
+		}
+		return fmt.Errorf("No provisioning method could put %s in %s", path, dst)
+	})
+	stats.Elapsed = time.Since(start)
+	return stats, err
+}
+
+func provisionFile(method ProvisionMethod, src, dst, cow string, info fs.FileInfo) error {
+	switch method {
+	case PROVISION_REFLINK:
+		return reflink(src, dst, info.Mode().Perm())
+	case PROVISION_HARDLINK:
+		return os.Link(src, dst)
+	case PROVISION_COW_HARDLINK:
+		return cowLink(src, cow, dst, info)
+	default:
+		return copyFile(src, dst, info.Mode().Perm())
+	}
+}
+
+// cowLink hardlinks in dst the read-only copy of src kept at cow,
+// making the copy first if it doesn't match src anymore
+func cowLink(src, cow, dst string, info fs.FileInfo) error {
+	perm := info.Mode().Perm() &^ 0222
+	current, err := os.Lstat(cow)
+	if err != nil || !current.Mode().IsRegular() || current.Mode().Perm() != perm ||
+		current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+		if err := makeCowCopy(src, cow, perm, info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return os.Link(cow, dst)
+}
+
+// makeCowCopy replaces the copy at cow by a new one. The workspaces
+// linked to the previous one keep it
+func makeCowCopy(src, cow string, perm fs.FileMode, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(cow), 0700); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(cow), ".provision-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), perm)
+	}
+	if err == nil {
+		err = os.Chtimes(out.Name(), modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), cow)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
+
+// isUnsupported tells if the error means the method cannot
+// work between the two directories, rather than a real failure
+func isUnsupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported) ||
+		errors.Is(err, syscall.EXDEV) ||
+		errors.Is(err, syscall.EOPNOTSUPP) ||
+		errors.Is(err, syscall.ENOTTY) ||
+		errors.Is(err, syscall.EINVAL) ||
+		errors.Is(err, syscall.EPERM) ||
+		errors.Is(err, syscall.EMLINK)
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
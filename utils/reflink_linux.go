@@ -0,0 +1,33 @@
+//go:build linux
+
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// ioctl cloning a whole file, from linux/fs.h
+const FICLONE = 0x40049409
+
+// reflink creates dst sharing the blocks of src
+func reflink(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), FICLONE, in.Fd())
+	if closeErr := out.Close(); errno == 0 && closeErr != nil {
+		return closeErr
+	}
+	if errno != 0 {
+		return &os.PathError{Op: "ficlone", Path: dst, Err: errno}
+	}
+	return nil
+}
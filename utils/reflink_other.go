@@ -0,0 +1,13 @@
+//go:build !linux
+
+package utils
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// reflink is only implemented on Linux
+func reflink(src, dst string, perm fs.FileMode) error {
+	return errors.ErrUnsupported
+}